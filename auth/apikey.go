@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// APIKeyPrefix starts every personal API key, which tells them apart from
+// session tokens and JWTs when sent as a bearer token.
+const APIKeyPrefix = "tba_"
+
+// Scopes an API key can be granted. Sessions and JWTs are not scoped.
+var APIKeyScopes = []string{
+	"posts:read",
+	"posts:write",
+	"categories:write",
+	"comments:read",
+	"comments:write",
+}
+
+// ValidScope reports whether scope is one of APIKeyScopes.
+func ValidScope(scope string) bool {
+	return contains(APIKeyScopes, scope)
+}
+
+// GenerateAPIKey returns a new random API key, the short prefix shown to users
+// to recognise it, and the hash to store in place of the key.
+func GenerateAPIKey() (key, prefix, hash string, err error) {
+	raw, err := generateRandomBytes(32)
+	if err != nil {
+		return "", "", "", err
+	}
+	key = APIKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	return key, key[:len(APIKeyPrefix)+8], HashAPIKey(key), nil
+}
+
+// HashAPIKey returns the hash an API key is stored and looked up by. Keys are
+// long and random, so a plain SHA-256 is enough here unlike for passwords.
+func HashAPIKey(key string) string {
+	return hashToken(key)
+}
+
+// IsAPIKey reports whether a bearer token is an API key.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
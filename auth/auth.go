@@ -11,11 +11,22 @@ import (
 	"golang.org/x/crypto/argon2"
 )
 
+// LoginCredentials identify a user by username or by email address.
 type LoginCredentials struct {
 	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
 	Password string `json:"password"`
 }
 
+// Identifier returns the username, or the email address if no username was
+// given.
+func (lc LoginCredentials) Identifier() string {
+	if lc.Username != "" {
+		return lc.Username
+	}
+	return lc.Email
+}
+
 type AuthParams struct {
 	Memory      uint32
 	Iterations  uint32
@@ -24,6 +35,15 @@ type AuthParams struct {
 	KeyLength   uint32
 }
 
+// DefaultAuthParams are used when no Argon2id parameters are configured.
+var DefaultAuthParams = AuthParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
 var (
 	ErrInvalidHash         = errors.New("the encoded hash is not in the correct format")
 	ErrIncompatibleVersion = errors.New("incompatible version of argon2")
@@ -65,6 +85,29 @@ func ComparePasswordAndHash(password, encodedHash string) (match bool, err error
 	return false, nil
 }
 
+// NeedsRehash reports whether encodedHash was produced with parameters other
+// than p, so that it can be upgraded the next time the password is known.
+func NeedsRehash(encodedHash string, p *AuthParams) (bool, error) {
+	current, salt, hash, err := decodeHash(encodedHash)
+	if err != nil {
+		return false, err
+	}
+	if current.Memory != p.Memory || current.Iterations != p.Iterations || current.Parallelism != p.Parallelism {
+		return true, nil
+	}
+	return uint32(len(salt)) != p.SaltLength || uint32(len(hash)) != p.KeyLength, nil
+}
+
+// RandomToken returns 32 random bytes encoded for use in URLs, for state,
+// nonce and one-off tokens.
+func RandomToken() (string, error) {
+	b, err := generateRandomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 func generateRandomBytes(n uint32) ([]byte, error) {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SessionCookieName is the name of the session cookie without a prefix.
+const SessionCookieName = "session_token"
+
+// CookiePolicy sets the attributes of the session cookie. Development setups
+// served over plain HTTP need Secure off; production should keep the defaults.
+type CookiePolicy struct {
+	Secure   bool
+	HTTPOnly bool
+	SameSite http.SameSite
+	Path     string
+	Domain   string
+	// HostPrefix names the cookie __Host-session_token, which browsers only
+	// accept when it is Secure, has Path=/ and no Domain, so it can't be set
+	// or overwritten from a sibling subdomain.
+	HostPrefix bool
+}
+
+var DefaultCookiePolicy = CookiePolicy{
+	Secure:   true,
+	HTTPOnly: true,
+	SameSite: http.SameSiteLaxMode,
+	Path:     "/",
+}
+
+// Validate reports settings browsers would reject.
+func (p CookiePolicy) Validate() error {
+	if p.HostPrefix && (!p.Secure || p.Path != "/" || p.Domain != "") {
+		return errors.New("a __Host- cookie must be Secure, have Path=/ and no Domain")
+	}
+	if p.SameSite == http.SameSiteNoneMode && !p.Secure {
+		return errors.New("SameSite=None requires a Secure cookie")
+	}
+	return nil
+}
+
+// Name returns the name of the session cookie.
+func (p CookiePolicy) Name() string {
+	if p.HostPrefix {
+		return "__Host-" + SessionCookieName
+	}
+	return SessionCookieName
+}
+
+// ParseSameSite converts lax, strict or none to an http.SameSite.
+func ParseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, errors.New("SameSite must be lax, strict or none")
+}
+
+// orDefault returns p, or the defaults for stores built without a policy.
+func (p CookiePolicy) orDefault() CookiePolicy {
+	if p == (CookiePolicy{}) {
+		return DefaultCookiePolicy
+	}
+	return p
+}
+
+// SetSessionCookie sets the session cookie to token until expires. An empty
+// token removes the cookie.
+func (rc *RedisClient) SetSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	rc.Cookie.setCookie(w, token, expires)
+}
+
+// SessionCookie returns the session token from the cookie of r.
+func (rc *RedisClient) SessionCookie(r *http.Request) (string, error) {
+	return rc.Cookie.cookie(r)
+}
+
+func (p CookiePolicy) setCookie(w http.ResponseWriter, token string, expires time.Time) {
+	p = p.orDefault()
+	c := &http.Cookie{
+		Name:     p.Name(),
+		Value:    token,
+		Expires:  expires,
+		Path:     p.Path,
+		Domain:   p.Domain,
+		Secure:   p.Secure,
+		HttpOnly: p.HTTPOnly,
+		SameSite: p.SameSite,
+	}
+	if token == "" {
+		c.Expires = time.Unix(0, 0)
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+func (p CookiePolicy) cookie(r *http.Request) (string, error) {
+	c, err := r.Cookie(p.orDefault().Name())
+	if err != nil {
+		return "", err
+	}
+	return c.Value, nil
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+)
+
+// CSRFHeader is the header state-changing requests authenticated by the
+// session cookie have to repeat the session's CSRF token in.
+const CSRFHeader = "X-CSRF-Token"
+
+// CSRFToken returns the CSRF token of the session stored under sessionToken.
+// Sessions created before CSRF tokens existed get one on first use.
+func (rc *RedisClient) CSRFToken(ctx context.Context, sessionToken string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	session, err := rc.LookupSession(ctx, sessionToken)
+	if err != nil {
+		return "", err
+	}
+	if session.CSRFToken != "" {
+		return session.CSRFToken, nil
+	}
+	if session.CSRFToken, err = RandomToken(); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	if err := rc.Conn.Set(sessionKey(sessionToken), b, 0).Err(); err != nil {
+		return "", err
+	}
+	return session.CSRFToken, nil
+}
+
+// ValidCSRFToken reports whether token is the CSRF token of session.
+func (s Session) ValidCSRFToken(token string) bool {
+	return s.CSRFToken != "" && subtle.ConstantTimeCompare([]byte(s.CSRFToken), []byte(token)) == 1
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// EmailChangeTTL is how long the link confirming a new email address works.
+const EmailChangeTTL = 24 * time.Hour
+
+// EmailChange is a requested email address that hasn't been confirmed yet.
+type EmailChange struct {
+	UserID int64
+	Email  string
+}
+
+func emailChangeKey(token string) string {
+	return "email_change:" + hashToken(token)
+}
+
+// IssueEmailChange stores c and returns the token that confirms it. Only the
+// hash of the token is stored.
+func (rc *RedisClient) IssueEmailChange(ctx context.Context, c EmailChange) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	token, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	if err := rc.Conn.Set(emailChangeKey(token), b, EmailChangeTTL).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RedeemEmailChange returns the email change confirmed by token. Each token
+// works once.
+func (rc *RedisClient) RedeemEmailChange(ctx context.Context, token string) (EmailChange, error) {
+	if err := ctx.Err(); err != nil {
+		return EmailChange{}, err
+	}
+	var get *redis.StringCmd
+	var del *redis.IntCmd
+	_, err := rc.Conn.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(emailChangeKey(token))
+		del = pipe.Del(emailChangeKey(token))
+		return nil
+	})
+	if err == redis.Nil || del.Val() != 1 {
+		return EmailChange{}, ErrInvalidToken
+	}
+	if err != nil {
+		return EmailChange{}, err
+	}
+	var c EmailChange
+	if err := json.Unmarshal([]byte(get.Val()), &c); err != nil {
+		return EmailChange{}, ErrInvalidToken
+	}
+	return c, nil
+}
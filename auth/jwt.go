@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// SigningKey is a key for signing and verifying access tokens. HS256 keys use
+// Secret, EdDSA keys use PrivateKey and PublicKey.
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	Secret     []byte
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+// TokenIssuer issues and verifies JWT access tokens. New tokens are signed with
+// the key named by ActiveKeyID, while every key in Keys is accepted for
+// verification so that keys can be rotated without logging everyone out.
+type TokenIssuer struct {
+	Keys        []SigningKey
+	ActiveKeyID string
+	Issuer      string
+	AccessTTL   time.Duration
+	RefreshTTL  time.Duration
+}
+
+// Claims are the JWT claims carried by an access token.
+type Claims struct {
+	Subject   string `json:"sub"`
+	Issuer    string `json:"iss,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Enabled reports whether token authentication is configured.
+func (ti *TokenIssuer) Enabled() bool {
+	return ti != nil && len(ti.Keys) > 0
+}
+
+func (ti *TokenIssuer) key(id string) (SigningKey, bool) {
+	for _, k := range ti.Keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// IssueAccessToken returns a signed access token for username and its expiry.
+func (ti *TokenIssuer) IssueAccessToken(username string) (string, time.Time, error) {
+	key, ok := ti.key(ti.ActiveKeyID)
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("signing key %q not configured", ti.ActiveKeyID)
+	}
+	now := time.Now()
+	expiresAt := now.Add(ti.AccessTTL)
+	header, err := json.Marshal(jwtHeader{Algorithm: key.Algorithm, Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims, err := json.Marshal(Claims{
+		Subject:   username,
+		Issuer:    ti.Issuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		ID:        uuid.NewString(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signingInput := b64(header) + "." + b64(claims)
+	sig, err := key.sign([]byte(signingInput))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signingInput + "." + b64(sig), expiresAt, nil
+}
+
+// ParseAccessToken verifies token and returns its claims.
+func (ti *TokenIssuer) ParseAccessToken(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	key, ok := ti.key(header.KeyID)
+	// The algorithm is fixed by the key, never chosen by the token
+	if !ok || header.Algorithm != key.Algorithm {
+		return Claims{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	if claims.Subject == "" || claims.Issuer != ti.Issuer || time.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// LooksLikeJWT tells a JWT apart from the opaque tokens used for sessions.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (k SigningKey) sign(data []byte) ([]byte, error) {
+	switch k.Algorithm {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.Secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case AlgEdDSA:
+		if k.PrivateKey == nil {
+			return nil, fmt.Errorf("key %q can only verify", k.ID)
+		}
+		return ed25519.Sign(k.PrivateKey, data), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+}
+
+func (k SigningKey) verify(data, sig []byte) bool {
+	switch k.Algorithm {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.Secret)
+		mac.Write(data)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case AlgEdDSA:
+		return ed25519.Verify(k.PublicKey, data, sig)
+	}
+	return false
+}
+
+// ParseSigningKeys parses a comma separated list of keys in the form
+// kid:HS256:<base64 secret> or kid:EdDSA:<base64 32 byte seed>.
+func ParseSigningKeys(spec string) ([]SigningKey, error) {
+	var keys []SigningKey
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("signing key %q: want kid:alg:base64", entry)
+		}
+		material, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q: %w", parts[0], err)
+		}
+		key := SigningKey{ID: parts[0], Algorithm: parts[1]}
+		switch parts[1] {
+		case AlgHS256:
+			if len(material) < 32 {
+				return nil, fmt.Errorf("signing key %q: HS256 secrets need at least 32 bytes", key.ID)
+			}
+			key.Secret = material
+		case AlgEdDSA:
+			if len(material) != ed25519.SeedSize {
+				return nil, fmt.Errorf("signing key %q: EdDSA seeds are %d bytes", key.ID, ed25519.SeedSize)
+			}
+			key.PrivateKey = ed25519.NewKeyFromSeed(material)
+			key.PublicKey = key.PrivateKey.Public().(ed25519.PublicKey)
+		default:
+			return nil, fmt.Errorf("signing key %q: unsupported algorithm %q", key.ID, parts[1])
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testIssuer(t *testing.T) *TokenIssuer {
+	t.Helper()
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = 1
+	keys, err := ParseSigningKeys("old:HS256:" + base64.StdEncoding.EncodeToString([]byte("an old secret, at least 32 bytes")) +
+		",new:EdDSA:" + base64.StdEncoding.EncodeToString(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TokenIssuer{Keys: keys, ActiveKeyID: "old", Issuer: "techblogapi", AccessTTL: time.Minute}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ti := testIssuer(t)
+	old, _, err := ti.IssueAccessToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens signed with the old key stay valid after switching to the new
+	// one, until the old key is dropped
+	ti.ActiveKeyID = "new"
+	current, _, err := ti.IssueAccessToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header jwtHeader
+	if err := decodeSegment(strings.Split(current, ".")[0], &header); err != nil || header.KeyID != "new" || header.Algorithm != AlgEdDSA {
+		t.Errorf("header of a token from the new key = %+v, %v", header, err)
+	}
+	for _, token := range []string{old, current} {
+		if c, err := ti.ParseAccessToken(token); err != nil || c.Subject != "alice" {
+			t.Errorf("ParseAccessToken = %+v, %v", c, err)
+		}
+	}
+	ti.Keys = ti.Keys[1:]
+	if _, err := ti.ParseAccessToken(old); err != ErrInvalidToken {
+		t.Errorf("token of a dropped key: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := ti.ParseAccessToken(current); err != nil {
+		t.Errorf("token of the remaining key: %v", err)
+	}
+
+	ti.ActiveKeyID = "old"
+	if _, _, err := ti.IssueAccessToken("alice"); err == nil {
+		t.Error("issued a token with a key that isn't configured")
+	}
+}
+
+func TestParseAccessTokenRefusesForgeries(t *testing.T) {
+	ti := testIssuer(t)
+	token, _, err := ti.IssueAccessToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	header := func(h jwtHeader) string {
+		return b64([]byte(`{"alg":"` + h.Algorithm + `","typ":"JWT","kid":"` + h.KeyID + `"}`))
+	}
+	for name, forged := range map[string]string{
+		"unknown kid":        header(jwtHeader{Algorithm: AlgHS256, KeyID: "other"}) + "." + parts[1] + "." + parts[2],
+		"algorithm swapped":  header(jwtHeader{Algorithm: AlgEdDSA, KeyID: "old"}) + "." + parts[1] + "." + parts[2],
+		"no algorithm":       header(jwtHeader{Algorithm: "none", KeyID: "old"}) + "." + parts[1] + ".",
+		"claims changed":     parts[0] + "." + b64([]byte(`{"sub":"admin","iss":"techblogapi","exp":9999999999}`)) + "." + parts[2],
+		"signature stripped": parts[0] + "." + parts[1] + ".",
+	} {
+		if _, err := ti.ParseAccessToken(forged); err != ErrInvalidToken {
+			t.Errorf("%s: err = %v, want ErrInvalidToken", name, err)
+		}
+	}
+
+	ti.AccessTTL = -time.Second
+	expired, _, err := ti.IssueAccessToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ti.ParseAccessToken(expired); err != ErrInvalidToken {
+		t.Errorf("expired token: err = %v, want ErrInvalidToken", err)
+	}
+}
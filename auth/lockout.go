@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LockoutPolicy controls how repeated failed logins are throttled. Failures are
+// counted separately per username and per client IP; once a counter passes its
+// free attempts every further failure locks that key out for an exponentially
+// growing delay.
+type LockoutPolicy struct {
+	FreeAttempts   int           // failures allowed per username before lockouts start
+	IPFreeAttempts int           // failures allowed per IP before lockouts start
+	BaseDelay      time.Duration // lockout after the first failure past the free attempts
+	MaxDelay       time.Duration // upper bound for a single lockout
+	Window         time.Duration // how long failures are remembered
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+	FreeAttempts:   5,
+	IPFreeAttempts: 20,
+	BaseDelay:      30 * time.Second,
+	MaxDelay:       time.Hour,
+	Window:         24 * time.Hour,
+}
+
+// Delay returns the lockout for the given number of failures, or zero while
+// the failures are still within the free attempts.
+func (p LockoutPolicy) Delay(failures, free int) time.Duration {
+	over := failures - free
+	if over <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := 1; i < over && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// orDefault returns p, or the defaults for stores built without a policy.
+func (p LockoutPolicy) orDefault() LockoutPolicy {
+	if p == (LockoutPolicy{}) {
+		return DefaultLockoutPolicy
+	}
+	return p
+}
+
+func failureKey(kind, id string) string {
+	return fmt.Sprintf("login_failures:%s:%s", kind, id)
+}
+
+func lockKey(kind, id string) string {
+	return fmt.Sprintf("login_lock:%s:%s", kind, id)
+}
+
+// LoginLockedFor returns how long logins for username or from ip are still
+// locked out. A zero duration means the attempt may go ahead.
+func (rc *RedisClient) LoginLockedFor(ctx context.Context, username, ip string) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var wait time.Duration
+	for _, key := range []string{lockKey("user", normalizeUsername(username)), lockKey("ip", ip)} {
+		ttl, err := rc.Conn.TTL(key).Result()
+		if err != nil {
+			return 0, err
+		}
+		if ttl > wait {
+			wait = ttl
+		}
+	}
+	return wait, nil
+}
+
+// RecordLoginFailure counts a failed login for username and ip and returns the
+// lockout that is now in effect, if any.
+func (rc *RedisClient) RecordLoginFailure(ctx context.Context, username, ip string) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	p := rc.Lockout.orDefault()
+	userWait, err := rc.recordFailure("user", normalizeUsername(username), p.FreeAttempts)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := rc.recordFailure("ip", ip, p.IPFreeAttempts)
+	if err != nil {
+		return 0, err
+	}
+	if ipWait > userWait {
+		return ipWait, nil
+	}
+	return userWait, nil
+}
+
+func (rc *RedisClient) recordFailure(kind, id string, free int) (time.Duration, error) {
+	p := rc.Lockout.orDefault()
+	key := failureKey(kind, id)
+	failures, err := rc.Conn.Incr(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if failures == 1 {
+		if err := rc.Conn.Expire(key, p.Window).Err(); err != nil {
+			return 0, err
+		}
+	}
+	delay := p.Delay(int(failures), free)
+	if delay > 0 {
+		if err := rc.Conn.Set(lockKey(kind, id), failures, delay).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return delay, nil
+}
+
+// ClearLoginFailures resets the failure counter for username after a
+// successful login. The IP counter is left alone so that one valid account
+// can't be used to reset the budget for guessing others.
+func (rc *RedisClient) ClearLoginFailures(ctx context.Context, username string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	username = normalizeUsername(username)
+	return rc.Conn.Del(failureKey("user", username), lockKey("user", username)).Err()
+}
+
+// SecondFactorLockedFor returns how long second factors for username are
+// still locked out.
+func (rc *RedisClient) SecondFactorLockedFor(ctx context.Context, username string) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	ttl, err := rc.Conn.TTL(lockKey("2fa", normalizeUsername(username))).Result()
+	if err != nil || ttl < 0 {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+// RecordSecondFactorFailure counts a wrong TOTP or recovery code for username
+// and returns the lockout that is now in effect, if any. A correct password
+// doesn't reset the count, so logging in again buys no further guesses.
+func (rc *RedisClient) RecordSecondFactorFailure(ctx context.Context, username string) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return rc.recordFailure("2fa", normalizeUsername(username), rc.Lockout.orDefault().FreeAttempts)
+}
+
+// ClearSecondFactorFailures resets the second factor counter for username
+// after a login passed every factor.
+func (rc *RedisClient) ClearSecondFactorFailures(ctx context.Context, username string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	username = normalizeUsername(username)
+	return rc.Conn.Del(failureKey("2fa", username), lockKey("2fa", username)).Err()
+}
+
+// UnlockLogin removes the failure counters and any active lockout for the
+// given username and/or ip, second factors included. Empty values are
+// skipped.
+func (rc *RedisClient) UnlockLogin(ctx context.Context, username, ip string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var keys []string
+	if username != "" {
+		username = normalizeUsername(username)
+		keys = append(keys, failureKey("user", username), lockKey("user", username))
+		keys = append(keys, failureKey("2fa", username), lockKey("2fa", username))
+	}
+	if ip != "" {
+		keys = append(keys, failureKey("ip", ip), lockKey("ip", ip))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return rc.Conn.Del(keys...).Err()
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
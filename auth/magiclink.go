@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// MagicLinkPolicy configures passwordless login links. Links are disabled
+// unless Secret is set.
+type MagicLinkPolicy struct {
+	Secret      []byte        // HMAC key the links are signed with
+	TTL         time.Duration // how long a link stays valid
+	PerAddress  int           // links that can be sent to one address per Window
+	PerIP       int           // links one client IP can request per Window
+	Window      time.Duration
+	RedirectURL string // base URL the emailed link points to, the token is appended
+}
+
+var DefaultMagicLinkPolicy = MagicLinkPolicy{
+	TTL:        15 * time.Minute,
+	PerAddress: 3,
+	PerIP:      20,
+	Window:     time.Hour,
+}
+
+// Enabled reports whether magic links can be issued.
+func (p MagicLinkPolicy) Enabled() bool {
+	return len(p.Secret) > 0
+}
+
+func magicLinkKey(nonce string) string {
+	return "magic_link:" + nonce
+}
+
+func magicLinkRateKey(kind, id string) string {
+	return "magic_link_rate:" + kind + ":" + id
+}
+
+// AllowMagicLink counts a request for a magic link to email from ip. It
+// returns how long to wait if either of them has asked for too many links.
+func (rc *RedisClient) AllowMagicLink(ctx context.Context, email, ip string) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	p := rc.MagicLink
+	for _, limit := range []struct {
+		key string
+		max int
+	}{
+		{magicLinkRateKey("email", strings.ToLower(strings.TrimSpace(email))), p.PerAddress},
+		{magicLinkRateKey("ip", ip), p.PerIP},
+	} {
+		n, err := rc.Conn.Incr(limit.key).Result()
+		if err != nil {
+			return 0, err
+		}
+		if n == 1 {
+			rc.Conn.Expire(limit.key, p.Window)
+		}
+		if int(n) > limit.max {
+			ttl, err := rc.Conn.TTL(limit.key).Result()
+			if err != nil || ttl < 0 {
+				ttl = p.Window
+			}
+			return ttl, nil
+		}
+	}
+	return 0, nil
+}
+
+// IssueMagicLink returns a signed single use login token for username. The
+// signature lets forged or expired tokens be refused without a lookup; Redis
+// holds the nonce so each token works only once.
+func (rc *RedisClient) IssueMagicLink(ctx context.Context, username string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	nonce, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
+	if err := rc.Conn.Set(magicLinkKey(nonce), username, rc.MagicLink.TTL).Err(); err != nil {
+		return "", err
+	}
+	return rc.MagicLink.token(nonce, time.Now().Add(rc.MagicLink.TTL)), nil
+}
+
+// RedeemMagicLink checks a token from IssueMagicLink and returns the username
+// it was issued for. The token can't be used again afterwards.
+func (rc *RedisClient) RedeemMagicLink(ctx context.Context, token string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	nonce, err := rc.MagicLink.nonce(token)
+	if err != nil {
+		return "", err
+	}
+
+	var get *redis.StringCmd
+	var del *redis.IntCmd
+	_, err = rc.Conn.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(magicLinkKey(nonce))
+		del = pipe.Del(magicLinkKey(nonce))
+		return nil
+	})
+	if err == redis.Nil || del.Val() != 1 {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+	return get.Val(), nil
+}
+
+// token signs nonce together with the expiry of the link.
+func (p MagicLinkPolicy) token(nonce string, expiry time.Time) string {
+	var exp [8]byte
+	binary.BigEndian.PutUint64(exp[:], uint64(expiry.Unix()))
+	payload := nonce + "." + base64.RawURLEncoding.EncodeToString(exp[:])
+	return payload + "." + p.sign(payload)
+}
+
+// nonce checks the signature and expiry of token and returns its nonce.
+func (p MagicLinkPolicy) nonce(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(p.sign(payload))) {
+		return "", ErrInvalidToken
+	}
+	exp, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(exp) != 8 {
+		return "", ErrInvalidToken
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(exp)) {
+		return "", ErrInvalidToken
+	}
+	return parts[0], nil
+}
+
+func (p MagicLinkPolicy) sign(payload string) string {
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
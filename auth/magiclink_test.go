@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMagicLinkSignature(t *testing.T) {
+	p := DefaultMagicLinkPolicy
+	p.Secret = []byte("magic link secret")
+	expiry := time.Now().Add(time.Minute)
+	token := p.token("nonce", expiry)
+
+	if nonce, err := p.nonce(token); err != nil || nonce != "nonce" {
+		t.Errorf("nonce(%q) = %q, %v, want the signed nonce", token, nonce, err)
+	}
+
+	parts := strings.Split(token, ".")
+	other := p
+	other.Secret = []byte("another secret")
+	later := p.token("nonce", expiry.Add(time.Hour))
+	for name, forged := range map[string]string{
+		"other nonce":       "other." + parts[1] + "." + parts[2],
+		"extended":          parts[0] + "." + strings.Split(later, ".")[1] + "." + parts[2],
+		"other secret":      other.token("nonce", expiry),
+		"no signature":      parts[0] + "." + parts[1] + ".",
+		"missing part":      parts[0] + "." + parts[2],
+		"expired":           p.token("nonce", time.Now().Add(-time.Second)),
+		"expiry not base64": parts[0] + ".!!." + p.sign(parts[0]+".!!"),
+	} {
+		if _, err := p.nonce(forged); err != ErrInvalidToken {
+			t.Errorf("%s: err = %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func TestMemoryStoreMagicLinks(t *testing.T) {
+	policy := DefaultMagicLinkPolicy
+	policy.Secret = []byte("magic link secret")
+	m := NewMemoryStore(DefaultLockoutPolicy, policy, CookiePolicy{})
+	ctx := context.Background()
+
+	token, err := m.IssueMagicLink(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username, err := m.RedeemMagicLink(ctx, token); err != nil || username != "alice" {
+		t.Errorf("RedeemMagicLink = %q, %v, want alice", username, err)
+	}
+	if _, err := m.RedeemMagicLink(ctx, token); err != ErrInvalidToken {
+		t.Errorf("redeeming a link twice: err = %v, want ErrInvalidToken", err)
+	}
+
+	// A validly signed token for a nonce that was never issued is refused too
+	if _, err := m.RedeemMagicLink(ctx, policy.token("never issued", time.Now().Add(time.Minute))); err != ErrInvalidToken {
+		t.Errorf("redeeming an unknown nonce: err = %v, want ErrInvalidToken", err)
+	}
+}
@@ -0,0 +1,526 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryStore is a SessionStore kept in memory, for tests and for running the
+// server without Redis. It behaves like RedisClient, expiring entries after
+// the same TTLs. Nothing it does blocks, so it ignores contexts. Create one
+// with NewMemoryStore.
+type MemoryStore struct {
+	Lockout   LockoutPolicy
+	MagicLink MagicLinkPolicy
+	Cookie    CookiePolicy
+
+	mu           sync.Mutex
+	sessions     map[string]Session
+	counters     map[string]memCounter
+	locks        map[string]time.Time
+	pending      map[string]memPending
+	refresh      map[string]RefreshToken
+	refreshUsed  map[string]bool
+	oidcStates   map[string]memOIDCState
+	magicLinks   map[string]memMagicLink
+	emailChanges map[string]memEmailChange
+}
+
+// memCounter is a counter that starts over once it expires.
+type memCounter struct {
+	n       int
+	expires time.Time
+}
+
+type memPending struct {
+	PendingLogin
+	expires time.Time
+}
+
+type memOIDCState struct {
+	OIDCState
+	expires time.Time
+}
+
+type memMagicLink struct {
+	username string
+	expires  time.Time
+}
+
+type memEmailChange struct {
+	EmailChange
+	expires time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore with the given policies. Zero
+// policies fall back to the defaults, as for RedisClient.
+func NewMemoryStore(lockout LockoutPolicy, magicLink MagicLinkPolicy, cookie CookiePolicy) *MemoryStore {
+	return &MemoryStore{
+		Lockout:      lockout,
+		MagicLink:    magicLink,
+		Cookie:       cookie,
+		sessions:     map[string]Session{},
+		counters:     map[string]memCounter{},
+		locks:        map[string]time.Time{},
+		pending:      map[string]memPending{},
+		refresh:      map[string]RefreshToken{},
+		refreshUsed:  map[string]bool{},
+		oidcStates:   map[string]memOIDCState{},
+		magicLinks:   map[string]memMagicLink{},
+		emailChanges: map[string]memEmailChange{},
+	}
+}
+
+// incr counts one more in the counter under key, starting a new one that
+// lasts for window if there is none.
+func (m *MemoryStore) incr(key string, window time.Duration) memCounter {
+	c, ok := m.counters[key]
+	if !ok || time.Now().After(c.expires) {
+		c = memCounter{expires: time.Now().Add(window)}
+	}
+	c.n++
+	m.counters[key] = c
+	return c
+}
+
+// Sessions
+
+func (m *MemoryStore) CheckSession(w http.ResponseWriter, r *http.Request) int {
+	sessionToken := ""
+	if err := json.NewDecoder(r.Body).Decode(&sessionToken); err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return http.StatusUnauthorized
+	}
+	if _, err := m.LookupSession(r.Context(), sessionToken); err != nil {
+		return http.StatusUnauthorized
+	}
+	return http.StatusOK
+}
+
+func (m *MemoryStore) CreateSession(ctx context.Context, w http.ResponseWriter, lc LoginCredentials) (string, error) {
+	sessionToken := uuid.NewString()
+	expiresAt := time.Now().Add(3600 * time.Second)
+	csrfToken, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.sessions[sessionToken] = Session{Username: lc.Username, Expiry: expiresAt, Created: time.Now(), CSRFToken: csrfToken}
+	m.mu.Unlock()
+	m.SetSessionCookie(w, sessionToken, expiresAt)
+	return sessionToken, nil
+}
+
+func (m *MemoryStore) LookupSession(ctx context.Context, sessionToken string) (Session, error) {
+	if !validSessionToken(sessionToken) {
+		return Session{}, ErrNoSession
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[sessionToken]
+	if !ok {
+		return Session{}, ErrNoSession
+	}
+	if session.isExpired() {
+		delete(m.sessions, sessionToken)
+		return Session{}, ErrNoSession
+	}
+	return session, nil
+}
+
+func (m *MemoryStore) RefreshSession(w http.ResponseWriter, r *http.Request) {
+	sessionToken, err := m.SessionCookie(r)
+	if err != nil {
+		if err == http.ErrNoCookie {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	session, err := m.LookupSession(r.Context(), sessionToken)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	newSessionToken := uuid.NewString()
+	expiresAt := time.Now().Add(3600 * time.Second)
+	m.mu.Lock()
+	m.sessions[newSessionToken] = Session{Username: session.Username, Expiry: expiresAt, Created: time.Now(), CSRFToken: session.CSRFToken}
+	delete(m.sessions, sessionToken)
+	m.mu.Unlock()
+	m.SetSessionCookie(w, newSessionToken, expiresAt)
+}
+
+func (m *MemoryStore) RemoveSession(w http.ResponseWriter, r *http.Request) {
+	sessionToken, err := m.SessionCookie(r)
+	if err != nil {
+		if err == http.ErrNoCookie {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	m.RevokeSession(r.Context(), sessionToken)
+	m.SetSessionCookie(w, "", time.Time{})
+}
+
+func (m *MemoryStore) ListSessions(ctx context.Context, username string) ([]SessionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []SessionInfo
+	for token, session := range m.sessions {
+		if session.isExpired() {
+			delete(m.sessions, token)
+			continue
+		}
+		if username == "" || session.Username == username {
+			sessions = append(sessions, SessionInfo{Token: token, Session: session})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Created.Before(sessions[j].Created) })
+	return sessions, nil
+}
+
+func (m *MemoryStore) RevokeSession(ctx context.Context, sessionToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, sessionToken)
+	return nil
+}
+
+func (m *MemoryStore) RevokeUserSessions(ctx context.Context, username string, keep ...string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	revoked := 0
+	for token, session := range m.sessions {
+		if session.Username != username || contains(keep, token) {
+			continue
+		}
+		delete(m.sessions, token)
+		revoked++
+	}
+	return revoked, nil
+}
+
+func (m *MemoryStore) CSRFToken(ctx context.Context, sessionToken string) (string, error) {
+	session, err := m.LookupSession(ctx, sessionToken)
+	if err != nil {
+		return "", err
+	}
+	if session.CSRFToken != "" {
+		return session.CSRFToken, nil
+	}
+	if session.CSRFToken, err = RandomToken(); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.sessions[sessionToken] = session
+	m.mu.Unlock()
+	return session.CSRFToken, nil
+}
+
+func (m *MemoryStore) SetSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	m.Cookie.setCookie(w, token, expires)
+}
+
+func (m *MemoryStore) SessionCookie(r *http.Request) (string, error) {
+	return m.Cookie.cookie(r)
+}
+
+// Login lockout
+
+func (m *MemoryStore) LoginLockedFor(ctx context.Context, username, ip string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var wait time.Duration
+	for _, key := range []string{lockKey("user", normalizeUsername(username)), lockKey("ip", ip)} {
+		if ttl := time.Until(m.locks[key]); ttl > wait {
+			wait = ttl
+		}
+	}
+	return wait, nil
+}
+
+func (m *MemoryStore) RecordLoginFailure(ctx context.Context, username, ip string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.Lockout.orDefault()
+	userWait := m.recordFailure(p, "user", normalizeUsername(username), p.FreeAttempts)
+	ipWait := m.recordFailure(p, "ip", ip, p.IPFreeAttempts)
+	if ipWait > userWait {
+		return ipWait, nil
+	}
+	return userWait, nil
+}
+
+func (m *MemoryStore) recordFailure(p LockoutPolicy, kind, id string, free int) time.Duration {
+	failures := m.incr(failureKey(kind, id), p.Window)
+	delay := p.Delay(failures.n, free)
+	if delay > 0 {
+		m.locks[lockKey(kind, id)] = time.Now().Add(delay)
+	}
+	return delay
+}
+
+func (m *MemoryStore) ClearLoginFailures(ctx context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	username = normalizeUsername(username)
+	delete(m.counters, failureKey("user", username))
+	delete(m.locks, lockKey("user", username))
+	return nil
+}
+
+func (m *MemoryStore) SecondFactorLockedFor(ctx context.Context, username string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if wait := time.Until(m.locks[lockKey("2fa", normalizeUsername(username))]); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+func (m *MemoryStore) RecordSecondFactorFailure(ctx context.Context, username string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.Lockout.orDefault()
+	return m.recordFailure(p, "2fa", normalizeUsername(username), p.FreeAttempts), nil
+}
+
+func (m *MemoryStore) ClearSecondFactorFailures(ctx context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	username = normalizeUsername(username)
+	delete(m.counters, failureKey("2fa", username))
+	delete(m.locks, lockKey("2fa", username))
+	return nil
+}
+
+func (m *MemoryStore) UnlockLogin(ctx context.Context, username, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if username != "" {
+		username = normalizeUsername(username)
+		for _, kind := range []string{"user", "2fa"} {
+			delete(m.counters, failureKey(kind, username))
+			delete(m.locks, lockKey(kind, username))
+		}
+	}
+	if ip != "" {
+		delete(m.counters, failureKey("ip", ip))
+		delete(m.locks, lockKey("ip", ip))
+	}
+	return nil
+}
+
+// Pending second factors
+
+func (m *MemoryStore) CreatePendingLogin(ctx context.Context, p PendingLogin) (string, error) {
+	token, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[token] = memPending{PendingLogin: p, expires: time.Now().Add(PendingLoginTTL)}
+	return token, nil
+}
+
+func (m *MemoryStore) LookupPendingLogin(ctx context.Context, token string) (PendingLogin, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pending[token]
+	if !ok || time.Now().After(p.expires) {
+		return PendingLogin{}, ErrInvalidToken
+	}
+	return p.PendingLogin, nil
+}
+
+func (m *MemoryStore) FailPendingLogin(ctx context.Context, token string) error {
+	m.mu.Lock()
+	attempts := m.incr(pendingAttemptsKey(token), PendingLoginTTL)
+	m.mu.Unlock()
+	if attempts.n >= maxSecondFactorAttempts {
+		return m.FinishPendingLogin(ctx, token)
+	}
+	return nil
+}
+
+func (m *MemoryStore) FinishPendingLogin(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pending[token]
+	delete(m.pending, token)
+	delete(m.counters, pendingAttemptsKey(token))
+	if !ok || time.Now().After(p.expires) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// Refresh tokens
+
+func (m *MemoryStore) IssueRefreshToken(ctx context.Context, username, family string, ttl time.Duration) (string, error) {
+	token, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
+	if family == "" {
+		family = uuid.NewString()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refresh[hashToken(token)] = RefreshToken{Username: username, Family: family, Expiry: time.Now().Add(ttl)}
+	return token, nil
+}
+
+func (m *MemoryStore) RotateRefreshToken(ctx context.Context, token string, ttl time.Duration) (string, string, error) {
+	hash := hashToken(token)
+	m.mu.Lock()
+	record, ok := m.refresh[hash]
+	if !ok || record.Expiry.Before(time.Now()) {
+		m.mu.Unlock()
+		return "", "", ErrInvalidToken
+	}
+	if m.refreshUsed[hash] {
+		m.revokeRefresh(func(t RefreshToken) bool { return t.Family == record.Family })
+		m.mu.Unlock()
+		return record.Username, "", ErrRefreshTokenReused
+	}
+	m.refreshUsed[hash] = true
+	m.mu.Unlock()
+	newToken, err := m.IssueRefreshToken(ctx, record.Username, record.Family, ttl)
+	if err != nil {
+		return "", "", err
+	}
+	return record.Username, newToken, nil
+}
+
+func (m *MemoryStore) RevokeRefreshToken(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.refresh[hashToken(token)]
+	if !ok {
+		return nil
+	}
+	m.revokeRefresh(func(t RefreshToken) bool { return t.Family == record.Family })
+	return nil
+}
+
+func (m *MemoryStore) RevokeUserRefreshTokens(ctx context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revokeRefresh(func(t RefreshToken) bool { return t.Username == username })
+	return nil
+}
+
+// revokeRefresh drops the refresh tokens matched by match. Their used
+// markers stay, so presenting an exchanged token still counts as reuse.
+func (m *MemoryStore) revokeRefresh(match func(RefreshToken) bool) {
+	for hash, t := range m.refresh {
+		if match(t) {
+			delete(m.refresh, hash)
+		}
+	}
+}
+
+// OIDC state
+
+func (m *MemoryStore) SaveOIDCState(ctx context.Context, state string, s OIDCState, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.oidcStates[state] = memOIDCState{OIDCState: s, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *MemoryStore) TakeOIDCState(ctx context.Context, state string) (OIDCState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.oidcStates[state]
+	delete(m.oidcStates, state)
+	if !ok || time.Now().After(s.expires) {
+		return OIDCState{}, ErrInvalidToken
+	}
+	return s.OIDCState, nil
+}
+
+// Magic links
+
+func (m *MemoryStore) AllowMagicLink(ctx context.Context, email, ip string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.MagicLink
+	for _, limit := range []struct {
+		key string
+		max int
+	}{
+		{magicLinkRateKey("email", strings.ToLower(strings.TrimSpace(email))), p.PerAddress},
+		{magicLinkRateKey("ip", ip), p.PerIP},
+	} {
+		if c := m.incr(limit.key, p.Window); c.n > limit.max {
+			return time.Until(c.expires), nil
+		}
+	}
+	return 0, nil
+}
+
+func (m *MemoryStore) IssueMagicLink(ctx context.Context, username string) (string, error) {
+	nonce, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
+	expiry := time.Now().Add(m.MagicLink.TTL)
+	m.mu.Lock()
+	m.magicLinks[nonce] = memMagicLink{username: username, expires: expiry}
+	m.mu.Unlock()
+	return m.MagicLink.token(nonce, expiry), nil
+}
+
+func (m *MemoryStore) RedeemMagicLink(ctx context.Context, token string) (string, error) {
+	nonce, err := m.MagicLink.nonce(token)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link, ok := m.magicLinks[nonce]
+	delete(m.magicLinks, nonce)
+	if !ok || time.Now().After(link.expires) {
+		return "", ErrInvalidToken
+	}
+	return link.username, nil
+}
+
+// Email changes
+
+func (m *MemoryStore) IssueEmailChange(ctx context.Context, c EmailChange) (string, error) {
+	token, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.emailChanges[hashToken(token)] = memEmailChange{EmailChange: c, expires: time.Now().Add(EmailChangeTTL)}
+	return token, nil
+}
+
+func (m *MemoryStore) RedeemEmailChange(ctx context.Context, token string) (EmailChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.emailChanges[hashToken(token)]
+	delete(m.emailChanges, hashToken(token))
+	if !ok || time.Now().After(c.expires) {
+		return EmailChange{}, ErrInvalidToken
+	}
+	return c.EmailChange, nil
+}
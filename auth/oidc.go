@@ -0,0 +1,433 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// OIDCProvider is an OpenID Connect identity provider that users can sign in
+// with. Endpoints and signing keys are discovered from the issuer, so any
+// compliant provider works, including a local mock server in tests.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	HTTPClient   *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDTokenClaims are the claims of a verified ID token that we use.
+type IDTokenClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          audience     `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	ExpiresAt         int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     flexibleBool `json:"email_verified"`
+	GivenName         string       `json:"given_name"`
+	FamilyName        string       `json:"family_name"`
+	PreferredUsername string       `json:"preferred_username"`
+}
+
+// audience is the aud claim, which can be a single string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// flexibleBool accepts both true and "true", some providers send the latter.
+type flexibleBool bool
+
+func (f *flexibleBool) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	*f = flexibleBool(s == "true")
+	return nil
+}
+
+func (p *OIDCProvider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (p *OIDCProvider) scopes() string {
+	if len(p.Scopes) == 0 {
+		return "openid email profile"
+	}
+	return strings.Join(p.Scopes, " ")
+}
+
+// discover fetches and caches the provider configuration of the issuer.
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("%s: discovery document is for issuer %q", p.Name, d.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// AuthCodeURL returns the URL to send the user to. The PKCE challenge is
+// derived from verifier, which has to be presented again in Exchange.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {p.scopes()},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades an authorization code for tokens and returns the verified
+// ID token claims.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (IDTokenClaims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return IDTokenClaims{}, fmt.Errorf("%s: token endpoint returned %s", p.Name, resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return IDTokenClaims{}, err
+	}
+	if tokens.IDToken == "" {
+		return IDTokenClaims{}, fmt.Errorf("%s: token response has no id_token", p.Name)
+	}
+	return p.VerifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// VerifyIDToken checks the signature and claims of an ID token.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw, nonce string) (IDTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return IDTokenClaims{}, ErrInvalidIDToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return IDTokenClaims{}, ErrInvalidIDToken
+	}
+	key, err := p.signingKey(ctx, header.KeyID)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return IDTokenClaims{}, ErrInvalidIDToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Algorithm != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return IDTokenClaims{}, ErrInvalidIDToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Algorithm != "ES256" || len(sig) != 64 {
+			return IDTokenClaims{}, ErrInvalidIDToken
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return IDTokenClaims{}, ErrInvalidIDToken
+		}
+	default:
+		return IDTokenClaims{}, ErrInvalidIDToken
+	}
+
+	var claims IDTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return IDTokenClaims{}, ErrInvalidIDToken
+	}
+	if claims.Issuer != p.Issuer || claims.Subject == "" || !contains(claims.Audience, p.ClientID) {
+		return IDTokenClaims{}, ErrInvalidIDToken
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return IDTokenClaims{}, ErrInvalidIDToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt || claims.Nonce != nonce {
+		return IDTokenClaims{}, ErrInvalidIDToken
+	}
+	return claims, nil
+}
+
+// signingKey returns the provider key with the given id, fetching the key set
+// again once if the id is unknown, since providers rotate their keys.
+func (p *OIDCProvider) signingKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.KeyID] = pub
+		}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrInvalidIDToken
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: GET %s returned %s", p.Name, url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jwk is a public key from a JSON Web Key Set.
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, errors.New("not a signing key")
+	}
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
+
+// OIDCState is kept server side between redirecting to the provider and the
+// callback, keyed by the state parameter.
+type OIDCState struct {
+	Provider string
+	Nonce    string
+	Verifier string
+	// LinkUsername is the signed in user linking the provider account to
+	// theirs, empty when signing in.
+	LinkUsername string `json:",omitempty"`
+}
+
+// OIDCStateCookieName is the cookie that ties the state parameter to the
+// browser that started the sign in. Without it, an attacker could have a
+// victim's browser finish the attacker's sign in.
+const OIDCStateCookieName = "__Host-oidc_state"
+
+// SetOIDCStateCookie sets the state cookie for ttl. An empty state removes
+// it. The __Host- prefix needs a Secure cookie on Path=/ without Domain.
+func SetOIDCStateCookie(w http.ResponseWriter, state string, ttl time.Duration) {
+	c := &http.Cookie{
+		Name:     OIDCStateCookieName,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		// Lax, since the provider sends the browser back with a top level
+		// navigation from another site
+		SameSite: http.SameSiteLaxMode,
+	}
+	if state == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// OIDCStateCookieMatches reports whether r carries the state cookie for state.
+func OIDCStateCookieMatches(r *http.Request, state string) bool {
+	c, err := r.Cookie(OIDCStateCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) == 1
+}
+
+func oidcStateKey(state string) string {
+	return "oidc_state:" + state
+}
+
+// SaveOIDCState stores s under state for ttl.
+func (rc *RedisClient) SaveOIDCState(ctx context.Context, state string, s OIDCState, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return rc.Conn.Set(oidcStateKey(state), b, ttl).Err()
+}
+
+// TakeOIDCState returns and deletes the state stored under state, so that
+// every authorization response can only be used once.
+func (rc *RedisClient) TakeOIDCState(ctx context.Context, state string) (OIDCState, error) {
+	if err := ctx.Err(); err != nil {
+		return OIDCState{}, err
+	}
+	raw, err := rc.Conn.Get(oidcStateKey(state)).Result()
+	if err == redis.Nil {
+		return OIDCState{}, ErrInvalidToken
+	}
+	if err != nil {
+		return OIDCState{}, err
+	}
+	deleted, err := rc.Conn.Del(oidcStateKey(state)).Result()
+	if err != nil {
+		return OIDCState{}, err
+	}
+	if deleted == 0 {
+		// Someone else used it first
+		return OIDCState{}, ErrInvalidToken
+	}
+	var s OIDCState
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		return OIDCState{}, ErrInvalidToken
+	}
+	return s, nil
+}
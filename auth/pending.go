@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// PendingLoginTTL is how long a user has to enter their second factor.
+const PendingLoginTTL = 5 * time.Minute
+
+// maxSecondFactorAttempts is how many wrong codes a pending login survives.
+const maxSecondFactorAttempts = 5
+
+// PendingLogin is a login that passed the first factor and waits for a TOTP
+// or recovery code. Mode records what to hand out once it is complete.
+type PendingLogin struct {
+	Username string
+	Mode     string
+	// Enroll is set when the role requires two-factor authentication but the
+	// user hasn't set it up yet, so they have to enroll to finish logging in.
+	Enroll bool
+}
+
+func pendingLoginKey(token string) string {
+	return "pending_2fa:" + token
+}
+
+func pendingAttemptsKey(token string) string {
+	return "pending_2fa_attempts:" + token
+}
+
+// CreatePendingLogin stores p and returns the token the client has to present
+// together with its second factor.
+func (rc *RedisClient) CreatePendingLogin(ctx context.Context, p PendingLogin) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	token, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	if err := rc.Conn.Set(pendingLoginKey(token), b, PendingLoginTTL).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// LookupPendingLogin returns the pending login for token.
+func (rc *RedisClient) LookupPendingLogin(ctx context.Context, token string) (PendingLogin, error) {
+	if err := ctx.Err(); err != nil {
+		return PendingLogin{}, err
+	}
+	raw, err := rc.Conn.Get(pendingLoginKey(token)).Result()
+	if err == redis.Nil {
+		return PendingLogin{}, ErrInvalidToken
+	}
+	if err != nil {
+		return PendingLogin{}, err
+	}
+	var p PendingLogin
+	if err := json.Unmarshal([]byte(raw), &p); err != nil {
+		return PendingLogin{}, ErrInvalidToken
+	}
+	return p, nil
+}
+
+// FailPendingLogin counts a wrong second factor and drops the pending login
+// once too many were tried, so codes can't be brute forced.
+func (rc *RedisClient) FailPendingLogin(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	attempts, err := rc.Conn.Incr(pendingAttemptsKey(token)).Result()
+	if err != nil {
+		return err
+	}
+	if attempts == 1 {
+		rc.Conn.Expire(pendingAttemptsKey(token), PendingLoginTTL)
+	}
+	if attempts >= maxSecondFactorAttempts {
+		return rc.FinishPendingLogin(ctx, token)
+	}
+	return nil
+}
+
+// FinishPendingLogin removes a pending login once it is complete. It reports
+// ErrInvalidToken if the login was already finished by another request.
+func (rc *RedisClient) FinishPendingLogin(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deleted, err := rc.Conn.Del(pendingLoginKey(token)).Result()
+	if err != nil {
+		return err
+	}
+	rc.Conn.Del(pendingAttemptsKey(token))
+	if deleted == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// PasswordPolicy decides which new passwords are accepted.
+type PasswordPolicy struct {
+	MinLength int // in characters
+	// MaxLength bounds the passwords that are scored at all, since scoring
+	// takes time that grows much faster than the length
+	MaxLength int
+	MinScore  int // minimum PasswordStrength, 0 to 4
+	// BreachedPath points to known breached passwords in the k-anonymity
+	// format of Have I Been Pwned: either a directory of range files named
+	// after the first five hex digits of the SHA-1 hash (e.g. 21BD1 or
+	// 21BD1.txt) holding SUFFIX:COUNT lines, or one file of HASH:COUNT lines
+	// sorted by hash. Empty disables the check.
+	BreachedPath string
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: 10,
+	MaxLength: 128,
+	MinScore:  2,
+}
+
+// Check returns what is wrong with password for a user with the given
+// username and email, or nothing if it is acceptable. The error is only set
+// if the breached password list couldn't be read.
+func (p PasswordPolicy) Check(password, username, email string) ([]string, error) {
+	var problems []string
+	n := utf8.RuneCountInString(password)
+	if p.MaxLength > 0 && n > p.MaxLength {
+		return []string{fmt.Sprintf("must be at most %d characters", p.MaxLength)}, nil
+	}
+	if n < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	lower := strings.ToLower(password)
+	if username != "" && lower == strings.ToLower(username) {
+		problems = append(problems, "must not be the username")
+	}
+	if email != "" && (lower == strings.ToLower(email) || lower == strings.ToLower(strings.SplitN(email, "@", 2)[0])) {
+		problems = append(problems, "must not be the email address")
+	}
+	if password != "" && PasswordStrength(password, username, email) < p.MinScore {
+		problems = append(problems, "is too easy to guess; use a longer phrase or fewer common words and patterns")
+	}
+	if password != "" && p.BreachedPath != "" {
+		breached, err := p.breached(password)
+		if err != nil {
+			return problems, err
+		}
+		if breached {
+			problems = append(problems, "has appeared in a data breach and must not be used")
+		}
+	}
+	return problems, nil
+}
+
+// breached looks the SHA-1 hash of password up in the breached password list.
+func (p PasswordPolicy) breached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	info, err := os.Stat(p.BreachedPath)
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return searchSortedHashes(p.BreachedPath, hash)
+	}
+	prefix, suffix := hash[:5], hash[5:]
+	for _, name := range []string{prefix, prefix + ".txt", strings.ToLower(prefix), strings.ToLower(prefix) + ".txt"} {
+		f, err := os.Open(filepath.Join(p.BreachedPath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if strings.EqualFold(hashField(s.Text()), suffix) {
+				return true, nil
+			}
+		}
+		return false, s.Err()
+	}
+	// No range file means no breached password has this prefix
+	return false, nil
+}
+
+// searchSortedHashes binary searches a file of HASH:COUNT lines sorted by
+// hash, so even the full list of several gigabytes needs only a few reads.
+func searchSortedHashes(path, hash string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	// lineAt returns the first full line starting after offset
+	lineAt := func(offset int64) (string, error) {
+		r := bufio.NewReader(io.NewSectionReader(f, offset, info.Size()-offset))
+		if offset > 0 {
+			if _, err := r.ReadString('\n'); err != nil {
+				return "", err
+			}
+		}
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimSpace(line), err
+	}
+
+	lo, hi := int64(0), info.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		line, err := lineAt(mid)
+		if err == io.EOF {
+			hi = mid
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		switch c := bytes.Compare([]byte(strings.ToUpper(hashField(line))), []byte(hash)); {
+		case c == 0:
+			return true, nil
+		case c < 0:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	// The search skips the line at offset 0, check it separately
+	line, err := lineAt(0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return strings.EqualFold(hashField(line), hash), nil
+}
+
+func hashField(line string) string {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		return strings.TrimSpace(line[:i])
+	}
+	return strings.TrimSpace(line)
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sha1Hex returns the upper case SHA-1 hash of password, as breach lists
+// have them.
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	p := DefaultPasswordPolicy
+	check := func(password, username, email string) []string {
+		t.Helper()
+		problems, err := p.Check(password, username, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return problems
+	}
+
+	if problems := check("k7#Qm2!vZp9@", "alice", "alice@example.com"); len(problems) != 0 {
+		t.Errorf("strong password: problems = %v", problems)
+	}
+	for _, tt := range []struct {
+		password, username, email string
+		want                      string
+	}{
+		{"k7#Qm2!v", "alice", "", "at least 10 characters"},
+		{"Bartholomew-1987", "bartholomew-1987", "", "must not be the username"},
+		{"bartholomew.jones", "bob", "Bartholomew.Jones@example.com", "must not be the email address"},
+		{"password123!", "alice", "", "too easy to guess"},
+		{strings.Repeat("k7#Qm2!vZp9@", 11), "alice", "", "at most 128 characters"},
+	} {
+		problems := check(tt.password, tt.username, tt.email)
+		if !strings.Contains(strings.Join(problems, "; "), tt.want) {
+			t.Errorf("Check(%q) = %v, want a problem with %q", tt.password, problems, tt.want)
+		}
+	}
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	breached, fine := "k7#Qm2!vZp9@", "vB4$wL9!rT2#"
+	hash := sha1Hex(breached)
+
+	// A directory of range files
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte("0000000000000000000000000000000000A:3\r\n"+hash[5:]+":42\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// One file sorted by hash, with the breached password in the middle and
+	// at either end
+	var lines []string
+	for _, h := range []string{"0000000000000000000000000000000000000001", hash, "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"} {
+		lines = append(lines, h+":1")
+	}
+	sorted := filepath.Join(t.TempDir(), "pwned.txt")
+	if err := os.WriteFile(sorted, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	first := filepath.Join(t.TempDir(), "first.txt")
+	if err := os.WriteFile(first, []byte(hash+":1\nFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{dir, sorted, first} {
+		p := DefaultPasswordPolicy
+		p.BreachedPath = path
+		problems, err := p.Check(breached, "alice", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(strings.Join(problems, "; "), "data breach") {
+			t.Errorf("%s: Check(breached) = %v, want it refused", path, problems)
+		}
+		if problems, err := p.Check(fine, "alice", ""); err != nil || len(problems) != 0 {
+			t.Errorf("%s: Check(fine) = %v, %v", path, problems, err)
+		}
+	}
+
+	p := DefaultPasswordPolicy
+	p.BreachedPath = filepath.Join(dir, "missing")
+	if _, err := p.Check(fine, "alice", ""); err == nil {
+		t.Error("Check with a missing breach list returned no error")
+	}
+}
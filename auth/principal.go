@@ -0,0 +1,38 @@
+package auth
+
+import "context"
+
+// How a request was authenticated.
+const (
+	MethodCookie  = "cookie"  // session token in the session cookie
+	MethodSession = "session" // session token sent as a bearer token
+	MethodJWT     = "jwt"     // JWT access token sent as a bearer token
+	MethodAPIKey  = "api_key" // personal API key sent as a bearer token
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Username string
+	Method   string
+	// Scopes limit what an API key may do. Nil means the full access of the
+	// user, as for sessions and JWTs.
+	Scopes []string
+}
+
+// HasScope reports whether the principal may act within scope.
+func (p Principal) HasScope(scope string) bool {
+	return p.Scopes == nil || contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal stored in ctx by WithPrincipal.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
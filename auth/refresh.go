@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+)
+
+// ErrRefreshTokenReused means a refresh token was presented after it had
+// already been exchanged. The whole token family is revoked when that happens,
+// since either the client or an attacker holds a stolen copy.
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+
+// RefreshToken is what Redis stores for an issued refresh token. The token
+// itself is never stored, only its SHA-256 hash is used as the key.
+type RefreshToken struct {
+	Username string
+	Family   string
+	Expiry   time.Time
+}
+
+func refreshKey(hash string) string {
+	return "refresh:" + hash
+}
+
+func refreshUsedKey(hash string) string {
+	return "refresh_used:" + hash
+}
+
+func refreshFamilyKey(family string) string {
+	return "refresh_family:" + family
+}
+
+func userRefreshKey(username string) string {
+	return "user_refresh:" + username
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueRefreshToken creates a refresh token for username valid for ttl. An
+// empty family starts a new token family, i.e. a new login.
+func (rc *RedisClient) IssueRefreshToken(ctx context.Context, username, family string, ttl time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	raw, err := generateRandomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	if family == "" {
+		family = uuid.NewString()
+	}
+	record, err := json.Marshal(RefreshToken{Username: username, Family: family, Expiry: time.Now().Add(ttl)})
+	if err != nil {
+		return "", err
+	}
+	hash := hashToken(token)
+	_, err = rc.Conn.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(refreshKey(hash), record, ttl)
+		pipe.SAdd(refreshFamilyKey(family), hash)
+		pipe.Expire(refreshFamilyKey(family), ttl)
+		pipe.SAdd(userRefreshKey(username), family)
+		pipe.Expire(userRefreshKey(username), ttl)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RotateRefreshToken exchanges token for a new refresh token in the same
+// family. It returns the username the token was issued to, also together
+// with ErrRefreshTokenReused when the family was revoked because token had
+// been used before.
+func (rc *RedisClient) RotateRefreshToken(ctx context.Context, token string, ttl time.Duration) (string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	hash := hashToken(token)
+	record, err := rc.refreshToken(hash)
+	if err != nil {
+		return "", "", err
+	}
+	// Marking the token as used is atomic, so of two concurrent exchanges
+	// only one wins and the other counts as reuse
+	first, err := rc.Conn.SetNX(refreshUsedKey(hash), 1, time.Until(record.Expiry)).Result()
+	if err != nil {
+		return "", "", err
+	}
+	if !first {
+		if err := rc.revokeRefreshFamily(record.Username, record.Family); err != nil {
+			return "", "", err
+		}
+		return record.Username, "", ErrRefreshTokenReused
+	}
+	newToken, err := rc.IssueRefreshToken(ctx, record.Username, record.Family, ttl)
+	if err != nil {
+		return "", "", err
+	}
+	return record.Username, newToken, nil
+}
+
+// RevokeRefreshToken revokes token together with every token rotated from the
+// same login.
+func (rc *RedisClient) RevokeRefreshToken(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	record, err := rc.refreshToken(hashToken(token))
+	if err == ErrInvalidToken {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return rc.revokeRefreshFamily(record.Username, record.Family)
+}
+
+// RevokeUserRefreshTokens revokes every refresh token issued to username.
+func (rc *RedisClient) RevokeUserRefreshTokens(ctx context.Context, username string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	families, err := rc.Conn.SMembers(userRefreshKey(username)).Result()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if err := rc.revokeRefreshFamily(username, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rc *RedisClient) refreshToken(hash string) (RefreshToken, error) {
+	raw, err := rc.Conn.Get(refreshKey(hash)).Result()
+	if err == redis.Nil {
+		return RefreshToken{}, ErrInvalidToken
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	var record RefreshToken
+	if err := json.Unmarshal([]byte(raw), &record); err != nil {
+		return RefreshToken{}, ErrInvalidToken
+	}
+	if record.Expiry.Before(time.Now()) {
+		return RefreshToken{}, ErrInvalidToken
+	}
+	return record, nil
+}
+
+func (rc *RedisClient) revokeRefreshFamily(username, family string) error {
+	hashes, err := rc.Conn.SMembers(refreshFamilyKey(family)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{refreshFamilyKey(family)}
+	for _, hash := range hashes {
+		keys = append(keys, refreshKey(hash))
+	}
+	if err := rc.Conn.Del(keys...).Err(); err != nil {
+		return err
+	}
+	return rc.Conn.SRem(userRefreshKey(username), family).Err()
+}
@@ -1,24 +1,42 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/google/uuid"
 )
 
+// RedisClient is the SessionStore on Redis. The client it uses can't abandon
+// a command once sent, so methods fail straight away when their context is
+// already done and the connection's timeouts bound the rest; see
+// ConnectRedis.
 type RedisClient struct {
-	Conn *redis.Client
+	Conn      *redis.Client
+	Lockout   LockoutPolicy
+	MagicLink MagicLinkPolicy
+	Cookie    CookiePolicy
 }
 
-func ConnectRedis() (*redis.Client, error) {
+var ErrNoSession = errors.New("no valid session")
+
+// ConnectRedis connects to the Redis server at addr. timeout limits dialing
+// and each read and write; zero keeps the client's defaults.
+func ConnectRedis(addr string, timeout time.Duration) (*redis.Client, error) {
 	redisClient := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
+		Addr:         addr,
+		Password:     "",
+		DB:           0,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
 	})
 	_, err := redisClient.Ping().Result()
 	if err != nil {
@@ -29,8 +47,10 @@ func ConnectRedis() (*redis.Client, error) {
 
 // struct to store user session in redis
 type Session struct {
-	Username string
-	Expiry   time.Time
+	Username  string
+	Expiry    time.Time
+	Created   time.Time
+	CSRFToken string
 }
 
 func (s Session) isExpired() bool {
@@ -57,57 +77,83 @@ func (rc *RedisClient) CheckSession(w http.ResponseWriter, r *http.Request) int
 		return http.StatusUnauthorized
 	}
 
-	// Check session token from cookie and redis
-	sessionTokenRedis, err := rc.Conn.Get(sessionToken).Result()
-	fmt.Println("sessionTokenRedis ", sessionTokenRedis)
-	jsonMap := Session{}
-	json.Unmarshal([]byte(sessionTokenRedis), &jsonMap)
-	if err != nil {
-		fmt.Println("status unauthorized")
+	if _, err := rc.LookupSession(r.Context(), sessionToken); err != nil {
 		return http.StatusUnauthorized
 	}
+	return http.StatusOK
+}
 
-	// Delete session token if expired
-	if jsonMap.isExpired() {
-		fmt.Println("jsonmapisexpired")
-		rc.Conn.Del(sessionToken)
-		return http.StatusUnauthorized
+// validSessionToken reports whether token has the form of a session token, a
+// uuid. Anything else is refused before the store is asked for it.
+func validSessionToken(token string) bool {
+	id, err := uuid.Parse(token)
+	return err == nil && id.String() == token
+}
+
+// sessionKey is the Redis key of the session for token. The prefix keeps
+// sessions apart from the other records, so no other key can be presented
+// as a session token.
+func sessionKey(token string) string {
+	return "session:" + token
+}
+
+// LookupSession loads the session stored under sessionToken, removing it if
+// it has expired.
+func (rc *RedisClient) LookupSession(ctx context.Context, sessionToken string) (Session, error) {
+	if err := ctx.Err(); err != nil {
+		return Session{}, err
 	}
-	fmt.Println("statusok")
-	return http.StatusOK
+	if !validSessionToken(sessionToken) {
+		return Session{}, ErrNoSession
+	}
+	sessionTokenRedis, err := rc.Conn.Get(sessionKey(sessionToken)).Result()
+	if err == redis.Nil {
+		return Session{}, ErrNoSession
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	session := Session{}
+	if err := json.Unmarshal([]byte(sessionTokenRedis), &session); err != nil {
+		return Session{}, ErrNoSession
+	}
+	if session.isExpired() {
+		rc.RevokeSession(ctx, sessionToken)
+		return Session{}, ErrNoSession
+	}
+	return session, nil
 }
 
-func (rc *RedisClient) CreateSession(w http.ResponseWriter, lc LoginCredentials) string {
+func (rc *RedisClient) CreateSession(ctx context.Context, w http.ResponseWriter, lc LoginCredentials) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	// Create new random session token using uuid
 	sessionToken := uuid.NewString()
-	fmt.Println("createSessionToken ", sessionToken)
 	expiresAt := time.Now().Add(3600 * time.Second)
-	fmt.Println("expiresAt ", expiresAt)
 
 	// Setting token in Redis
-	json, err := json.Marshal(Session{Username: lc.Username, Expiry: expiresAt})
-	rc.Conn.Set(sessionToken, json, 0).Err()
+	csrfToken, err := RandomToken()
 	if err != nil {
-		fmt.Println(err)
+		return "", err
 	}
-
-	getSessionToken, err := rc.Conn.Get(sessionToken).Result()
+	json, err := json.Marshal(Session{Username: lc.Username, Expiry: expiresAt, Created: time.Now(), CSRFToken: csrfToken})
 	if err != nil {
-		fmt.Println(err)
+		return "", err
+	}
+	if err := rc.Conn.Set(sessionKey(sessionToken), json, 0).Err(); err != nil {
+		return "", err
 	}
-	fmt.Println("getSessionToken ", getSessionToken)
+	rc.indexSession(lc.Username, sessionToken)
 
-	// Set the client cookie for "session_token" as the session token generated and expiry of 120s
-	http.SetCookie(w, &http.Cookie{
-		Name:    "session_token",
-		Value:   sessionToken,
-		Expires: expiresAt,
-	})
-	return sessionToken
+	// Set the client cookie for "session_token" as the session token generated
+	rc.SetSessionCookie(w, sessionToken, expiresAt)
+	return sessionToken, nil
 }
 
 func (rc *RedisClient) RefreshSession(w http.ResponseWriter, r *http.Request) {
-	c, err := r.Cookie("session_token")
+	ctx := r.Context()
+	sessionToken, err := rc.SessionCookie(r)
 	if err != nil {
 		if err == http.ErrNoCookie {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -116,37 +162,37 @@ func (rc *RedisClient) RefreshSession(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	sessionToken := c.Value
 
-	_, err = rc.Conn.Get(sessionToken).Result()
+	session, err := rc.LookupSession(ctx, sessionToken)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
+		return
 	}
 
 	// Create new session for current user if session is valid
 	newSessionToken := uuid.NewString()
 	expiresAt := time.Now().Add(3600 * time.Second)
 
-	newSessionTokenString, err := json.Marshal(Session{Username: newSessionToken, Expiry: expiresAt})
+	// The CSRF token moves to the new session, so pages already holding it
+	// keep working
+	newSessionTokenString, err := json.Marshal(Session{Username: session.Username, Expiry: expiresAt, Created: time.Now(), CSRFToken: session.CSRFToken})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	rc.Conn.Set(newSessionToken, newSessionTokenString, 0).Err()
+	rc.Conn.Set(sessionKey(newSessionToken), newSessionTokenString, 0).Err()
+	rc.indexSession(session.Username, newSessionToken)
 
 	// Delete previous session
-	rc.Conn.Del(sessionToken)
+	rc.RevokeSession(ctx, sessionToken)
 
 	// Set new token as user's session_token cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:    "session_token",
-		Value:   newSessionToken,
-		Expires: time.Now().Add(3600 * time.Second),
-	})
+	rc.SetSessionCookie(w, newSessionToken, expiresAt)
 }
 
 func (rc *RedisClient) RemoveSession(w http.ResponseWriter, r *http.Request) {
-	c, err := r.Cookie("session_token")
+	ctx := r.Context()
+	sessionToken, err := rc.SessionCookie(r)
 	if err != nil {
 		if err == http.ErrNoCookie {
 			// Return unauthorized if cookie is not set
@@ -157,15 +203,139 @@ func (rc *RedisClient) RemoveSession(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	sessionToken := c.Value
 
 	// Removing Session from Redis
-	rc.Conn.Del(sessionToken).Err()
+	rc.RevokeSession(ctx, sessionToken)
 
 	// Remove Cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:    "session_token",
-		Value:   "",
-		Expires: time.Now(),
-	})
+	rc.SetSessionCookie(w, "", time.Time{})
+}
+
+// SessionInfo describes a stored session for listing and revocation.
+type SessionInfo struct {
+	Token string
+	Session
+}
+
+func userSessionsKey(username string) string {
+	return "user_sessions:" + username
+}
+
+// indexSession remembers sessionToken under username so that all sessions of
+// a user can be listed and revoked.
+func (rc *RedisClient) indexSession(username, sessionToken string) {
+	if err := rc.Conn.SAdd(userSessionsKey(username), sessionToken).Err(); err != nil {
+		log.Print(err)
+	}
+}
+
+// ListSessions returns the live sessions of username, or of every user when
+// username is empty. Index entries for sessions that are gone are pruned.
+func (rc *RedisClient) ListSessions(ctx context.Context, username string) ([]SessionInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	usernames := []string{username}
+	if username == "" {
+		var err error
+		usernames, err = rc.indexedUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var sessions []SessionInfo
+	for _, u := range usernames {
+		tokens, err := rc.Conn.SMembers(userSessionsKey(u)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, token := range tokens {
+			session, err := rc.LookupSession(ctx, token)
+			if err == ErrNoSession {
+				rc.Conn.SRem(userSessionsKey(u), token)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			sessions = append(sessions, SessionInfo{Token: token, Session: session})
+		}
+	}
+	return sessions, nil
+}
+
+func (rc *RedisClient) indexedUsers(ctx context.Context) ([]string, error) {
+	var usernames []string
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		keys, next, err := rc.Conn.Scan(cursor, userSessionsKey("*"), 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			usernames = append(usernames, strings.TrimPrefix(key, userSessionsKey("")))
+		}
+		if next == 0 {
+			return usernames, nil
+		}
+		cursor = next
+	}
+}
+
+// RevokeSession deletes the session stored under sessionToken.
+func (rc *RedisClient) RevokeSession(ctx context.Context, sessionToken string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !validSessionToken(sessionToken) {
+		return nil
+	}
+	raw, err := rc.Conn.Get(sessionKey(sessionToken)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	session := Session{}
+	if json.Unmarshal([]byte(raw), &session) == nil && session.Username != "" {
+		rc.Conn.SRem(userSessionsKey(session.Username), sessionToken)
+	}
+	return rc.Conn.Del(sessionKey(sessionToken)).Err()
+}
+
+// RevokeUserSessions deletes every session of username except the ones listed
+// in keep, and returns how many were deleted.
+func (rc *RedisClient) RevokeUserSessions(ctx context.Context, username string, keep ...string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	tokens, err := rc.Conn.SMembers(userSessionsKey(username)).Result()
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, token := range tokens {
+		if contains(keep, token) {
+			continue
+		}
+		if err := rc.Conn.Del(sessionKey(token)).Err(); err != nil {
+			return revoked, err
+		}
+		rc.Conn.SRem(userSessionsKey(username), token)
+		revoked++
+	}
+	return revoked, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestValidSessionToken(t *testing.T) {
+	token := uuid.NewString()
+	if !validSessionToken(token) {
+		t.Errorf("validSessionToken(%q) = false, want true", token)
+	}
+	// Other records share the Redis keyspace and must never pass as sessions
+	for _, bad := range []string{
+		"",
+		refreshKey(hashToken("a refresh token")),
+		pendingLoginKey("token"),
+		oidcStateKey("state"),
+		userSessionsKey("alice"),
+		sessionKey(token),
+		"{" + token + "}",
+		"urn:uuid:" + token,
+	} {
+		if validSessionToken(bad) {
+			t.Errorf("validSessionToken(%q) = true, want false", bad)
+		}
+	}
+}
+
+func TestMemoryStoreSessions(t *testing.T) {
+	m := NewMemoryStore(DefaultLockoutPolicy, MagicLinkPolicy{}, CookiePolicy{})
+	ctx := context.Background()
+	token, err := m.CreateSession(ctx, httptest.NewRecorder(), LoginCredentials{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := m.LookupSession(ctx, token); err != nil || s.Username != "alice" || s.CSRFToken == "" {
+		t.Errorf("LookupSession(%q) = %+v, %v", token, s, err)
+	}
+	if _, err := m.LookupSession(ctx, refreshKey(hashToken(token))); err != ErrNoSession {
+		t.Errorf("LookupSession of a refresh token key = %v, want ErrNoSession", err)
+	}
+	if n, err := m.RevokeUserSessions(ctx, "alice"); err != nil || n != 1 {
+		t.Errorf("RevokeUserSessions = %d, %v, want 1", n, err)
+	}
+	if _, err := m.LookupSession(ctx, token); err != ErrNoSession {
+		t.Errorf("LookupSession after revoking = %v, want ErrNoSession", err)
+	}
+}
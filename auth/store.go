@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// SessionStore keeps sessions and the short lived state around logging in:
+// failed login counters, pending second factors, refresh tokens, OIDC state,
+// magic links and email changes. RedisClient implements it on Redis and
+// MemoryStore in memory.
+type SessionStore interface {
+	CheckSession(w http.ResponseWriter, r *http.Request) int
+	CreateSession(ctx context.Context, w http.ResponseWriter, lc LoginCredentials) (string, error)
+	LookupSession(ctx context.Context, sessionToken string) (Session, error)
+	RefreshSession(w http.ResponseWriter, r *http.Request)
+	RemoveSession(w http.ResponseWriter, r *http.Request)
+	ListSessions(ctx context.Context, username string) ([]SessionInfo, error)
+	RevokeSession(ctx context.Context, sessionToken string) error
+	RevokeUserSessions(ctx context.Context, username string, keep ...string) (int, error)
+	CSRFToken(ctx context.Context, sessionToken string) (string, error)
+	SetSessionCookie(w http.ResponseWriter, token string, expires time.Time)
+	SessionCookie(r *http.Request) (string, error)
+
+	LoginLockedFor(ctx context.Context, username, ip string) (time.Duration, error)
+	RecordLoginFailure(ctx context.Context, username, ip string) (time.Duration, error)
+	ClearLoginFailures(ctx context.Context, username string) error
+	SecondFactorLockedFor(ctx context.Context, username string) (time.Duration, error)
+	RecordSecondFactorFailure(ctx context.Context, username string) (time.Duration, error)
+	ClearSecondFactorFailures(ctx context.Context, username string) error
+	UnlockLogin(ctx context.Context, username, ip string) error
+
+	CreatePendingLogin(ctx context.Context, p PendingLogin) (string, error)
+	LookupPendingLogin(ctx context.Context, token string) (PendingLogin, error)
+	FailPendingLogin(ctx context.Context, token string) error
+	FinishPendingLogin(ctx context.Context, token string) error
+
+	IssueRefreshToken(ctx context.Context, username, family string, ttl time.Duration) (string, error)
+	RotateRefreshToken(ctx context.Context, token string, ttl time.Duration) (string, string, error)
+	RevokeRefreshToken(ctx context.Context, token string) error
+	RevokeUserRefreshTokens(ctx context.Context, username string) error
+
+	SaveOIDCState(ctx context.Context, state string, s OIDCState, ttl time.Duration) error
+	TakeOIDCState(ctx context.Context, state string) (OIDCState, error)
+
+	AllowMagicLink(ctx context.Context, email, ip string) (time.Duration, error)
+	IssueMagicLink(ctx context.Context, username string) (string, error)
+	RedeemMagicLink(ctx context.Context, token string) (string, error)
+
+	IssueEmailChange(ctx context.Context, c EmailChange) (string, error)
+	RedeemEmailChange(ctx context.Context, token string) (EmailChange, error)
+}
+
+var (
+	_ SessionStore = (*RedisClient)(nil)
+	_ SessionStore = (*MemoryStore)(nil)
+)
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// PasswordStrength scores password from 0 (trivial to guess) to 4 (very hard)
+// in the spirit of zxcvbn: it estimates how many guesses an attacker who
+// knows common passwords, keyboard walks, sequences, repeats and l33t
+// substitutions would need. userInputs, such as the username and email, are
+// treated as the most likely guesses of all.
+func PasswordStrength(password string, userInputs ...string) int {
+	return strengthScore(estimateGuesses(password, userInputs))
+}
+
+// strengthScore maps log10 of the guesses needed to a score, using the
+// thresholds of zxcvbn.
+func strengthScore(log10Guesses float64) int {
+	switch {
+	case log10Guesses < 3:
+		return 0
+	case log10Guesses < 6:
+		return 1
+	case log10Guesses < 8:
+		return 2
+	case log10Guesses < 10:
+		return 3
+	}
+	return 4
+}
+
+// commonPasswords are among the most used passwords, most common first.
+// Substrings of at least four characters are matched too, so variations like
+// "password123!" are caught.
+var commonPasswords = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345", "1234",
+	"111111", "1234567", "dragon", "123123", "baseball", "abc123", "football",
+	"monkey", "letmein", "shadow", "master", "696969", "mustang", "michael",
+	"superman", "1234567890", "access", "batman", "trustno1", "hello",
+	"charlie", "donald", "iloveyou", "princess", "welcome", "login", "admin",
+	"starwars", "solo", "passw0rd", "freedom", "whatever", "qazwsx", "ninja",
+	"azerty", "sunshine", "flower", "hottie", "loveme", "zaq1zaq1", "secret",
+	"summer", "winter", "spring", "autumn", "jordan", "hunter", "ranger",
+	"buster", "soccer", "harley", "thomas", "tigger", "robert", "jennifer",
+	"jessica", "pepper", "daniel", "killer", "cheese", "computer", "internet",
+	"blog", "techblog", "changeme", "default", "guest", "root", "test",
+	"orange", "banana", "cookie", "maggie", "ginger", "purple",
+	"chelsea", "liverpool", "arsenal", "samsung", "google", "yankees",
+	"matrix", "silver", "golden", "diamond", "love", "angel", "lovely",
+}
+
+var leetSubstitutions = strings.NewReplacer(
+	"@", "a", "4", "a", "8", "b", "(", "c", "3", "e", "6", "g", "1", "i",
+	"!", "i", "|", "l", "0", "o", "$", "s", "5", "s", "7", "t", "+", "t", "2", "z",
+)
+
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik,9ol.0p;/", "qazwsxedcrfvtgbyhnujmikolp",
+}
+
+// estimateGuesses returns log10 of the number of guesses needed for password.
+// It covers the password left to right with the cheapest match at each
+// position: a known word, a repeat, a sequence, a keyboard walk, or a single
+// character guessed by brute force.
+func estimateGuesses(password string, userInputs []string) float64 {
+	runes := []rune(password)
+	lower := []rune(strings.ToLower(password))
+	if len(lower) != len(runes) {
+		lower = runes
+	}
+	unleet := []rune(leetSubstitutions.Replace(string(lower)))
+	if len(unleet) != len(lower) {
+		unleet = lower
+	}
+	var inputs []string
+	for _, in := range userInputs {
+		in = strings.ToLower(strings.TrimSpace(in))
+		if in == "" {
+			continue
+		}
+		inputs = append(inputs, in)
+		if at := strings.IndexByte(in, '@'); at > 0 {
+			inputs = append(inputs, in[:at])
+		}
+	}
+
+	// best[i] is the cheapest log10 guesses for the first i runes
+	best := make([]float64, len(runes)+1)
+	for i := 1; i <= len(runes); i++ {
+		best[i] = math.Inf(1)
+	}
+	for i := 0; i < len(runes); i++ {
+		if math.IsInf(best[i], 1) {
+			continue
+		}
+		relax := func(j int, cost float64) {
+			if best[i]+cost < best[j] {
+				best[j] = best[i] + cost
+			}
+		}
+		relax(i+1, math.Log10(bruteForceCardinality(runes[i])))
+		for j := i + 3; j <= len(runes); j++ {
+			if cost, ok := wordGuesses(string(lower[i:j]), string(unleet[i:j]), inputs); ok {
+				relax(j, cost)
+			}
+			if cost, ok := patternGuesses(lower[i:j]); ok {
+				relax(j, cost)
+			}
+		}
+	}
+	return best[len(runes)]
+}
+
+// wordGuesses matches s against the user's own details and the common
+// passwords, directly or after undoing l33t substitutions.
+func wordGuesses(s, unleet string, inputs []string) (float64, bool) {
+	for _, in := range inputs {
+		if len(s) >= 3 && (s == in || unleet == in || (len(s) >= 4 && strings.Contains(in, s))) {
+			return 1, true
+		}
+	}
+	if len(s) < 4 {
+		return 0, false
+	}
+	for rank, word := range commonPasswords {
+		if s == word {
+			return math.Log10(float64(rank + 2)), true
+		}
+		if unleet == word {
+			// Each substitution doubles the variations to try
+			return math.Log10(float64(rank+2)) + math.Log10(4), true
+		}
+	}
+	return 0, false
+}
+
+// patternGuesses matches runs of one character, alphabetic or numeric
+// sequences and keyboard walks, which attackers try early.
+func patternGuesses(s []rune) (float64, bool) {
+	n := float64(len(s))
+	repeat, ascending, descending := true, true, true
+	for k := 1; k < len(s); k++ {
+		repeat = repeat && s[k] == s[0]
+		ascending = ascending && s[k] == s[k-1]+1
+		descending = descending && s[k] == s[k-1]-1
+	}
+	switch {
+	case repeat:
+		return math.Log10(bruteForceCardinality(s[0]) * n), true
+	case ascending || descending:
+		return math.Log10(bruteForceCardinality(s[0]) * n * 2), true
+	}
+	str := string(s)
+	for _, row := range keyboardRows {
+		if strings.Contains(row, str) || strings.Contains(reverse(row), str) {
+			return math.Log10(float64(len(row)) * n * 2), true
+		}
+	}
+	return 0, false
+}
+
+func bruteForceCardinality(r rune) float64 {
+	switch {
+	case unicode.IsDigit(r):
+		return 10
+	case unicode.IsLower(r), unicode.IsUpper(r):
+		if r < unicode.MaxASCII {
+			return 26
+		}
+		return 100
+	case r < unicode.MaxASCII:
+		return 33
+	}
+	return 100
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
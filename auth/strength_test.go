@@ -0,0 +1,32 @@
+package auth
+
+import "testing"
+
+func TestPasswordStrength(t *testing.T) {
+	for _, tt := range []struct {
+		password string
+		max      int // the highest score it may get
+		min      int
+	}{
+		{"password", 0, 0},
+		{"P@ssw0rd", 0, 0},
+		{"1234567890", 0, 0},
+		{"qwertyuiop", 0, 0},
+		{"zxcvbnm,./", 0, 0},
+		{"aaaaaaaaaaaa", 0, 0},
+		{"abcdefghijkl", 0, 0},
+		{"alicealice", 0, 0},
+		{"password123!", 1, 0},
+		{"alice2024", 1, 0},
+		{"k7#Qm2!vZp9@", 4, 4},
+		{"correct horse battery staple", 4, 4},
+	} {
+		if got := PasswordStrength(tt.password, "alice", "alice@example.com"); got < tt.min || got > tt.max {
+			t.Errorf("PasswordStrength(%q) = %d, want %d to %d", tt.password, got, tt.min, tt.max)
+		}
+	}
+	// The user's own details are the first thing an attacker tries
+	if a, b := PasswordStrength("winterbourne", "winterbourne"), PasswordStrength("winterbourne", "alice"); a >= b {
+		t.Errorf("a password that is the username scores %d, not below %d", a, b)
+	}
+}
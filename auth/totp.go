@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP settings as in RFC 6238. They are the defaults of every authenticator
+// app, which is why they aren't configurable.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // accept codes one period early or late for clock drift
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random base32 encoded TOTP secret.
+func GenerateTOTPSecret() (string, error) {
+	b, err := generateRandomBytes(20)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth URI that authenticator apps read from a QR code.
+func TOTPURI(issuer, account, secret string) string {
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// ValidateTOTP checks code against secret at time now. It returns the time
+// step the code belongs to, so callers can refuse to accept a step twice.
+func ValidateTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	step := now.Unix() / totpPeriod
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step+i)), []byte(code)) == 1 {
+			return step + i, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode computes the HOTP value of RFC 4226 for counter.
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// GenerateRecoveryCodes returns n single use recovery codes and the hashes to
+// store for them.
+func GenerateRecoveryCodes(n int) (codes, hashes []string, err error) {
+	for i := 0; i < n; i++ {
+		b, err := generateRandomBytes(10)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		code = code[:8] + "-" + code[8:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the stored hash of a recovery code. Case and dashes
+// are ignored, since people type these in by hand.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return hashToken(code)
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors, base32 encoded.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestValidateTOTP(t *testing.T) {
+	// The last six digits of the RFC 6238 SHA-1 vectors
+	for _, tt := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		now := time.Unix(tt.unix, 0)
+		step, ok := ValidateTOTP(rfc6238Secret, tt.code, now)
+		if !ok || step != tt.unix/totpPeriod {
+			t.Errorf("ValidateTOTP(%s at %d) = %d, %v, want step %d", tt.code, tt.unix, step, ok, tt.unix/totpPeriod)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	for _, code := range []string{"081805", "08180", "0818044", "", "abcdef"} {
+		if _, ok := ValidateTOTP(rfc6238Secret, code, now); ok {
+			t.Errorf("ValidateTOTP accepted %q", code)
+		}
+	}
+	if _, ok := ValidateTOTP(" "+strings.ToLower(rfc6238Secret), "081 804", now); !ok {
+		t.Error("ValidateTOTP refused a code with a space for a lower case secret")
+	}
+	if _, ok := ValidateTOTP("not base32!", "081804", now); ok {
+		t.Error("ValidateTOTP accepted a code for a secret that isn't base32")
+	}
+}
+
+// TestTOTPStepReuse checks that a code keeps reporting its own time step for
+// as long as the clock skew allows it, so refusing steps at or before the
+// last one used stops it from being replayed.
+func TestTOTPStepReuse(t *testing.T) {
+	issued := time.Unix(1111111109, 0)
+	step := issued.Unix() / totpPeriod
+	var last int64
+	use := func(now time.Time) bool {
+		got, ok := ValidateTOTP(rfc6238Secret, "081804", now)
+		if !ok || got <= last {
+			return false
+		}
+		last = got
+		return true
+	}
+
+	if !use(issued) || last != step {
+		t.Fatalf("first use: last step = %d, want %d", last, step)
+	}
+	for _, later := range []time.Duration{0, 10 * time.Second, totpPeriod * time.Second} {
+		if use(issued.Add(later)) {
+			t.Errorf("code was accepted again %v later", later)
+		}
+	}
+	// Outside the skew window the code is no good anyway
+	if _, ok := ValidateTOTP(rfc6238Secret, "081804", issued.Add(2*totpPeriod*time.Second)); ok {
+		t.Error("code was valid two periods later")
+	}
+	if got, ok := ValidateTOTP(rfc6238Secret, "081804", issued.Add(-totpPeriod*time.Second)); !ok || got != step {
+		t.Errorf("code one period early = step %d, %v, want step %d", got, ok, step)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 10 || len(hashes) != 10 {
+		t.Fatalf("got %d codes and %d hashes, want 10 of each", len(codes), len(hashes))
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if seen[code] {
+			t.Errorf("recovery code %q was handed out twice", code)
+		}
+		seen[code] = true
+		if HashRecoveryCode(code) != hashes[i] {
+			t.Errorf("hash of recovery code %d doesn't match the stored one", i)
+		}
+		if typed := strings.ToUpper(strings.ReplaceAll(code, "-", "")); HashRecoveryCode(" "+typed) != hashes[i] {
+			t.Errorf("recovery code %q typed as %q doesn't match", code, typed)
+		}
+	}
+}
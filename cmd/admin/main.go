@@ -0,0 +1,473 @@
+// Command admin runs maintenance tasks against the blog database using the
+// same configuration as the server.
+//
+// Usage:
+//
+//	admin [-env local.env] <command> [flags]
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"os/user"
+	"sort"
+	"strings"
+	"techblogapi/auth"
+	"techblogapi/config"
+	"techblogapi/models"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/lib/pq"
+	"golang.org/x/term"
+)
+
+// command is a subcommand of the admin tool.
+type command struct {
+	usage string
+	run   func(app *app, args []string) error
+}
+
+var commands = map[string]command{
+	"create-user":      {"create a normal or guest account", createUser},
+	"create-superuser": {"create a superuser account", createSuperuser},
+	"reset-password":   {"set a new password for an account", resetPassword},
+	"set-role":         {"promote or demote an account", setRole},
+	"duplicate-users":  {"report usernames and emails used by several accounts", duplicateUsers},
+	"disable":          {"disable an account and revoke its sessions and tokens", disableUser},
+	"enable":           {"enable a disabled account", enableUser},
+	"sessions":         {"list sessions, optionally for one user", listSessions},
+	"revoke-sessions":  {"revoke one session, or all sessions and tokens of a user", revokeSessions},
+	"reassign-posts":   {"move all posts from one user to another", reassignPosts},
+	"rebuild-slugs":    {"fill in missing category and post slugs", rebuildSlugs},
+	"prune-audit":      {"delete audit log entries older than the retention period", pruneAudit},
+	"purge-trash":      {"delete what has been in the trash longer than the retention period", purgeTrash},
+}
+
+// app holds the connections shared by every command. Redis is only connected
+// for the commands that need it. ctx is canceled on interrupt, which stops
+// the query in progress.
+type app struct {
+	ctx   context.Context
+	cfg   config.Config
+	blog  models.BlogModel
+	cache *auth.RedisClient
+}
+
+func (a *app) sessions() (*auth.RedisClient, error) {
+	if a.cache == nil {
+		conn, err := auth.ConnectRedis(a.cfg.RedisAddr, a.cfg.RedisTimeout)
+		if err != nil {
+			return nil, err
+		}
+		a.cache = &auth.RedisClient{Conn: conn}
+	}
+	return a.cache, nil
+}
+
+func main() {
+	envFile := flag.String("env", "local.env", "env file to load the configuration from")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*envFile)
+	if err != nil {
+		log.Fatalf("An error occured. Err: %s", err)
+	}
+	db, err := sql.Open("postgres", cfg.DSN())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	a := &app{
+		ctx:  ctx,
+		cfg:  cfg,
+		blog: models.BlogModel{DB: db, Params: &cfg.Argon2},
+	}
+	if err := cmd.run(a, flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: admin [-env file] <command> [flags]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun admin <command> -h for the flags of a command.\n")
+}
+
+func createUser(a *app, args []string) error {
+	return addUser(a, "create-user", false, args)
+}
+
+func createSuperuser(a *app, args []string) error {
+	return addUser(a, "create-superuser", true, args)
+}
+
+func addUser(a *app, name string, superuser bool, args []string) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	username := fs.String("username", "", "username (required)")
+	email := fs.String("email", "", "email address")
+	firstname := fs.String("firstname", "", "first name")
+	lastname := fs.String("lastname", "", "last name")
+	guest := false
+	if !superuser {
+		fs.BoolVar(&guest, "guest", false, "create a guest account")
+	}
+	fs.Parse(args)
+	if *username == "" {
+		return errors.New("-username is required")
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	if err := a.checkPassword(password, *username, *email); err != nil {
+		return err
+	}
+	u := models.User{
+		IsGuest:     guest,
+		IsSuperuser: superuser,
+		Username:    *username,
+		FirstName:   *firstname,
+		LastName:    *lastname,
+		Email:       *email,
+		Password:    password,
+	}
+	if _, err := a.blog.Register(a.ctx, u); err != nil {
+		return err
+	}
+	a.audit("user.create", "user", u.Username, map[string]bool{"is_superuser": u.IsSuperuser, "is_guest": u.IsGuest})
+	fmt.Printf("Created user %s\n", u.Username)
+	return nil
+}
+
+func resetPassword(a *app, args []string) error {
+	fs := flag.NewFlagSet("reset-password", flag.ExitOnError)
+	username := fs.String("username", "", "username (required)")
+	keepSessions := fs.Bool("keep-sessions", false, "don't revoke the existing sessions and tokens")
+	fs.Parse(args)
+	if *username == "" {
+		return errors.New("-username is required")
+	}
+	u, err := a.blog.UserByUsername(a.ctx, *username)
+	if err != nil {
+		return err
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	if err := a.checkPassword(password, u.Username, u.Email); err != nil {
+		return err
+	}
+	if err := a.blog.SetPassword(a.ctx, *username, password); err != nil {
+		return err
+	}
+	a.audit("user.reset_password", "user", *username, nil)
+	fmt.Printf("Password for %s changed\n", *username)
+	if *keepSessions {
+		return nil
+	}
+	return a.revokeAll(*username)
+}
+
+func setRole(a *app, args []string) error {
+	fs := flag.NewFlagSet("set-role", flag.ExitOnError)
+	username := fs.String("username", "", "username (required)")
+	role := fs.String("role", "", "new role: superuser, user or guest (required)")
+	fs.Parse(args)
+	if *username == "" {
+		return errors.New("-username is required")
+	}
+	var superuser, guest bool
+	switch *role {
+	case "superuser":
+		superuser = true
+	case "guest":
+		guest = true
+	case "user":
+	default:
+		return fmt.Errorf("unknown role %q, want superuser, user or guest", *role)
+	}
+
+	before, err := a.blog.UserByUsername(a.ctx, *username)
+	if err != nil {
+		return err
+	}
+	if err := a.blog.SetRole(a.ctx, *username, superuser, guest); err != nil {
+		return err
+	}
+	a.audit("user.set_role", "user", *username, map[string]interface{}{
+		"before": map[string]bool{"is_superuser": before.IsSuperuser, "is_guest": before.IsGuest},
+		"after":  map[string]bool{"is_superuser": superuser, "is_guest": guest},
+	})
+	fmt.Printf("%s is now %s\n", *username, *role)
+	return nil
+}
+
+func disableUser(a *app, args []string) error {
+	username, err := usernameFlag("disable", args)
+	if err != nil {
+		return err
+	}
+	if err := a.blog.SetDisabled(a.ctx, username, true); err != nil {
+		return err
+	}
+	a.audit("user.disable", "user", username, nil)
+	fmt.Printf("Disabled %s\n", username)
+	return a.revokeAll(username)
+}
+
+func enableUser(a *app, args []string) error {
+	username, err := usernameFlag("enable", args)
+	if err != nil {
+		return err
+	}
+	if err := a.blog.SetDisabled(a.ctx, username, false); err != nil {
+		return err
+	}
+	a.audit("user.enable", "user", username, nil)
+	fmt.Printf("Enabled %s\n", username)
+	return nil
+}
+
+func listSessions(a *app, args []string) error {
+	fs := flag.NewFlagSet("sessions", flag.ExitOnError)
+	username := fs.String("username", "", "only list the sessions of this user")
+	fs.Parse(args)
+	cache, err := a.sessions()
+	if err != nil {
+		return err
+	}
+	sessions, err := cache.ListSessions(a.ctx, *username)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tTOKEN\tCREATED\tEXPIRES")
+	for _, s := range sessions {
+		created := "-"
+		if !s.Created.IsZero() {
+			created = s.Created.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Username, s.Token, created, s.Expiry.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func revokeSessions(a *app, args []string) error {
+	fs := flag.NewFlagSet("revoke-sessions", flag.ExitOnError)
+	username := fs.String("username", "", "revoke every session and refresh token of this user")
+	token := fs.String("token", "", "revoke a single session")
+	fs.Parse(args)
+	if (*username == "") == (*token == "") {
+		return errors.New("exactly one of -username or -token is required")
+	}
+	if *username != "" {
+		return a.revokeAll(*username)
+	}
+	cache, err := a.sessions()
+	if err != nil {
+		return err
+	}
+	if err := cache.RevokeSession(a.ctx, *token); err != nil {
+		return err
+	}
+	fmt.Println("Revoked 1 session")
+	return nil
+}
+
+func (a *app) revokeAll(username string) error {
+	cache, err := a.sessions()
+	if err != nil {
+		return err
+	}
+	n, err := cache.RevokeUserSessions(a.ctx, username)
+	if err != nil {
+		return err
+	}
+	if err := cache.RevokeUserRefreshTokens(a.ctx, username); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked %d sessions and every refresh token of %s\n", n, username)
+	return nil
+}
+
+func reassignPosts(a *app, args []string) error {
+	fs := flag.NewFlagSet("reassign-posts", flag.ExitOnError)
+	from := fs.String("from", "", "username to take the posts from (required)")
+	to := fs.String("to", "", "username to give the posts to (required)")
+	fs.Parse(args)
+	if *from == "" || *to == "" {
+		return errors.New("-from and -to are required")
+	}
+	n, err := a.blog.ReassignPosts(a.ctx, *from, *to)
+	if err != nil {
+		return err
+	}
+	a.audit("post.reassign", "user", *from, map[string]interface{}{"to": *to, "posts": n})
+	fmt.Printf("Moved %d posts from %s to %s\n", n, *from, *to)
+	return nil
+}
+
+func rebuildSlugs(a *app, args []string) error {
+	fs := flag.NewFlagSet("rebuild-slugs", flag.ExitOnError)
+	all := fs.Bool("all", false, "regenerate every slug, not only missing ones (changes public URLs)")
+	fs.Parse(args)
+	categories, posts, err := a.blog.RebuildSlugs(a.ctx, *all)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Updated %d category slugs and %d post slugs\n", categories, posts)
+	return nil
+}
+
+func pruneAudit(a *app, args []string) error {
+	fs := flag.NewFlagSet("prune-audit", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", a.cfg.AuditRetention, "age of the entries to delete, defaults to AUDIT_RETENTION")
+	fs.Parse(args)
+	if *olderThan <= 0 {
+		return errors.New("no retention period: set AUDIT_RETENTION or -older-than")
+	}
+	n, err := a.blog.PruneAuditLog(a.ctx, time.Now().Add(-*olderThan))
+	if err != nil {
+		return err
+	}
+	a.audit("audit.prune", "audit_log", "", map[string]interface{}{"older_than": olderThan.String(), "deleted": n})
+	fmt.Printf("Deleted %d audit log entries older than %s\n", n, *olderThan)
+	return nil
+}
+
+func purgeTrash(a *app, args []string) error {
+	fs := flag.NewFlagSet("purge-trash", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", a.cfg.TrashRetention, "how long to keep deleted items, defaults to TRASH_RETENTION")
+	fs.Parse(args)
+	if *olderThan <= 0 {
+		return errors.New("no retention period: set TRASH_RETENTION or -older-than")
+	}
+	res, err := a.blog.PurgeTrash(a.ctx, time.Now().Add(-*olderThan))
+	if err != nil {
+		return err
+	}
+	a.audit("trash.purge", "trash", "", map[string]interface{}{"older_than": olderThan.String(), "purged": res})
+	fmt.Printf("Purged %d categories, %d posts, %d comments and %d images deleted more than %s ago\n",
+		res.Categories, res.Posts, res.Comments, res.Images, *olderThan)
+	return nil
+}
+
+func duplicateUsers(a *app, args []string) error {
+	fs := flag.NewFlagSet("duplicate-users", flag.ExitOnError)
+	fs.Parse(args)
+	dups, err := a.blog.DuplicateUsers(a.ctx)
+	if err != nil {
+		return err
+	}
+	if len(dups) == 0 {
+		fmt.Println("No duplicate usernames or emails")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FIELD\tVALUE\tUSER IDS")
+	for _, d := range dups {
+		fmt.Fprintf(w, "%s\t%s\t%v\n", d.Field, d.Value, d.UserIDs)
+	}
+	return w.Flush()
+}
+
+func usernameFlag(name string, args []string) (string, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	username := fs.String("username", "", "username (required)")
+	fs.Parse(args)
+	if *username == "" {
+		return "", errors.New("-username is required")
+	}
+	return *username, nil
+}
+
+// checkPassword returns an error listing what is wrong with a new password.
+func (a *app) checkPassword(password, username, email string) error {
+	problems, err := a.cfg.Passwords.Check(password, username, email)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("password %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// readPassword reads a password from stdin, so that it doesn't end up in the
+// shell history or the process list. On a terminal the input isn't echoed;
+// otherwise the first line is used, which lets scripts pipe it in.
+func readPassword() (string, error) {
+	var password string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		password = string(b)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+	return password, nil
+}
+
+// audit records an action taken from the command line. The actor is the
+// operating system user running the tool.
+func (a *app) audit(action, targetType, targetID string, details interface{}) {
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor = "cli:" + u.Username
+	}
+	e := models.AuditEntry{Actor: actor, Action: action, TargetType: targetType, TargetID: targetID}
+	if details != nil {
+		b, err := json.Marshal(details)
+		if err != nil {
+			log.Print(err)
+		}
+		e.Details = b
+	}
+	if err := a.blog.AddAuditEntry(a.ctx, e); err != nil {
+		log.Print(err)
+	}
+}
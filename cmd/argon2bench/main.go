@@ -0,0 +1,94 @@
+// Command argon2bench measures Argon2id on the current host and suggests
+// parameters that hash a password in about the target time. The output can be
+// pasted into local.env.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"runtime"
+	"techblogapi/auth"
+	"time"
+)
+
+func main() {
+	target := flag.Duration("target", 500*time.Millisecond, "target hashing time per password")
+	maxMemory := flag.Uint("max-memory", 256*1024, "largest memory cost to try, in KiB")
+	minMemory := flag.Uint("min-memory", 19*1024, "smallest memory cost to try, in KiB")
+	parallelism := flag.Uint("parallelism", defaultParallelism(), "parallelism (lanes) to use")
+	runs := flag.Int("runs", 3, "hashes per measurement, the fastest one is used")
+	flag.Parse()
+
+	if *parallelism == 0 || *parallelism > 255 {
+		log.Fatal("parallelism must be between 1 and 255")
+	}
+	if *minMemory > *maxMemory {
+		log.Fatal("min-memory must not be larger than max-memory")
+	}
+
+	fmt.Printf("Target %s, parallelism %d, %d CPUs\n\n", *target, *parallelism, runtime.NumCPU())
+	fmt.Printf("%10s %10s %12s\n", "memory", "iterations", "time")
+
+	// Memory is the better defence against GPU cracking, so use as much of
+	// it as the target allows and only then add iterations.
+	var best *auth.AuthParams
+	for memory := uint32(*minMemory); memory <= uint32(*maxMemory); memory *= 2 {
+		p := auth.DefaultAuthParams
+		p.Memory = memory
+		p.Iterations = 1
+		p.Parallelism = uint8(*parallelism)
+
+		elapsed := measure(&p, *runs)
+		fmt.Printf("%7d KiB %10d %12s\n", p.Memory, p.Iterations, elapsed.Round(time.Millisecond))
+		if elapsed > *target {
+			break
+		}
+		for elapsed*time.Duration(p.Iterations+1)/time.Duration(p.Iterations) <= *target {
+			p.Iterations++
+			elapsed = measure(&p, *runs)
+			fmt.Printf("%7d KiB %10d %12s\n", p.Memory, p.Iterations, elapsed.Round(time.Millisecond))
+		}
+		if elapsed <= *target && (best == nil || cost(&p) > cost(best)) {
+			found := p
+			best = &found
+		}
+	}
+
+	if best == nil {
+		log.Fatalf("even %d KiB with one iteration is slower than %s, lower min-memory or raise the target", *minMemory, *target)
+	}
+	fmt.Printf("\nSuggested parameters:\n\n")
+	fmt.Printf("ARGON2_MEMORY_KIB=%d\n", best.Memory)
+	fmt.Printf("ARGON2_ITERATIONS=%d\n", best.Iterations)
+	fmt.Printf("ARGON2_PARALLELISM=%d\n", best.Parallelism)
+	fmt.Printf("ARGON2_SALT_LENGTH=%d\n", best.SaltLength)
+	fmt.Printf("ARGON2_KEY_LENGTH=%d\n", best.KeyLength)
+}
+
+func defaultParallelism() uint {
+	if n := runtime.NumCPU(); n < 4 {
+		return uint(n)
+	}
+	return 4
+}
+
+func cost(p *auth.AuthParams) uint64 {
+	return uint64(p.Memory) * uint64(p.Iterations)
+}
+
+// measure returns the fastest of runs hashes with p.
+func measure(p *auth.AuthParams, runs int) time.Duration {
+	var fastest time.Duration
+	for i := 0; i < runs; i++ {
+		start := time.Now()
+		if _, err := auth.GenerateFromPassword("correct horse battery staple", p); err != nil {
+			log.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		if fastest == 0 || elapsed < fastest {
+			fastest = elapsed
+		}
+	}
+	return fastest
+}
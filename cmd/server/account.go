@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"techblogapi/models"
+	"time"
+)
+
+// exportedSession is what the export tells about a session. The token itself
+// is left out, it is a credential.
+type exportedSession struct {
+	Created time.Time `json:"created"`
+	Expiry  time.Time `json:"expiry"`
+}
+
+// ExportMe answers with a ZIP archive of the personal data stored about the
+// current user, one JSON file per kind of data.
+func (env *Env) ExportMe(w http.ResponseWriter, r *http.Request) {
+	u, ok := env.accountUser(w, r)
+	if !ok {
+		return
+	}
+	files, err := env.exportFiles(r.Context(), u)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="techblogapi-export.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.data); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Print(err)
+	}
+	env.audit(r, u.Username, "user.export", "user", u.Username, nil)
+}
+
+type exportFile struct {
+	name string
+	data interface{}
+}
+
+// exportFiles collects everything before anything is written, so a failed
+// query still gets a proper error response.
+func (env *Env) exportFiles(ctx context.Context, u models.User) ([]exportFile, error) {
+	profile, err := env.blog.AuthorByUserID(ctx, u.UserID)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := env.blog.IdentitiesForUser(ctx, u.UserID)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys, err := env.blog.APIKeysForUser(ctx, u.UserID)
+	if err != nil {
+		return nil, err
+	}
+	posts, err := env.blog.PostsByAuthor(ctx, u.Username)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := env.blog.CommentsByUser(ctx, u.UserID)
+	if err != nil {
+		return nil, err
+	}
+	images, err := env.blog.ImagesForUser(ctx, u.UserID)
+	if err != nil {
+		return nil, err
+	}
+	activity, err := env.blog.AuditEntriesByActor(ctx, u.Username)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := env.cache.ListSessions(ctx, u.Username)
+	if err != nil {
+		return nil, err
+	}
+	exported := make([]exportedSession, 0, len(sessions))
+	for _, s := range sessions {
+		exported = append(exported, exportedSession{Created: s.Created, Expiry: s.Expiry})
+	}
+
+	return []exportFile{
+		{"account.json", map[string]interface{}{"user": u, "profile": profile, "identities": identities, "api_keys": apiKeys}},
+		{"posts.json", posts},
+		{"comments.json", comments},
+		{"images.json", images},
+		{"sessions.json", exported},
+		{"activity.json", activity},
+	}, nil
+}
+
+type deleteMeRequest struct {
+	Password string `json:"password"`
+}
+
+// DeleteMe deletes or anonymizes the account of the current user, as set by
+// ACCOUNT_DELETION, and signs them out everywhere. Accounts with a password
+// have to confirm with it.
+func (env *Env) DeleteMe(w http.ResponseWriter, r *http.Request) {
+	u, ok := env.accountUser(w, r)
+	if !ok {
+		return
+	}
+	var req deleteMeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPasswordBody)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Guesses count towards the login lockout, so a stolen session can't be
+	// used to guess the password
+	wait, err := env.cache.LoginLockedFor(r.Context(), accountLockoutKey(u), env.clientIP(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+	valid, err := env.blog.CheckPassword(r.Context(), u.UserID, req.Password)
+	if err == models.ErrNoPassword {
+		valid, err = true, nil
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !valid {
+		wait, err := env.cache.RecordLoginFailure(r.Context(), accountLockoutKey(u), env.clientIP(r))
+		if err != nil {
+			log.Print(err)
+		}
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+		writeValidationErrors(w, fieldErrors{"password": {"is incorrect"}})
+		return
+	}
+
+	err = env.blog.RemoveAccount(r.Context(), u.UserID, env.accountDeletion)
+	if err == models.ErrSuperuserDeletion {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if _, err := env.cache.RevokeUserSessions(r.Context(), u.Username); err != nil {
+		log.Print(err)
+	}
+	if err := env.cache.RevokeUserRefreshTokens(r.Context(), u.Username); err != nil {
+		log.Print(err)
+	}
+	env.cache.SetSessionCookie(w, "", time.Time{})
+	env.audit(r, u.Username, "user.delete", "user", u.Username, map[string]string{"policy": env.accountDeletion})
+	w.WriteHeader(http.StatusNoContent)
+}
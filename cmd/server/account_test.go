@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"techblogapi/models"
+	"testing"
+)
+
+func TestUpdateMeAndVerifyEmail(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+	ts.register(t, "bob")
+
+	res := ts.request(t, "PATCH", "/me", token, map[string]string{"website": "not a url"})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+
+	res = ts.request(t, "PATCH", "/me", token, map[string]string{
+		"firstname": "Alice",
+		"bio":       "Writes about Go",
+		"email":     "alice@example.org",
+	})
+	expectStatus(t, res, http.StatusOK)
+	var updated struct {
+		Results      models.User   `json:"results"`
+		Profile      models.Author `json:"profile"`
+		PendingEmail string        `json:"pending_email"`
+	}
+	decode(t, res, &updated)
+	if updated.Results.FirstName != "Alice" || updated.Profile.Bio != "Writes about Go" {
+		t.Errorf("PATCH /me = %+v", updated)
+	}
+	// The address only changes once the link is opened
+	if updated.Results.Email != "alice@example.com" || updated.PendingEmail != "alice@example.org" {
+		t.Errorf("email = %q, pending %q", updated.Results.Email, updated.PendingEmail)
+	}
+
+	mail := ts.mail.nextTo(t, "alice@example.org")
+	link, err := url.Parse(linkPattern.FindString(mail.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := "/verify-email?" + url.Values{"token": {link.Query().Get("token")}}.Encode()
+	expectStatus(t, ts.request(t, "GET", verify, "", nil), http.StatusOK)
+	expectStatus(t, ts.request(t, "GET", verify, "", nil), http.StatusUnauthorized)
+
+	u, err := ts.blog.UserByUsername(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "alice@example.org" {
+		t.Errorf("email after verifying = %q, want alice@example.org", u.Email)
+	}
+
+	// bob's address is taken by the time the link is opened
+	expectStatus(t, ts.request(t, "PATCH", "/me", token, map[string]string{"email": "BOB@example.com"}), http.StatusOK)
+	link, err = url.Parse(linkPattern.FindString(ts.mail.nextTo(t, "BOB@example.com").body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify = "/verify-email?" + url.Values{"token": {link.Query().Get("token")}}.Encode()
+	expectStatus(t, ts.request(t, "GET", verify, "", nil), http.StatusConflict)
+}
+
+func TestChangePassword(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+	other := ts.login(t, "alice")
+
+	res := ts.request(t, "POST", "/me/password", token, map[string]string{
+		"current_password": "wrong password",
+		"new_password":     "another long passphrase",
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+
+	// Guessing the current password locks the account like failed logins do
+	for i := 1; i < ts.sessions.Lockout.FreeAttempts; i++ {
+		expectStatus(t, ts.request(t, "POST", "/me/password", token, map[string]string{
+			"current_password": "wrong password",
+			"new_password":     "another long passphrase",
+		}), http.StatusUnprocessableEntity)
+	}
+	expectStatus(t, ts.request(t, "POST", "/me/password", token, map[string]string{
+		"current_password": "wrong password",
+		"new_password":     "another long passphrase",
+	}), http.StatusTooManyRequests)
+	res = ts.request(t, "POST", "/me/password", token, map[string]string{
+		"current_password": testPassword,
+		"new_password":     "another long passphrase",
+	})
+	expectStatus(t, res, http.StatusTooManyRequests)
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("lockout response has no Retry-After header")
+	}
+	admin := ts.superuser(t, "admin")
+	expectStatus(t, ts.request(t, "POST", "/admin/unlock", admin, map[string]string{"username": "alice"}), http.StatusOK)
+
+	res = ts.request(t, "POST", "/me/password", token, map[string]string{
+		"current_password": testPassword,
+		"new_password":     "another long passphrase",
+	})
+	expectStatus(t, res, http.StatusNoContent)
+
+	// Other sessions are signed out
+	expectStatus(t, ts.request(t, "GET", "/me", other, nil), http.StatusUnauthorized)
+	expectStatus(t, ts.request(t, "GET", "/me", token, nil), http.StatusOK)
+	res = ts.request(t, "POST", "/login", "", map[string]string{"username": "alice", "password": "another long passphrase"})
+	expectStatus(t, res, http.StatusOK)
+}
+
+func TestExportAndDeleteMe(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+	catID, err := ts.blog.AddCategory(context.Background(), models.Category{CategoryName: "Go", Slug: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	postID, err := ts.blog.AddPost(context.Background(), models.Post{UserID: ts.userID(t, "alice"), CategoryID: catID, Slug: "hello", Title: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := ts.request(t, "GET", "/me/export", token, nil)
+	expectStatus(t, res, http.StatusOK)
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, f := range zr.File {
+		names[f.Name] = true
+	}
+	for _, want := range []string{"account.json", "posts.json"} {
+		if !names[want] {
+			t.Errorf("export has no %s: %v", want, names)
+		}
+	}
+
+	expectStatus(t, ts.request(t, "DELETE", "/me", token, map[string]string{"password": "wrong password"}), http.StatusUnprocessableEntity)
+	// Guessing the password locks the account like failed logins do
+	for i := 1; i < ts.sessions.Lockout.FreeAttempts; i++ {
+		expectStatus(t, ts.request(t, "DELETE", "/me", token, map[string]string{"password": "wrong password"}), http.StatusUnprocessableEntity)
+	}
+	expectStatus(t, ts.request(t, "DELETE", "/me", token, map[string]string{"password": "wrong password"}), http.StatusTooManyRequests)
+	expectStatus(t, ts.request(t, "DELETE", "/me", token, map[string]string{"password": testPassword}), http.StatusTooManyRequests)
+	admin := ts.superuser(t, "admin")
+	expectStatus(t, ts.request(t, "POST", "/admin/unlock", admin, map[string]string{"username": "alice"}), http.StatusOK)
+	expectStatus(t, ts.request(t, "DELETE", "/me", token, map[string]string{"password": testPassword}), http.StatusNoContent)
+	expectStatus(t, ts.request(t, "GET", "/me", token, nil), http.StatusUnauthorized)
+	expectStatus(t, ts.request(t, "POST", "/login", "", map[string]string{"username": "alice", "password": testPassword}), http.StatusUnauthorized)
+
+	// Anonymizing keeps the posts
+	posts, err := ts.blog.PostById(context.Background(), int(postID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 {
+		t.Fatalf("post %d after deleting its author = %+v", postID, posts)
+	}
+	if a := posts[0].Author; a == nil || a.Username == "alice" {
+		t.Errorf("post author after deleting the account = %+v", a)
+	}
+}
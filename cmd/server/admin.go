@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"techblogapi/auth"
+	"techblogapi/models"
+)
+
+// requireSuperuser writes an error response and returns false unless the
+// request carries a valid session for a superuser. API keys are refused
+// whatever their scopes, none of which covers the admin endpoints.
+func (env *Env) requireSuperuser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	p, err := env.authenticate(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return models.User{}, false
+	}
+	if p.Method == auth.MethodAPIKey {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return models.User{}, false
+	}
+	u, err := env.blog.UserByUsername(r.Context(), p.Username)
+	if err != nil || u.Disabled {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return models.User{}, false
+	}
+	if !u.IsSuperuser {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return models.User{}, false
+	}
+	return u, true
+}
+
+// clientIP returns the address the request came from. X-Forwarded-For is only
+// used when the server is configured to sit behind a trusted proxy.
+func (env *Env) clientIP(r *http.Request) string {
+	if env.trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type unlockRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+// UnlockLogin clears failed login counters and lockouts for a username, an
+// IP, or both.
+func (env *Env) UnlockLogin(w http.ResponseWriter, r *http.Request) {
+	admin, ok := env.requireSuperuser(w, r)
+	if !ok {
+		return
+	}
+	var req unlockRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" && req.IP == "" {
+		http.Error(w, "username or ip is required", http.StatusBadRequest)
+		return
+	}
+	var key string
+	if req.Username != "" {
+		if key, err = env.lockoutKey(r.Context(), req.Username); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	if err := env.cache.UnlockLogin(r.Context(), key, req.IP); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	env.audit(r, admin.Username, "login.unlock", "user", req.Username, req)
+	json.NewEncoder(w).Encode(map[string]string{"results": "unlocked"})
+}
+
+type createUserRequest struct {
+	registerRequest
+	IsGuest     bool `json:"is_guest"`
+	IsSuperuser bool `json:"is_superuser"`
+}
+
+// CreateUser lets a superuser create accounts of any kind, including other
+// superusers. Every account created here is written to the audit log.
+func (env *Env) CreateUser(w http.ResponseWriter, r *http.Request) {
+	admin, ok := env.requireSuperuser(w, r)
+	if !ok {
+		return
+	}
+	var req createUserRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPasswordBody)).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	errs := fieldErrors{}
+	if req.Username == "" {
+		errs.add("username", "is required")
+	}
+	if err := env.checkPassword(errs, req.Password, req.Username, req.Email); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	u := req.user()
+	u.IsGuest = req.IsGuest
+	u.IsSuperuser = req.IsSuperuser
+	_, err = env.blog.Register(r.Context(), u)
+	if err != nil {
+		registerError(w, r, err)
+		return
+	}
+	env.audit(r, admin.Username, "user.create", "user", u.Username, map[string]bool{
+		"is_guest":     u.IsGuest,
+		"is_superuser": u.IsSuperuser,
+	})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"results": u.Username})
+}
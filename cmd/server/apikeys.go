@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"techblogapi/auth"
+	"techblogapi/models"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// currentUser loads the user behind the principal that requireAuth stored in
+// the request context.
+func (env *Env) currentUser(r *http.Request) (models.User, error) {
+	p, ok := auth.PrincipalFrom(r.Context())
+	if !ok {
+		return models.User{}, auth.ErrNoSession
+	}
+	return env.blog.UserByUsername(r.Context(), p.Username)
+}
+
+func (env *Env) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	u, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	keys, err := env.blog.APIKeysForUser(r.Context(), u.UserID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string][]models.APIKey{"results": keys})
+}
+
+// CreateAPIKey issues a new API key. The key is only ever shown in this
+// response, afterwards only its prefix is known.
+func (env *Env) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	// API keys can't be used to mint more API keys
+	if p, _ := auth.PrincipalFrom(r.Context()); p.Method == auth.MethodAPIKey {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	var req createAPIKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			http.Error(w, "unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+	if req.Scopes == nil {
+		req.Scopes = []string{}
+	}
+
+	u, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	key, prefix, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	stored, err := env.blog.AddAPIKey(r.Context(), models.APIKey{
+		UserID:    u.UserID,
+		Name:      req.Name,
+		Prefix:    prefix,
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	}, hash)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	env.auditChange(r, "api_key.create", "api_key", strconv.FormatInt(stored.ID, 10), nil, stored)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": stored, "key": key})
+}
+
+func (env *Env) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	u, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	err = env.blog.RevokeAPIKey(r.Context(), u.UserID, id)
+	if err == models.ErrAPIKeyNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	env.audit(r, u.Username, "api_key.revoke", "api_key", mux.Vars(r)["id"], nil)
+	w.WriteHeader(http.StatusNoContent)
+}
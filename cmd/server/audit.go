@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"techblogapi/auth"
+	"techblogapi/models"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the ID of a request, both ways. A valid ID sent by
+// the client or a proxy is kept so log lines can be matched up.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID, in the response header and the
+// request context.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// actor returns the username of the authenticated caller of r.
+func actor(r *http.Request) string {
+	p, _ := auth.PrincipalFrom(r.Context())
+	return p.Username
+}
+
+// audit writes an entry to the audit log. A failed write is logged but does
+// not fail the request, the action itself has already happened.
+func (env *Env) audit(r *http.Request, actor, action, targetType, targetID string, details interface{}) {
+	env.record(r, models.AuditEntry{
+		Actor:      actor,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Details:    auditJSON(details),
+	})
+}
+
+// auditChange writes an entry for a change to a target, with the target as
+// it was before and after. Either is nil when the target was created or
+// deleted.
+func (env *Env) auditChange(r *http.Request, action, targetType, targetID string, before, after interface{}) {
+	env.record(r, models.AuditEntry{
+		Actor:      actor(r),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Before:     auditJSON(before),
+		After:      auditJSON(after),
+	})
+}
+
+func (env *Env) record(r *http.Request, e models.AuditEntry) {
+	e.IP = env.clientIP(r)
+	e.RequestID = requestID(r)
+	// The change has happened by now, so record it even if the client has
+	// gone away
+	if err := env.blog.AddAuditEntry(context.Background(), e); err != nil {
+		log.Print(err)
+	}
+}
+
+func auditJSON(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	return b
+}
+
+// snapshot returns the stored state of a category, post or comment for the
+// audit log, or nil when there is none.
+func (env *Env) snapshot(ctx context.Context, targetType string, id int) interface{} {
+	var v interface{}
+	var err error
+	switch targetType {
+	case "category":
+		v, err = env.blog.CategoryByID(ctx, id)
+	case "post":
+		var posts []models.Post
+		posts, err = env.blog.PostById(ctx, id)
+		if err == nil && len(posts) == 0 {
+			err = sql.ErrNoRows
+		}
+		if err == nil {
+			v = posts[0]
+		}
+	case "comment":
+		v, err = env.blog.CommentByID(ctx, id)
+	}
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	return v
+}
+
+// maxAuditPage is the most entries GET /admin/audit returns at once.
+const maxAuditPage = 500
+
+// GetAuditLog lists audit log entries, newest first. It can be filtered by
+// actor, action, target_type and target_id, and by time with since and
+// until as RFC 3339 timestamps; limit and offset page through the results.
+func (env *Env) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	if _, ok := env.requireSuperuser(w, r); !ok {
+		return
+	}
+	q := r.URL.Query()
+	f := models.AuditFilter{
+		Actor:      q.Get("actor"),
+		Action:     q.Get("action"),
+		TargetType: q.Get("target_type"),
+		TargetID:   q.Get("target_id"),
+		Limit:      100,
+	}
+	errs := fieldErrors{}
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := q.Get(t.name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errs.add(t.name, "must be an RFC 3339 timestamp")
+			}
+			*t.dst = parsed
+		}
+	}
+	for _, n := range []struct {
+		name string
+		dst  *int
+	}{{"limit", &f.Limit}, {"offset", &f.Offset}} {
+		if v := q.Get(n.name); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 0 {
+				errs.add(n.name, "must be a non-negative integer")
+			}
+			*n.dst = parsed
+		}
+	}
+	if f.Limit == 0 || f.Limit > maxAuditPage {
+		f.Limit = maxAuditPage
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	entries, err := env.blog.AuditEntries(r.Context(), f)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string][]models.AuditEntry{"results": entries})
+}
+
+// pruneAuditLog deletes audit log entries older than retention once a day.
+func (env *Env) pruneAuditLog(retention time.Duration) {
+	for {
+		n, err := env.blog.PruneAuditLog(context.Background(), time.Now().Add(-retention))
+		if err != nil {
+			log.Print(err)
+		} else if n > 0 {
+			log.Printf("Pruned %d audit log entries", n)
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
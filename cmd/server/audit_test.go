@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"techblogapi/models"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+	admin := ts.superuser(t, "admin")
+
+	header := http.Header{RequestIDHeader: {"req-audit"}}
+	res := ts.send(t, http.DefaultClient, "POST", "/category", token, models.Category{CategoryName: "Go", Slug: "go"}, header)
+	expectStatus(t, res, http.StatusOK)
+
+	expectStatus(t, ts.request(t, "GET", "/admin/audit", token, nil), http.StatusForbidden)
+	// Not even a superuser's API key reaches the admin endpoints
+	res = ts.request(t, "POST", "/apikeys", admin, map[string]interface{}{"name": "ci", "scopes": []string{"comments:read"}})
+	expectStatus(t, res, http.StatusCreated)
+	var key struct {
+		Key string `json:"key"`
+	}
+	decode(t, res, &key)
+	expectStatus(t, ts.request(t, "GET", "/admin/audit", key.Key, nil), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "POST", "/admin/users", key.Key, map[string]interface{}{"username": "mallory", "password": testPassword, "is_superuser": true}), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "GET", "/admin/audit?since=yesterday", admin, nil), http.StatusUnprocessableEntity)
+
+	res = ts.request(t, "GET", "/admin/audit?actor=alice&action=category.create", admin, nil)
+	expectStatus(t, res, http.StatusOK)
+	var log struct {
+		Results []models.AuditEntry `json:"results"`
+	}
+	decode(t, res, &log)
+	if len(log.Results) != 1 {
+		t.Fatalf("GET /admin/audit = %+v, want one entry", log.Results)
+	}
+	e := log.Results[0]
+	if e.TargetType != "category" || e.RequestID != "req-audit" || e.Before != nil || e.After == nil {
+		t.Errorf("audit entry = %+v", e)
+	}
+
+	res = ts.request(t, "GET", "/admin/audit?actor=nobody", admin, nil)
+	expectStatus(t, res, http.StatusOK)
+	decode(t, res, &log)
+	if len(log.Results) != 0 {
+		t.Errorf("GET /admin/audit?actor=nobody = %+v, want none", log.Results)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"techblogapi/models"
+
+	"github.com/gorilla/mux"
+)
+
+func (env *Env) GetAuthors(w http.ResponseWriter, r *http.Request) {
+	authors, err := env.blog.Authors(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string][]models.Author{"results": authors})
+}
+
+func (env *Env) GetAuthor(w http.ResponseWriter, r *http.Request) {
+	author, err := env.blog.AuthorByUsername(r.Context(), mux.Vars(r)["username"])
+	if err == models.ErrUserNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]models.Author{"results": author})
+}
+
+func (env *Env) GetAuthorPosts(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	if _, err := env.blog.AuthorByUsername(r.Context(), username); err != nil {
+		if err == models.ErrUserNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err)
+		return
+	}
+	posts, err := env.blog.PostsByAuthor(r.Context(), username)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string][]models.Post{"results": posts})
+}
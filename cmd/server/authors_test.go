@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"techblogapi/models"
+	"testing"
+	"time"
+)
+
+func TestAuthors(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	ts.user(t, "carol")
+	ts.user(t, "bob")
+	ts.user(t, "alice")
+	category, err := ts.blog.AddCategory(ctx, models.Category{CategoryName: "Go", Slug: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	post := func(username, title string, at time.Time) int64 {
+		t.Helper()
+		id, err := ts.blog.AddPost(ctx, models.Post{UserID: ts.userID(t, username), CategoryID: category, Title: title, DateTime: at})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	post("bob", "Older", now.Add(-time.Hour))
+	post("bob", "Newer", now)
+	trashed := post("bob", "Trashed", now.Add(time.Hour))
+	post("alice", "Hello", now)
+	if _, err := ts.blog.DelPost(ctx, int(trashed)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.blog.UpdateAuthorProfile(ctx, ts.userID(t, "bob"), models.AuthorProfile{Bio: "Writes about Go", SocialLinks: map[string]string{"github": "https://github.com/bob"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only users with posts are listed, by username
+	res := ts.request(t, "GET", "/authors", "", nil)
+	expectStatus(t, res, http.StatusOK)
+	var list struct {
+		Results []models.Author `json:"results"`
+	}
+	decode(t, res, &list)
+	if len(list.Results) != 2 || list.Results[0].Username != "alice" || list.Results[1].Username != "bob" {
+		t.Fatalf("GET /authors = %+v, want alice and bob", list.Results)
+	}
+	if n := list.Results[1].PostCount; n != 2 {
+		t.Errorf("bob's post count = %d, want 2 without the trashed post", n)
+	}
+
+	res = ts.request(t, "GET", "/authors/bob", "", nil)
+	expectStatus(t, res, http.StatusOK)
+	var one struct {
+		Results map[string]interface{} `json:"results"`
+	}
+	decode(t, res, &one)
+	a := one.Results
+	if a["username"] != "bob" || a["bio"] != "Writes about Go" || a["post_count"] != 2.0 {
+		t.Errorf("GET /authors/bob = %v", a)
+	}
+	if links, _ := a["social_links"].(map[string]interface{}); links["github"] != "https://github.com/bob" {
+		t.Errorf("bob's social links = %v", a["social_links"])
+	}
+	// The public profile doesn't give away how to reach or log in as the user
+	for _, field := range []string{"email", "password", "user_id"} {
+		if _, ok := a[field]; ok {
+			t.Errorf("GET /authors/bob has %s: %v", field, a)
+		}
+	}
+	// Users without posts still have a profile
+	expectStatus(t, ts.request(t, "GET", "/authors/carol", "", nil), http.StatusOK)
+	expectStatus(t, ts.request(t, "GET", "/authors/nobody", "", nil), http.StatusNotFound)
+
+	res = ts.request(t, "GET", "/authors/bob/posts", "", nil)
+	expectStatus(t, res, http.StatusOK)
+	var posts struct {
+		Results []models.Post `json:"results"`
+	}
+	decode(t, res, &posts)
+	if len(posts.Results) != 2 || posts.Results[0].Title != "Newer" || posts.Results[1].Title != "Older" {
+		t.Errorf("GET /authors/bob/posts = %+v, want Newer then Older", posts.Results)
+	}
+	res = ts.request(t, "GET", "/authors/carol/posts", "", nil)
+	expectStatus(t, res, http.StatusOK)
+	decode(t, res, &posts)
+	if posts.Results == nil || len(posts.Results) != 0 {
+		t.Errorf("GET /authors/carol/posts = %+v, want an empty list", posts.Results)
+	}
+	expectStatus(t, ts.request(t, "GET", "/authors/nobody/posts", "", nil), http.StatusNotFound)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"techblogapi/models"
+	"testing"
+)
+
+func TestDeleteCategoryReassign(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+	ctx := context.Background()
+
+	var ids []int64
+	for _, name := range []string{"Go", "Golang", "Rust", "Gopher"} {
+		id, err := ts.blog.AddCategory(ctx, models.Category{CategoryName: name, Slug: models.Slugify(name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	goID, golang, rust, gopher := ids[0], ids[1], ids[2], ids[3]
+	for i, category := range []int64{golang, golang, gopher} {
+		_, err := ts.blog.AddPost(ctx, models.Post{UserID: ts.userID(t, "alice"), CategoryID: category, Title: "Post " + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(id int64) string { return "/category/" + strconv.FormatInt(id, 10) }
+
+	// Categories are shared, so only superusers delete and merge them
+	admin := ts.superuser(t, "admin")
+	expectStatus(t, ts.request(t, "DELETE", path(rust), token, nil), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "POST", "/categories/"+strconv.FormatInt(goID, 10)+"/merge", token, map[string][]int64{"from": {rust}}), http.StatusForbidden)
+
+	expectStatus(t, ts.request(t, "DELETE", path(golang), admin, nil), http.StatusConflict)
+	expectStatus(t, ts.request(t, "DELETE", path(golang)+"?reassign_to=go", admin, nil), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "DELETE", path(golang)+"?reassign_to=999", admin, nil), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "DELETE", path(golang)+"?reassign_to="+strconv.FormatInt(golang, 10), admin, nil), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "DELETE", path(999), admin, nil), http.StatusNotFound)
+
+	res := ts.request(t, "DELETE", path(golang)+"?reassign_to="+strconv.FormatInt(goID, 10), admin, nil)
+	expectStatus(t, res, http.StatusOK)
+	var report struct {
+		Results models.ReassignResult `json:"results"`
+	}
+	decode(t, res, &report)
+	if r := report.Results; r.To != goID || r.PostsMoved != 2 || len(r.Deleted) != 1 || r.Deleted[0] != golang {
+		t.Errorf("DELETE %s?reassign_to=%d = %+v", path(golang), goID, r)
+	}
+	posts, err := ts.blog.AllPostsByCatID(ctx, int(goID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 2 {
+		t.Errorf("posts in Go after reassigning = %d, want 2", len(posts))
+	}
+
+	// Nothing moves when one of the categories can't be merged
+	merge := "/categories/" + strconv.FormatInt(goID, 10) + "/merge"
+	expectStatus(t, ts.request(t, "POST", merge, admin, map[string][]int64{"from": {}}), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "POST", merge, admin, map[string][]int64{"from": {gopher, golang}}), http.StatusUnprocessableEntity)
+	if posts, _ := ts.blog.AllPostsByCatID(ctx, int(gopher)); len(posts) != 1 {
+		t.Errorf("posts in Gopher after a failed merge = %d, want 1", len(posts))
+	}
+	expectStatus(t, ts.request(t, "POST", "/categories/999/merge", admin, map[string][]int64{"from": {gopher}}), http.StatusNotFound)
+
+	res = ts.request(t, "POST", merge, admin, map[string][]int64{"from": {gopher, rust}})
+	expectStatus(t, res, http.StatusOK)
+	decode(t, res, &report)
+	if r := report.Results; r.PostsMoved != 1 || len(r.Deleted) != 2 {
+		t.Errorf("POST %s = %+v", merge, r)
+	}
+	categories, err := ts.blog.AllCategories(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(categories) != 1 || categories[0].CategoryID != goID {
+		t.Errorf("categories after merging = %+v, want only Go", categories)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"techblogapi/models"
+
+	"github.com/gorilla/mux"
+)
+
+// maxEditBytes limits the body of a PUT or PATCH of a category, post or
+// comment.
+const maxEditBytes = 1 << 20
+
+// The fields a PUT must have. IDs can't be changed, and neither can the post
+// a comment is on. The author can be left out and stays as it is; only
+// superusers can give posts and comments to someone else, see keepAuthor.
+var (
+	categoryFields = []string{"category_name", "slug"}
+	postFields     = []string{"category_id", "slug", "title", "message", "read_time", "date_time"}
+	commentFields  = []string{"message"}
+)
+
+// changeFunc turns a stored resource, as JSON, and the body of the request
+// changing it into the new resource.
+type changeFunc func(stored, body []byte) ([]byte, error)
+
+// bodyError is a request body that can't be applied, answered with 400 Bad
+// Request.
+type bodyError struct {
+	err error
+}
+
+func (e bodyError) Error() string {
+	return e.err.Error()
+}
+
+var errNotAnObject = bodyError{errors.New("the body must be a JSON object")}
+
+// replaceWith is the change of a PUT: the body is the new resource and must
+// have every one of fields, even the ones to be emptied.
+func replaceWith(fields []string) changeFunc {
+	return func(stored, body []byte) ([]byte, error) {
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return nil, bodyError{err}
+		}
+		if doc == nil {
+			return nil, errNotAnObject
+		}
+		missing := models.ValidationError{}
+		for _, field := range fields {
+			if _, ok := doc[field]; !ok {
+				missing[field] = []string{"is required"}
+			}
+		}
+		if len(missing) > 0 {
+			return nil, missing
+		}
+		return body, nil
+	}
+}
+
+// mergePatch is the change of a PATCH: the body is a JSON merge patch
+// (RFC 7396), whose fields replace the stored ones and whose nulls remove
+// them. Removed fields end up empty, so "slug": null makes a new slug.
+func mergePatch(stored, body []byte) ([]byte, error) {
+	var doc, patch interface{}
+	if err := decodeNumbers(stored, &doc); err != nil {
+		return nil, err
+	}
+	if err := decodeNumbers(body, &patch); err != nil {
+		return nil, bodyError{err}
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		return nil, errNotAnObject
+	}
+	return json.Marshal(merge(doc, patch))
+}
+
+// decodeNumbers unmarshals data into v, keeping numbers as they were written
+// so large IDs survive.
+func decodeNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// merge is the MergePatch function of RFC 7396.
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+		} else {
+			t[name] = merge(t[name], value)
+		}
+	}
+	return t
+}
+
+// applyChange replaces the resource v points to with the result of change,
+// given the request body.
+func applyChange(change changeFunc, body []byte, v interface{}) error {
+	stored, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	doc, err := change(stored, body)
+	if err != nil {
+		return err
+	}
+	// Start over from the zero value, so fields left out of doc are empty
+	rv := reflect.ValueOf(v).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return bodyError{err}
+	}
+	return nil
+}
+
+// unchanged fails when a request gives field, which can't be changed, a
+// value other than the stored one.
+func unchanged(field string, got, stored int64) error {
+	if got != 0 && got != stored {
+		return models.ValidationError{field: {"can't be changed"}}
+	}
+	return nil
+}
+
+// editRequest returns the ID in the URL and the body of a PUT or PATCH,
+// answering 400 Bad Request when either is unusable. PATCH takes
+// application/merge-patch+json, or application/json as older clients send.
+func editRequest(w http.ResponseWriter, r *http.Request) (int, []byte, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return 0, nil, false
+	}
+	if r.Method == "PATCH" {
+		switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+		case "", "application/json", "application/merge-patch+json":
+		default:
+			w.Header().Set("Accept-Patch", "application/merge-patch+json")
+			http.Error(w, "PATCH takes a JSON merge patch, application/merge-patch+json", http.StatusUnsupportedMediaType)
+			return 0, nil, false
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEditBytes+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, nil, false
+	}
+	if len(body) > maxEditBytes {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return 0, nil, false
+	}
+	return id, body, true
+}
+
+// editError answers a failed update: 404 Not Found when there is nothing to
+// update, 403 Forbidden for someone else's content, 400 Bad Request for a
+// body that can't be applied and 422 Unprocessable Entity for an invalid
+// result.
+func editError(w http.ResponseWriter, r *http.Request, err error) {
+	var invalid models.ValidationError
+	var bad bodyError
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case errors.Is(err, errNotAuthor):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.As(err, &bad):
+		http.Error(w, bad.Error(), http.StatusBadRequest)
+	case errors.As(err, &invalid):
+		writeValidationErrors(w, fieldErrors(invalid))
+	default:
+		serverError(w, r, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"techblogapi/models"
+	"testing"
+	"time"
+)
+
+func TestPatchAndPut(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+	ctx := context.Background()
+
+	catID, err := ts.blog.AddCategory(ctx, models.Category{CategoryName: "Go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	postID, err := ts.blog.AddPost(ctx, models.Post{
+		UserID: ts.userID(t, "alice"), CategoryID: catID, Title: "Hello", Slug: "hello",
+		Message: "First post", ReadTime: 3, DateTime: written,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/post/" + strconv.FormatInt(postID, 10)
+	var updated struct {
+		Results models.Post `json:"results"`
+	}
+
+	// Only the title changes, and the null slug is made anew from it
+	res := ts.request(t, "PATCH", path, token, map[string]interface{}{"title": "Hello again", "slug": nil})
+	expectStatus(t, res, http.StatusOK)
+	decode(t, res, &updated)
+	if p := updated.Results; p.Title != "Hello again" || p.Slug != "hello-again" || p.Message != "First post" || p.ReadTime != 3 || !p.DateTime.Equal(written) {
+		t.Errorf("PATCH %s = %+v", path, p)
+	}
+
+	expectStatus(t, ts.request(t, "PATCH", path, token, map[string]interface{}{"title": nil}), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "PATCH", path, token, map[string]interface{}{"category_id": 999}), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "PATCH", path, token, map[string]interface{}{"post_id": postID + 1}), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "PATCH", path, token, map[string]interface{}{"title": 5}), http.StatusBadRequest)
+	expectStatus(t, ts.request(t, "PATCH", path, token, map[string]interface{}{"views": 5}), http.StatusBadRequest)
+	expectStatus(t, ts.request(t, "PATCH", path, token, []string{"title"}), http.StatusBadRequest)
+	expectStatus(t, ts.request(t, "PATCH", "/post/999", token, map[string]string{"title": "Nope"}), http.StatusNotFound)
+	patch := http.Header{"Content-Type": {"application/json-patch+json"}}
+	expectStatus(t, ts.send(t, http.DefaultClient, "PATCH", path, token, []string{}, patch), http.StatusUnsupportedMediaType)
+
+	// PUT wants every field, so nothing is emptied by leaving it out
+	res = ts.request(t, "PUT", path, token, map[string]interface{}{"title": "Replaced"})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	var invalid struct {
+		Errors map[string][]string `json:"errors"`
+	}
+	decode(t, res, &invalid)
+	if len(invalid.Errors["message"]) == 0 || len(invalid.Errors["title"]) != 0 {
+		t.Errorf("PUT %s with a title only: errors = %v", path, invalid.Errors)
+	}
+	post := updated.Results
+	post.Title, post.Message = "Replaced", ""
+	expectStatus(t, ts.request(t, "PUT", path, token, post), http.StatusOK)
+	if p, _ := ts.blog.PostById(ctx, int(postID)); len(p) != 1 || p[0].Title != "Replaced" || p[0].Message != "" {
+		t.Errorf("post after PUT = %+v", p)
+	}
+
+	// Only the author or a superuser changes a post, and only superusers
+	// change categories
+	bob := ts.user(t, "bob")
+	admin := ts.superuser(t, "admin")
+	expectStatus(t, ts.request(t, "PATCH", path, bob, map[string]string{"title": "Mine now"}), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "PUT", path, bob, post), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "PATCH", path, admin, map[string]string{"title": "Moderated"}), http.StatusOK)
+	if p, _ := ts.blog.PostById(ctx, int(postID)); len(p) != 1 || p[0].Title != "Moderated" || p[0].UserID != ts.userID(t, "alice") {
+		t.Errorf("post after a superuser's PATCH = %+v", p)
+	}
+
+	// Authors can't give their posts away, but superusers can move them
+	bobID := ts.userID(t, "bob")
+	expectStatus(t, ts.request(t, "PATCH", path, token, map[string]int64{"user_id": bobID}), http.StatusUnprocessableEntity)
+	moved := post
+	moved.UserID = bobID
+	expectStatus(t, ts.request(t, "PUT", path, token, moved), http.StatusUnprocessableEntity)
+	moved.UserID = 0
+	expectStatus(t, ts.request(t, "PUT", path, token, moved), http.StatusOK)
+	if p, _ := ts.blog.PostById(ctx, int(postID)); len(p) != 1 || p[0].UserID != ts.userID(t, "alice") {
+		t.Errorf("post after a PUT without user_id = %+v, want it kept by alice", p)
+	}
+	expectStatus(t, ts.request(t, "PATCH", path, admin, map[string]int64{"user_id": bobID}), http.StatusOK)
+	if p, _ := ts.blog.PostById(ctx, int(postID)); len(p) != 1 || p[0].UserID != bobID {
+		t.Errorf("post after a superuser moved it = %+v, want it bob's", p)
+	}
+	expectStatus(t, ts.request(t, "PATCH", path, admin, map[string]int64{"user_id": ts.userID(t, "alice")}), http.StatusOK)
+
+	category := "/category/" + strconv.FormatInt(catID, 10)
+	expectStatus(t, ts.request(t, "PATCH", category, token, map[string]string{"category_name": "Golang"}), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "PUT", category, admin, map[string]string{"category_name": "Golang"}), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "PATCH", category, admin, map[string]string{"category_name": strings.Repeat("x", 151)}), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "PATCH", category, admin, map[string]string{"category_name": "Golang"}), http.StatusOK)
+	if c, _ := ts.blog.CategoryByID(ctx, int(catID)); c.CategoryName != "Golang" || c.Slug != "go" {
+		t.Errorf("category after PATCH = %+v, want Golang keeping its slug", c)
+	}
+
+	commentID, err := ts.blog.AddComment(ctx, models.Comment{UserID: ts.userID(t, "alice"), PostID: postID, Message: "Nice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	comment := "/comment/" + strconv.FormatInt(commentID, 10)
+	expectStatus(t, ts.request(t, "PATCH", comment, token, map[string]interface{}{"post_id": postID + 1}), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "PATCH", comment, bob, map[string]string{"message": "Not nice"}), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "PATCH", comment, token, map[string]int64{"user_id": bobID}), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "DELETE", comment, bob, nil), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "DELETE", path, bob, nil), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "PATCH", comment, token, map[string]string{"message": "Very nice"}), http.StatusOK)
+	if c, _ := ts.blog.CommentByID(ctx, int(commentID)); c.Message != "Very nice" || c.UserID != ts.userID(t, "alice") || c.PostID != postID {
+		t.Errorf("comment after PATCH = %+v", c)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"techblogapi/models"
+)
+
+// statusClientClosedRequest is nginx's status for a request the client gave
+// up on. Nobody receives it, but it keeps those requests apart from server
+// errors in access logs.
+const statusClientClosedRequest = 499
+
+// serverError answers a request whose store call failed with err: 499 when
+// the client has gone away, 503 when the call ran out of time, and 500 for
+// anything else.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case r.Context().Err() == context.Canceled:
+		w.WriteHeader(statusClientClosedRequest)
+	case models.IsTimeout(err):
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	default:
+		log.Print(err)
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
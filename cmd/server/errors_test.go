@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"techblogapi/models"
+	"testing"
+	"time"
+)
+
+// slowStore is a store whose category listing never finishes in time, like
+// a query stuck behind a lock.
+type slowStore struct {
+	models.Store
+	timeout time.Duration
+}
+
+func (s slowStore) AllCategories(ctx context.Context) ([]models.Category, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestServerError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want int
+	}{
+		{"failure", context.Background(), errors.New("connection refused"), http.StatusInternalServerError},
+		{"timeout", context.Background(), context.DeadlineExceeded, http.StatusServiceUnavailable},
+		{"client gone", canceled, context.Canceled, statusClientClosedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/categories", nil).WithContext(tt.ctx)
+			serverError(w, r, tt.err)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.env.blog = slowStore{ts.blog, 20 * time.Millisecond}
+
+	res := ts.request(t, "GET", "/categories", "", nil)
+	expectStatus(t, res, http.StatusServiceUnavailable)
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("timeout response has no Retry-After header")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"techblogapi/auth"
+	"techblogapi/config"
+	"techblogapi/models"
+	"testing"
+	"time"
+)
+
+// testParams keep password hashing fast in tests.
+var testParams = auth.AuthParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+// testPassword passes the default password policy.
+const testPassword = "correct horse battery staple"
+
+// testServer runs the API on the in-memory stores.
+type testServer struct {
+	*httptest.Server
+	env      *Env
+	blog     *models.MemoryStore
+	sessions *auth.MemoryStore
+	mail     *recordingMailer
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	blog := models.NewMemoryStore()
+	blog.Params = &testParams
+	magicLink := auth.DefaultMagicLinkPolicy
+	magicLink.Secret = []byte("test secret")
+	magicLink.RedirectURL = "http://blog.test/login/magic/verify"
+	// Plain HTTP test servers need a cookie that isn't Secure
+	cookie := auth.CookiePolicy{HTTPOnly: true, SameSite: http.SameSiteLaxMode, Path: "/"}
+	sessions := auth.NewMemoryStore(auth.DefaultLockoutPolicy, magicLink, cookie)
+	mailer := &recordingMailer{sent: make(chan sentMail, 10)}
+
+	env := &Env{
+		blog:                blog,
+		cache:               sessions,
+		providers:           map[string]*auth.OIDCProvider{},
+		totpIssuer:          "techblogapi",
+		oidcSuccessRedirect: "http://blog.test/",
+		mailer:              mailer,
+		passwords:           auth.DefaultPasswordPolicy,
+		magicLink:           magicLink,
+		emailVerifyURL:      "http://blog.test/verify-email",
+		accountDeletion:     models.DeletionAnonymize,
+		tokens: &auth.TokenIssuer{
+			Keys:        []auth.SigningKey{{ID: "test", Algorithm: auth.AlgHS256, Secret: []byte("test signing key, 32 bytes long")}},
+			ActiveKeyID: "test",
+			Issuer:      "techblogapi",
+			AccessTTL:   time.Minute,
+			RefreshTTL:  time.Hour,
+		},
+	}
+	ts := &testServer{
+		Server:   httptest.NewServer(env.handler(config.SecurityHeaders{FrameAncestors: "'none'"})),
+		env:      env,
+		blog:     blog,
+		sessions: sessions,
+		mail:     mailer,
+	}
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+type sentMail struct {
+	to, subject, body string
+}
+
+// recordingMailer hands sent emails to the test instead of sending them.
+type recordingMailer struct {
+	sent chan sentMail
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.sent <- sentMail{to, subject, body}
+	return nil
+}
+
+// next waits for the next email sent.
+func (m *recordingMailer) next(t *testing.T) sentMail {
+	t.Helper()
+	select {
+	case mail := <-m.sent:
+		return mail
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+		return sentMail{}
+	}
+}
+
+// nextTo waits for the next email sent to address, skipping any others.
+func (m *recordingMailer) nextTo(t *testing.T, address string) sentMail {
+	t.Helper()
+	for {
+		if mail := m.next(t); mail.to == address {
+			return mail
+		}
+	}
+}
+
+// request sends a request with body encoded as JSON, authenticated with a
+// bearer token unless token is empty.
+func (ts *testServer) request(t *testing.T, method, path, token string, body interface{}) *http.Response {
+	t.Helper()
+	return ts.send(t, http.DefaultClient, method, path, token, body, nil)
+}
+
+func (ts *testServer) send(t *testing.T, client *http.Client, method, path, token string, body interface{}, header http.Header) *http.Response {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// cookieClient returns a client that keeps cookies and doesn't follow
+// redirects, like a browser tab whose redirects the test looks at.
+func cookieClient(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func expectStatus(t *testing.T, res *http.Response, want int) {
+	t.Helper()
+	if res.StatusCode != want {
+		b, _ := io.ReadAll(res.Body)
+		t.Fatalf("%s %s: got status %d, want %d: %s", res.Request.Method, res.Request.URL.Path, res.StatusCode, want, strings.TrimSpace(string(b)))
+	}
+}
+
+func decode(t *testing.T, res *http.Response, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatalf("%s %s: %v", res.Request.Method, res.Request.URL.Path, err)
+	}
+}
+
+// register creates an account through the API.
+func (ts *testServer) register(t *testing.T, username string) {
+	t.Helper()
+	res := ts.request(t, "POST", "/register", "", map[string]string{
+		"username": username,
+		"email":    username + "@example.com",
+		"password": testPassword,
+	})
+	expectStatus(t, res, http.StatusCreated)
+}
+
+// login signs in and returns the session token.
+func (ts *testServer) login(t *testing.T, username string) string {
+	t.Helper()
+	res := ts.request(t, "POST", "/login", "", map[string]string{"username": username, "password": testPassword})
+	expectStatus(t, res, http.StatusOK)
+	var body struct {
+		Results string `json:"results"`
+	}
+	decode(t, res, &body)
+	return body.Results
+}
+
+// user registers username and returns a session token for it.
+func (ts *testServer) user(t *testing.T, username string) string {
+	t.Helper()
+	ts.register(t, username)
+	return ts.login(t, username)
+}
+
+// superuser creates a superuser directly in the store and returns a session
+// token for it.
+func (ts *testServer) superuser(t *testing.T, username string) string {
+	t.Helper()
+	_, err := ts.blog.Register(context.Background(), models.User{Username: username, IsSuperuser: true, Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts.login(t, username)
+}
+
+func (ts *testServer) userID(t *testing.T, username string) int64 {
+	t.Helper()
+	u, err := ts.blog.UserByUsername(context.Background(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.UserID
+}
+
+// totpCode computes the current code for a base32 secret, as an
+// authenticator app would.
+func totpCode(t *testing.T, secret string, now time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(now.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
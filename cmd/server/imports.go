@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"techblogapi/models"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxImportItems and maxImportBytes limit a bulk request. Bigger
+	// migrations are sent in several batches.
+	maxImportItems = 10000
+	maxImportBytes = 32 << 20
+)
+
+var (
+	errTooManyItems = fmt.Errorf("a bulk request takes at most %d items", maxImportItems)
+	errTooLarge     = fmt.Errorf("a bulk request takes at most %d bytes", maxImportBytes)
+)
+
+// importResponse is the answer to a bulk request: what became of each item,
+// in request order, and how many items ended up in each status.
+type importResponse struct {
+	Mode    models.ImportMode     `json:"mode"`
+	Created int                   `json:"created"`
+	Failed  int                   `json:"failed"`
+	Skipped int                   `json:"skipped"`
+	Results []models.ImportResult `json:"results"`
+}
+
+// BulkInsertCategories creates the categories in the request body. See
+// bulkImport for the format and modes.
+func (env *Env) BulkInsertCategories(w http.ResponseWriter, r *http.Request) {
+	var categories []models.Category
+	env.bulkImport(w, r, "category", func(raw json.RawMessage) error {
+		var c models.Category
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return err
+		}
+		categories = append(categories, c)
+		return nil
+	}, func(mode models.ImportMode) ([]models.ImportResult, error) {
+		return env.blog.ImportCategories(r.Context(), categories, mode)
+	})
+}
+
+// BulkInsertPosts creates the posts in the request body. Posts are the
+// caller's; see authorFor for who may import them under another user_id.
+func (env *Env) BulkInsertPosts(w http.ResponseWriter, r *http.Request) {
+	me, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var posts []models.Post
+	env.bulkImport(w, r, "post", func(raw json.RawMessage) error {
+		var p models.Post
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return err
+		}
+		if p.UserID, err = authorFor(r, me, p.UserID); err != nil {
+			return err
+		}
+		posts = append(posts, p)
+		return nil
+	}, func(mode models.ImportMode) ([]models.ImportResult, error) {
+		return env.blog.ImportPosts(r.Context(), posts, mode)
+	})
+}
+
+// BulkInsertComments creates the comments in the request body, on the post
+// in the URL when there is one. Comments are the caller's, as with
+// BulkInsertPosts.
+func (env *Env) BulkInsertComments(w http.ResponseWriter, r *http.Request) {
+	var postID int64
+	if v, ok := mux.Vars(r)["id"]; ok {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		postID = id
+	}
+	me, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var comments []models.Comment
+	env.bulkImport(w, r, "comment", func(raw json.RawMessage) error {
+		var c models.Comment
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return err
+		}
+		if postID != 0 {
+			if c.PostID != 0 && c.PostID != postID {
+				return fmt.Errorf("post_id must be left out or be %d", postID)
+			}
+			c.PostID = postID
+		}
+		if c.UserID, err = authorFor(r, me, c.UserID); err != nil {
+			return err
+		}
+		comments = append(comments, c)
+		return nil
+	}, func(mode models.ImportMode) ([]models.ImportResult, error) {
+		return env.blog.ImportComments(r.Context(), comments, mode)
+	})
+}
+
+// bulkImport answers a bulk request for target, whose body is a JSON array
+// of items or, with Content-Type application/x-ndjson, one item per line.
+// decode is called on each item in order and store once with the mode, to
+// store the items decode accepted.
+//
+// ?mode=all-or-nothing, the default, stores nothing unless every item is
+// valid and answers 422 Unprocessable Entity otherwise. ?mode=best-effort
+// stores the valid items and reports the others. Either way the response
+// has a result per item. When items can't be decoded in all-or-nothing
+// mode, the others are skipped without being checked.
+func (env *Env) bulkImport(w http.ResponseWriter, r *http.Request, target string, decode func(json.RawMessage) error, store func(models.ImportMode) ([]models.ImportResult, error)) {
+	mode := models.ImportMode(r.URL.Query().Get("mode"))
+	switch mode {
+	case "":
+		mode = models.AllOrNothing
+	case models.AllOrNothing, models.BestEffort:
+	default:
+		writeValidationErrors(w, fieldErrors{"mode": {"must be all-or-nothing or best-effort"}})
+		return
+	}
+	items, err := readImport(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errTooManyItems || err == errTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if len(items) == 0 {
+		writeValidationErrors(w, fieldErrors{"items": {"is required"}})
+		return
+	}
+
+	res := importResponse{Mode: mode, Results: make([]models.ImportResult, len(items))}
+	var decoded []int // the request index of each item passed to store
+	for i, raw := range items {
+		res.Results[i].Index = i
+		if err := decode(raw); err != nil {
+			var invalid models.ValidationError
+			if !errors.As(err, &invalid) {
+				invalid = models.ValidationError{"item": {err.Error()}}
+			}
+			for field, problems := range invalid {
+				for _, problem := range problems {
+					res.Results[i].Fail(field, problem)
+				}
+			}
+			continue
+		}
+		decoded = append(decoded, i)
+	}
+	if mode == models.AllOrNothing && len(decoded) < len(items) {
+		for _, i := range decoded {
+			res.Results[i].Status = models.ImportSkipped
+		}
+	} else if len(decoded) > 0 {
+		stored, err := store(mode)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		for n, result := range stored {
+			result.Index = decoded[n]
+			res.Results[decoded[n]] = result
+		}
+	}
+
+	var ids []int64
+	for _, result := range res.Results {
+		switch result.Status {
+		case models.ImportCreated:
+			res.Created++
+			ids = append(ids, result.ID)
+		case models.ImportFailed:
+			res.Failed++
+		case models.ImportSkipped:
+			res.Skipped++
+		}
+	}
+	if res.Created > 0 {
+		env.record(r, models.AuditEntry{
+			Actor:      actor(r),
+			Action:     target + ".import",
+			TargetType: target,
+			Details:    auditJSON(map[string]interface{}{"mode": mode, "failed": res.Failed, "created": ids}),
+		})
+	}
+	if res.Created == 0 && res.Failed > 0 && mode == models.AllOrNothing {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// readImport splits the body of a bulk request into its items, without
+// decoding them. Blank NDJSON lines are ignored.
+func readImport(r *http.Request) ([]json.RawMessage, error) {
+	body := &limitedBody{r: r.Body, left: maxImportBytes + 1}
+	var items []json.RawMessage
+	add := func(item json.RawMessage) error {
+		if len(items) == maxImportItems {
+			return errTooManyItems
+		}
+		items = append(items, item)
+		return nil
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-ndjson" {
+		lines := bufio.NewReader(body)
+		for {
+			line, err := lines.ReadBytes('\n')
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				if err := add(line); err != nil {
+					return nil, err
+				}
+			}
+			if err == io.EOF {
+				return items, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	dec := json.NewDecoder(body)
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		if err == nil {
+			err = errors.New("the body must be a JSON array or NDJSON with Content-Type application/x-ndjson")
+		}
+		return nil, err
+	}
+	for dec.More() {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err != nil {
+			return nil, err
+		}
+		if err := add(item); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// limitedBody fails with errTooLarge once more than maxImportBytes are read
+// from r.
+type limitedBody struct {
+	r    io.Reader
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.r.Read(p)
+	if b.left -= int64(n); b.left == 0 {
+		return n, errTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"techblogapi/models"
+	"testing"
+)
+
+func TestBulkImport(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+	ctx := context.Background()
+
+	imported := func(res *http.Response, status int) importResponse {
+		t.Helper()
+		expectStatus(t, res, status)
+		var report importResponse
+		decode(t, res, &report)
+		return report
+	}
+	report := imported(ts.request(t, "POST", "/categories", token, []models.Category{{CategoryName: "Go"}, {CategoryName: "Rust"}}), http.StatusOK)
+	if report.Created != 2 || report.Results[1].ID == 0 || report.Results[1].Status != models.ImportCreated {
+		t.Fatalf("POST /categories = %+v", report)
+	}
+	goID := report.Results[0].ID
+
+	// One bad post keeps the others out unless the import is best-effort
+	posts := []map[string]interface{}{
+		{"title": "Hello", "category_id": goID},
+		{"title": "", "category_id": goID},
+		{"title": "Elsewhere", "category_id": 999},
+	}
+	report = imported(ts.request(t, "POST", "/posts", token, posts), http.StatusUnprocessableEntity)
+	if report.Created != 0 || report.Failed != 2 || report.Skipped != 1 || report.Results[0].ID != 0 {
+		t.Errorf("all-or-nothing POST /posts = %+v", report)
+	}
+	report = imported(ts.request(t, "POST", "/posts", token, append(posts, map[string]interface{}{"title": 5})), http.StatusUnprocessableEntity)
+	if report.Failed != 1 || report.Skipped != 3 || report.Results[3].Errors["item"] == nil {
+		t.Errorf("all-or-nothing POST /posts with an item that isn't a post = %+v", report)
+	}
+	if all, _ := ts.blog.AllPosts(ctx); len(all) != 0 {
+		t.Errorf("posts after a failed all-or-nothing import = %d, want 0", len(all))
+	}
+
+	report = imported(ts.request(t, "POST", "/posts?mode=best-effort", token, append(posts, map[string]interface{}{"title": 5})), http.StatusOK)
+	if report.Created != 1 || report.Failed != 3 {
+		t.Fatalf("best-effort POST /posts = %+v", report)
+	}
+	if r := report.Results[2]; r.Index != 2 || r.Errors["category_id"] == nil {
+		t.Errorf("post in a missing category = %+v", r)
+	}
+	post, err := ts.blog.PostById(ctx, int(report.Results[0].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(post) != 1 || post[0].UserID != ts.userID(t, "alice") || post[0].Slug != "hello" {
+		t.Errorf("imported post = %+v, want alice's with a slug", post)
+	}
+	postID := strconv.FormatInt(report.Results[0].ID, 10)
+
+	// NDJSON, with a blank line and a line that isn't JSON
+	body := "{\"message\": \"First\"}\n\n{\"message\": \"Second\"}\nnot json\n"
+	req, err := http.NewRequest("POST", ts.URL+"/comments/post/"+postID+"?mode=best-effort", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	report = imported(res, http.StatusOK)
+	if report.Created != 2 || report.Failed != 1 || report.Results[2].Errors["item"] == nil {
+		t.Errorf("NDJSON POST /comments/post/%s = %+v", postID, report)
+	}
+	if comments, _ := ts.blog.CommentsByPost(ctx, int(post[0].PostID)); len(comments) != 2 {
+		t.Errorf("comments on the post after importing = %d, want 2", len(comments))
+	}
+
+	// Only a superuser can import content in someone else's name
+	bob := ts.user(t, "bob")
+	report = imported(ts.request(t, "POST", "/comments/post/"+postID, bob, []models.Comment{{UserID: ts.userID(t, "alice"), Message: "Forged"}}), http.StatusUnprocessableEntity)
+	if report.Results[0].Errors["user_id"] == nil {
+		t.Errorf("comment attributed to someone else = %+v", report)
+	}
+	report = imported(ts.request(t, "POST", "/comments/post/"+postID, bob, []models.Comment{{UserID: ts.userID(t, "bob"), Message: "Mine"}}), http.StatusOK)
+	if report.Created != 1 {
+		t.Errorf("comment naming its own author = %+v", report)
+	}
+	admin := ts.superuser(t, "admin")
+	report = imported(ts.request(t, "POST", "/posts", admin, []map[string]interface{}{{"title": "Migrated", "category_id": goID, "user_id": ts.userID(t, "bob")}}), http.StatusOK)
+	if p, _ := ts.blog.PostById(ctx, int(report.Results[0].ID)); len(p) != 1 || p[0].UserID != ts.userID(t, "bob") {
+		t.Errorf("post a superuser imported for bob = %+v", p)
+	}
+	res = ts.request(t, "POST", "/apikeys", admin, map[string]interface{}{"name": "import", "scopes": []string{"posts:write"}})
+	expectStatus(t, res, http.StatusCreated)
+	var key struct {
+		Key string `json:"key"`
+	}
+	decode(t, res, &key)
+	report = imported(ts.request(t, "POST", "/posts", key.Key, []map[string]interface{}{{"title": "Keyed", "category_id": goID, "user_id": ts.userID(t, "bob")}}), http.StatusUnprocessableEntity)
+	if report.Results[0].Errors["user_id"] == nil {
+		t.Errorf("post a superuser's API key attributed to bob = %+v", report)
+	}
+
+	expectStatus(t, ts.request(t, "POST", "/comments?mode=some", token, []models.Comment{{Message: "Hi"}}), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "POST", "/comments", token, []models.Comment{}), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "POST", "/comments", token, map[string]string{"message": "Hi"}), http.StatusBadRequest)
+	expectStatus(t, ts.request(t, "POST", "/categories", "", []models.Category{{CategoryName: "C"}}), http.StatusUnauthorized)
+}
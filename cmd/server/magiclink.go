@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"techblogapi/auth"
+	"techblogapi/models"
+)
+
+type magicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+type magicLinkLoginRequest struct {
+	Token string `json:"token"`
+}
+
+// maxMagicLinkBody limits the body of a magic link login, which only holds
+// the token.
+const maxMagicLinkBody = 4 << 10
+
+// RequestMagicLink emails a single use login link to the given address. The
+// response is the same whether or not an account has that address, so the
+// endpoint can't be used to find out who is registered.
+func (env *Env) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req magicLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if !strings.Contains(req.Email, "@") {
+		http.Error(w, "a valid email is required", http.StatusBadRequest)
+		return
+	}
+
+	wait, err := env.cache.AllowMagicLink(r.Context(), req.Email, env.clientIP(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many login links requested, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	u, err := env.blog.UserByEmail(r.Context(), req.Email)
+	switch {
+	case err == models.ErrUserNotFound || (err == nil && u.Disabled):
+	case err != nil:
+		serverError(w, r, err)
+		return
+	default:
+		token, err := env.cache.IssueMagicLink(r.Context(), u.Username)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		// Sent in the background so the response time doesn't tell whether
+		// the address belongs to an account
+		go env.sendMagicLink(u, token)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"results": "If an account uses this email, a login link is on its way"})
+}
+
+func (env *Env) sendMagicLink(u models.User, token string) {
+	link := env.magicLink.RedirectURL + "?" + url.Values{"token": {token}}.Encode()
+	body := fmt.Sprintf("Hi %s,\n\nUse this link to log in. It works once and expires in %s.\n\n%s\n\nIf you didn't ask for it, you can ignore this email.\n",
+		u.Username, env.magicLink.TTL, link)
+	if err := env.mailer.Send(u.Email, "Your login link", body); err != nil {
+		log.Print(err)
+	}
+}
+
+// magicLinkPage is what an emailed login link opens. It only asks the user
+// to confirm; fetching the link, as mail scanners and link previews do,
+// doesn't use the token up.
+var magicLinkPage = template.Must(template.New("magic").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="referrer" content="no-referrer">
+<title>Log in</title>
+</head>
+<body>
+<form method="post">
+<input type="hidden" name="token" value="{{.}}">
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+// ConfirmMagicLink answers the GET of an emailed link with a page that posts
+// its token to MagicLinkLogin.
+func (env *Env) ConfirmMagicLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := magicLinkPage.Execute(w, r.URL.Query().Get("token")); err != nil {
+		log.Print(err)
+	}
+}
+
+// MagicLinkLogin logs in with the token from an emailed link, posted as a
+// form by ConfirmMagicLink's page or as JSON. Users with two-factor
+// authentication still have to pass it.
+func (env *Env) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxMagicLinkBody)
+	token := r.PostFormValue("token")
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var req magicLinkLoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		token = req.Token
+	}
+	username, err := env.cache.RedeemMagicLink(r.Context(), token)
+	if err != nil {
+		if err != auth.ErrInvalidToken {
+			log.Print(err)
+		}
+		http.Error(w, "This login link is invalid or has expired", http.StatusUnauthorized)
+		return
+	}
+	u, err := env.blog.UserByUsername(r.Context(), username)
+	if err != nil || u.Disabled {
+		http.Error(w, "This login link is invalid or has expired", http.StatusUnauthorized)
+		return
+	}
+	if env.requireSecondFactor(w, r, u, loginModeMagic) {
+		return
+	}
+	env.finishLogin(w, r, u, loginModeMagic, nil)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var linkPattern = regexp.MustCompile(`https?://\S+`)
+
+func TestMagicLinkLogin(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "alice")
+
+	res := ts.request(t, "POST", "/login/magic", "", map[string]string{"email": "nobody@example.com"})
+	expectStatus(t, res, http.StatusAccepted)
+	res = ts.request(t, "POST", "/login/magic", "", map[string]string{"email": "ALICE@example.com"})
+	expectStatus(t, res, http.StatusAccepted)
+
+	mail := ts.mail.next(t)
+	if mail.to != "alice@example.com" {
+		t.Fatalf("login link sent to %q, want alice@example.com", mail.to)
+	}
+	link, err := url.Parse(linkPattern.FindString(mail.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := link.Query().Get("token")
+	if token == "" {
+		t.Fatalf("no token in email body %q", mail.body)
+	}
+
+	// Opening the link, as a mail scanner would, only shows a form to confirm
+	verify := "/login/magic/verify?" + url.Values{"token": {token}}.Encode()
+	for i := 0; i < 2; i++ {
+		res = ts.send(t, cookieClient(t), "GET", verify, "", nil, nil)
+		expectStatus(t, res, http.StatusOK)
+		page, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(page), `value="`+token+`"`) || res.Header.Get("Set-Cookie") != "" {
+			t.Fatalf("GET %s = %s", verify, page)
+		}
+	}
+
+	browser := cookieClient(t)
+	confirm := func(client *http.Client) *http.Response {
+		t.Helper()
+		res, err := client.PostForm(ts.URL+"/login/magic/verify", url.Values{"token": {token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+	res = confirm(browser)
+	expectStatus(t, res, http.StatusFound)
+	if got := res.Header.Get("Location"); got != ts.env.oidcSuccessRedirect {
+		t.Errorf("redirected to %q, want %q", got, ts.env.oidcSuccessRedirect)
+	}
+	expectStatus(t, ts.send(t, browser, "GET", "/me", "", nil, nil), http.StatusOK)
+
+	// Links work once
+	expectStatus(t, confirm(cookieClient(t)), http.StatusUnauthorized)
+}
@@ -1,62 +1,99 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
-	"os"
 	"strconv"
 	"techblogapi/auth"
+	"techblogapi/config"
+	"techblogapi/mail"
 	"techblogapi/models"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
-// Make models.BlogModel the dependency in Env
+// Env holds the dependencies of the handlers. The stores are interfaces so
+// tests can run the handlers against models.MemoryStore and auth.MemoryStore.
 type Env struct {
-	blog  models.BlogModel
-	cache auth.RedisClient
+	blog       models.Store
+	cache      auth.SessionStore
+	tokens     *auth.TokenIssuer
+	providers  map[string]*auth.OIDCProvider
+	trustProxy bool
+	totpIssuer string
+
+	// oidcSuccessRedirect is where browsers go after signing in with a provider
+	// or a magic link
+	oidcSuccessRedirect string
+
+	mailer    mail.Mailer
+	passwords auth.PasswordPolicy
+	magicLink auth.MagicLinkPolicy
+
+	// emailVerifyURL is where links confirming a new email address point
+	emailVerifyURL string
+	// accountDeletion is models.DeletionAnonymize or models.DeletionDelete
+	accountDeletion string
 }
 
 func main() {
-	err := godotenv.Load("local.env")
+	cfg, err := config.Load("local.env")
 	if err != nil {
 		log.Fatalf("An error occured. Err: %s", err)
 	}
-	host := os.Getenv("host")
-	port := os.Getenv("port")
-	user := os.Getenv("user")
-	pass := os.Getenv("pass")
-	dbname := os.Getenv("db")
 
 	// Initialize connection pool
-	newport, err := strconv.Atoi(port)
-	if err != nil {
-		log.Fatal(err)
-	}
-	conn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, newport, user, pass, dbname)
-	db, err := sql.Open("postgres", conn)
+	db, err := sql.Open("postgres", cfg.DSN())
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	redisConn, err := auth.ConnectRedis()
+	redisConn, err := auth.ConnectRedis(cfg.RedisAddr, cfg.RedisTimeout)
 	if err != nil {
 		panic(err)
 	}
 
 	// Initialize Env with models.BlogModel that wraps connection pool
 	env := &Env{
-		blog:  models.BlogModel{DB: db},
-		cache: auth.RedisClient{Conn: redisConn},
+		blog:       models.BlogModel{DB: db, Params: &cfg.Argon2, Timeouts: cfg.DBTimeouts},
+		cache:      &auth.RedisClient{Conn: redisConn, Lockout: cfg.Lockout, MagicLink: cfg.MagicLink, Cookie: cfg.Cookie},
+		tokens:     &cfg.Tokens,
+		providers:  map[string]*auth.OIDCProvider{},
+		trustProxy: cfg.TrustProxy,
+		totpIssuer: cfg.TOTPIssuer,
+
+		oidcSuccessRedirect: cfg.OIDCSuccessRedirect,
+		mailer:              mail.New(cfg.SMTP),
+		passwords:           cfg.Passwords,
+		magicLink:           cfg.MagicLink,
+		emailVerifyURL:      cfg.EmailVerifyURL,
+		accountDeletion:     cfg.AccountDeletion,
+	}
+	for _, p := range cfg.OIDCProviders {
+		env.providers[p.Name] = p
 	}
 
+	if cfg.AuditRetention > 0 {
+		go env.pruneAuditLog(cfg.AuditRetention)
+	}
+	if cfg.TrashRetention > 0 {
+		go env.purgeTrash(cfg.TrashRetention)
+	}
+	log.Fatal(http.ListenAndServe(":8080", env.handler(cfg.Headers)))
+}
+
+// handler routes the API and wraps it in the middleware every request goes
+// through.
+func (env *Env) handler(headers config.SecurityHeaders) http.Handler {
 	r := mux.NewRouter()
 	// r.Use(contentTypeApplicationJsonMiddleware)
 
@@ -64,32 +101,52 @@ func main() {
 	r.HandleFunc("/register", env.Register).Methods("POST")
 	r.HandleFunc("/login", env.Login).Methods("POST")
 	r.HandleFunc("/checkSession", env.Handle).Methods("POST")
+	r.HandleFunc("/csrf", env.GetCSRFToken).Methods("GET")
+	r.HandleFunc("/login/2fa", env.LoginSecondFactor).Methods("POST")
+	r.HandleFunc("/login/2fa/enroll", env.LoginEnrollSecondFactor).Methods("POST")
+	if env.magicLink.Enabled() {
+		r.HandleFunc("/login/magic", env.RequestMagicLink).Methods("POST")
+		r.HandleFunc("/login/magic/verify", env.ConfirmMagicLink).Methods("GET")
+		r.HandleFunc("/login/magic/verify", env.MagicLinkLogin).Methods("POST")
+	}
+	r.HandleFunc("/login/{provider}", env.OIDCLogin).Methods("GET")
+	r.HandleFunc("/login/{provider}/callback", env.OIDCCallback).Methods("GET")
+	if env.tokens.Enabled() {
+		r.HandleFunc("/token", env.IssueToken).Methods("POST")
+		r.HandleFunc("/token/refresh", env.RefreshToken).Methods("POST")
+		r.HandleFunc("/token/revoke", env.RevokeToken).Methods("POST")
+	}
 
 	r.HandleFunc("/categories", env.GetCategories).Methods("GET")
 	r.HandleFunc("/categories/id/{id}", env.GetCategoryByID).Methods("GET")
 	r.HandleFunc("/categories/name/{name}", env.GetIDForCategory).Methods("GET")
-	r.HandleFunc("/category", env.InsertCategory).Methods("POST")
-	// r.HandleFunc("/categories", env.BulkInsertCategories).Methods("POST")
-	r.HandleFunc("/category/{id}", env.EditCategory).Methods("PUT")
-	r.HandleFunc("/category/{id}", env.DeleteCategory).Methods("DELETE")
+	r.HandleFunc("/category", env.requireScope("categories:write", env.InsertCategory)).Methods("POST")
+	r.HandleFunc("/categories", env.requireScope("categories:write", env.BulkInsertCategories)).Methods("POST")
+	r.HandleFunc("/category/{id}", env.requireScope("categories:write", env.EditCategory)).Methods("PUT")
+	r.HandleFunc("/category/{id}", env.requireScope("categories:write", env.PatchCategory)).Methods("PATCH")
+	r.HandleFunc("/category/{id}", env.requireScope("categories:write", env.DeleteCategory)).Methods("DELETE")
+	r.HandleFunc("/categories/{id}/merge", env.requireScope("categories:write", env.MergeCategories)).Methods("POST")
 
 	r.HandleFunc("/posts", env.GetPosts).Methods("GET")
 	r.HandleFunc("/posts/category/{id}", env.GetPostsByCategoryId).Methods("GET")
 	r.HandleFunc("/posts/category/slug/{slug}", env.GetPostsByCategorySlug).Methods("GET")
 	r.HandleFunc("/post/id/{id}", env.GetPostById).Methods("GET")
 	r.HandleFunc("/post/slug/{slug}", env.GetPostBySlug).Methods("GET")
-	r.HandleFunc("/post", env.InsertPost).Methods("POST")
-	// r.HandleFunc("/posts", env.BulkInsertPosts).Methods("POST")
-	r.HandleFunc("/post/{id}", env.EditPost).Methods("PUT")
-	r.HandleFunc("/post/{id}", env.DeletePost).Methods("DELETE")
+	r.HandleFunc("/post", env.requireScope("posts:write", env.InsertPost)).Methods("POST")
+	r.HandleFunc("/posts", env.requireScope("posts:write", env.BulkInsertPosts)).Methods("POST")
+	r.HandleFunc("/post/{id}", env.requireScope("posts:write", env.EditPost)).Methods("PUT")
+	r.HandleFunc("/post/{id}", env.requireScope("posts:write", env.PatchPost)).Methods("PATCH")
+	r.HandleFunc("/post/{id}", env.requireScope("posts:write", env.DeletePost)).Methods("DELETE")
 
 	r.HandleFunc("/comments", env.GetComments).Methods("GET")
 	// r.HandleFunc("/comments/post/{postid}", env.GetCommentsByPostId).Methods("GET")
 	// r.HandleFunc("/comments/user/{userid}", env.GetPostByUserId).Methods("GET")
-	r.HandleFunc("/comment", env.InsertComment).Methods("POST")
-	// r.HandleFunc("/comments/post/{id}", env.BulkInsertComments).Methods("POST")
-	r.HandleFunc("/comment/{id}", env.EditComment).Methods("EDIT")
-	r.HandleFunc("/comment/{id}", env.DeleteComment).Methods("DELETE")
+	r.HandleFunc("/comment", env.requireScope("comments:write", env.InsertComment)).Methods("POST")
+	r.HandleFunc("/comments", env.requireScope("comments:write", env.BulkInsertComments)).Methods("POST")
+	r.HandleFunc("/comments/post/{id}", env.requireScope("comments:write", env.BulkInsertComments)).Methods("POST")
+	r.HandleFunc("/comment/{id}", env.requireScope("comments:write", env.EditComment)).Methods("PUT", "EDIT")
+	r.HandleFunc("/comment/{id}", env.requireScope("comments:write", env.PatchComment)).Methods("PATCH")
+	r.HandleFunc("/comment/{id}", env.requireScope("comments:write", env.DeleteComment)).Methods("DELETE")
 	// r.HandleFunc("/comments/post/{id}", env.DeleteCommentsByPostId).Methods("DELETE")
 
 	// r.HandleFunc("/images", env.GetImages).Methods("GET")
@@ -100,18 +157,48 @@ func main() {
 	// r.HandleFunc("/image/{id}", env.DeleteImage).Methods("DELETE")
 	// r.HandleFunc("/image/post/{id}", env.DeleteImageByPostId).Methods("DELETE")
 
-	r.HandleFunc("/logout", env.Logout).Methods("POST")
-
-	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "Content-Length", "Accept", "Accept-Encoding", "X-Requested-With", "X-CSRF-Token", "Set-Cookie", "Authorization"})
+	r.HandleFunc("/logout", env.requireAuth(env.Logout)).Methods("POST")
+
+	r.HandleFunc("/me", env.requireAuth(env.GetMe)).Methods("GET")
+	r.HandleFunc("/me", env.requireAuth(env.UpdateMe)).Methods("PATCH")
+	r.HandleFunc("/me", env.requireAuth(env.DeleteMe)).Methods("DELETE")
+	r.HandleFunc("/me/export", env.requireAuth(env.ExportMe)).Methods("GET")
+	r.HandleFunc("/me/password", env.requireAuth(env.ChangePassword)).Methods("POST")
+	r.HandleFunc("/me/identities/{provider}", env.requireAuth(env.LinkIdentity)).Methods("POST")
+	r.HandleFunc("/verify-email", env.VerifyEmail).Methods("GET")
+	r.HandleFunc("/users/{username}", env.GetUser).Methods("GET")
+	r.HandleFunc("/authors", env.GetAuthors).Methods("GET")
+	r.HandleFunc("/authors/{username}", env.GetAuthor).Methods("GET")
+	r.HandleFunc("/authors/{username}/posts", env.GetAuthorPosts).Methods("GET")
+
+	r.HandleFunc("/me/2fa/enroll", env.requireAuth(env.EnrollSecondFactor)).Methods("POST")
+	r.HandleFunc("/me/2fa/confirm", env.requireAuth(env.ConfirmSecondFactor)).Methods("POST")
+	r.HandleFunc("/me/2fa/recovery-codes", env.requireAuth(env.RegenerateRecoveryCodes)).Methods("POST")
+	r.HandleFunc("/me/2fa", env.requireAuth(env.DisableSecondFactor)).Methods("DELETE")
+
+	r.HandleFunc("/apikeys", env.requireAuth(env.GetAPIKeys)).Methods("GET")
+	r.HandleFunc("/apikeys", env.requireAuth(env.CreateAPIKey)).Methods("POST")
+	r.HandleFunc("/apikeys/{id}", env.requireAuth(env.RevokeAPIKey)).Methods("DELETE")
+
+	r.HandleFunc("/admin/unlock", env.UnlockLogin).Methods("POST")
+	r.HandleFunc("/admin/users", env.CreateUser).Methods("POST")
+	r.HandleFunc("/admin/2fa-policy", env.GetTwoFactorPolicy).Methods("GET")
+	r.HandleFunc("/admin/2fa-policy", env.SetTwoFactorPolicy).Methods("PUT")
+	r.HandleFunc("/admin/audit", env.GetAuditLog).Methods("GET")
+	r.HandleFunc("/admin/trash", env.GetTrash).Methods("GET")
+	r.HandleFunc("/admin/trash/{type}/{id}/restore", env.RestoreFromTrash).Methods("POST")
+
+	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "Content-Length", "Accept", "Accept-Encoding", "X-Requested-With", "X-CSRF-Token", "X-Request-ID", "Set-Cookie", "Authorization"})
 	originsOk := handlers.AllowedOrigins([]string{"http://127.0.0.1:3000", "127.0.0.1:3000", "localhost:3000", "http://localhost:3000"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS", "DELETE"})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "OPTIONS", "DELETE"})
 	allowCreds := handlers.AllowCredentials()
-	exposedHeaders := handlers.ExposedHeaders([]string{"Set-Cookie"})
+	exposedHeaders := handlers.ExposedHeaders([]string{"Set-Cookie", "X-Request-ID"})
 
-	// start server listen with error handling
 	r.Use(contentTypeApplicationJsonMiddleware)
-	log.Fatal(http.ListenAndServe(":8080", handlers.CORS(originsOk, headersOk, methodsOk, exposedHeaders, allowCreds)(r)))
-	http.Handle("/", r)
+	r.Use(env.csrfProtect)
+	// The security headers wrap CORS so preflight responses get them too
+	cors := handlers.CORS(originsOk, headersOk, methodsOk, exposedHeaders, allowCreds)(r)
+	return withRequestID(securityHeaders(headers)(cors))
 }
 
 func contentTypeApplicationJsonMiddleware(next http.Handler) http.Handler {
@@ -122,13 +209,11 @@ func contentTypeApplicationJsonMiddleware(next http.Handler) http.Handler {
 }
 
 func (env *Env) HandleCheck(w http.ResponseWriter, r *http.Request) int {
-	loggedIn := env.cache.CheckSession(w, r)
-	fmt.Println("logged in ", loggedIn)
-
-	for _, c := range r.Cookies() {
-		fmt.Println("allCookies", c)
+	if _, err := env.authenticate(r); err == nil {
+		return http.StatusOK
 	}
-
+	// Older clients post the session token as the request body
+	loggedIn := env.cache.CheckSession(w, r)
 	if loggedIn != http.StatusOK {
 		response := map[string]int{"Login returned code": loggedIn}
 		json.NewEncoder(w).Encode(response)
@@ -148,10 +233,9 @@ func (env *Env) Handle(w http.ResponseWriter, r *http.Request) {
 
 func (env *Env) GetCategories(w http.ResponseWriter, r *http.Request) {
 	// Execute the SQL query by calling the AllCategoriesMethod() from env.blog
-	categories, err := env.blog.AllCategories()
+	categories, err := env.blog.AllCategories(r.Context())
 	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+		serverError(w, r, err)
 		return
 	}
 	json.NewEncoder(w).Encode(map[string][]models.Category{"results": categories})
@@ -167,13 +251,11 @@ func (env *Env) GetCategoryByID(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	fmt.Println("id ", id)
-	categoryName, err := env.blog.GetCatNameByID(id)
+	categoryName, err := env.blog.GetCatNameByID(r.Context(), id)
 	if err != nil {
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
-	fmt.Println("categoryByID ", categoryName)
 	json.NewEncoder(w).Encode(map[string]string{"category_name": categoryName})
 }
 
@@ -184,7 +266,7 @@ func (env *Env) GetIDForCategory(w http.ResponseWriter, r *http.Request) {
 	// }
 	vars := mux.Vars(r)
 	name := vars["name"]
-	id, err := env.blog.GetCatIDByName(name)
+	id, err := env.blog.GetCatIDByName(r.Context(), name)
 	if err != nil {
 		return
 	}
@@ -202,39 +284,173 @@ func (env *Env) InsertCategory(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
-	env.blog.AddCategory(c)
+	id, err := env.blog.AddCategory(r.Context(), c)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	env.auditChange(r, "category.create", "category", strconv.FormatInt(id, 10), nil, env.snapshot(r.Context(), "category", int(id)))
 }
 
+// EditCategory replaces a category with the one in the request body, which
+// must have every field.
 func (env *Env) EditCategory(w http.ResponseWriter, r *http.Request) {
-	// responseCode := env.HandleCheck(w, r)
-	// if responseCode != http.StatusOK {
-	// 	return
-	// }
-	vars := mux.Vars(r)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Category Id: %v\n", vars["id"])
-	categoryId, err := strconv.Atoi(vars["id"])
+	env.editCategory(w, r, replaceWith(categoryFields))
+}
+
+// PatchCategory changes the fields of a category given in the request body, a
+// JSON merge patch.
+func (env *Env) PatchCategory(w http.ResponseWriter, r *http.Request) {
+	env.editCategory(w, r, mergePatch)
+}
+
+func (env *Env) editCategory(w http.ResponseWriter, r *http.Request, change changeFunc) {
+	// Categories are shared by every author, so only superusers change them
+	if _, ok := env.requireSuperuser(w, r); !ok {
+		return
+	}
+	id, body, ok := editRequest(w, r)
+	if !ok {
+		return
+	}
+	before := env.snapshot(r.Context(), "category", id)
+	c, err := env.blog.UpdateCategory(r.Context(), id, func(c *models.Category) error {
+		if err := applyChange(change, body, c); err != nil {
+			return err
+		}
+		return unchanged("category_id", c.CategoryID, int64(id))
+	})
 	if err != nil {
+		editError(w, r, err)
 		return
 	}
-	category := models.Category{}
-	json.NewDecoder(r.Body).Decode(&category)
-	env.blog.PutCategory(categoryId, category.CategoryName)
+	env.auditChange(r, "category.update", "category", strconv.Itoa(id), before, c)
+	json.NewEncoder(w).Encode(map[string]models.Category{"results": c})
 }
 
+// DeleteCategory moves a category to the trash. A category with posts is
+// only deleted with ?reassign_to={id}, which moves its posts and images to
+// that category first.
 func (env *Env) DeleteCategory(w http.ResponseWriter, r *http.Request) {
-	// responseCode := env.HandleCheck(w, r)
-	// if responseCode != http.StatusOK {
-	// 	return
-	// }
-	vars := mux.Vars(r)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Category Id: %v\n", vars["id"])
-	categoryId, err := strconv.Atoi(vars["id"])
+	if _, ok := env.requireSuperuser(w, r); !ok {
+		return
+	}
+	categoryId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	before, ok := env.categoryOr404(w, r, categoryId)
+	if !ok {
+		return
+	}
+	res := models.ReassignResult{Deleted: []int64{int64(categoryId)}}
+	if v := r.URL.Query().Get("reassign_to"); v != "" {
+		to, err := strconv.Atoi(v)
+		if err != nil {
+			writeValidationErrors(w, fieldErrors{"reassign_to": {"must be a category id"}})
+			return
+		}
+		res, err = env.blog.MergeCategories(r.Context(), to, []int{categoryId})
+		if err != nil {
+			reassignError(w, r, "reassign_to", err)
+			return
+		}
+	} else {
+		_, err = env.blog.DeleteCategory(r.Context(), categoryId)
+		if errors.Is(err, models.ErrCategoryInUse) {
+			http.Error(w, "category still has posts, move them with ?reassign_to={category id}", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	env.record(r, models.AuditEntry{
+		Actor:      actor(r),
+		Action:     "category.delete",
+		TargetType: "category",
+		TargetID:   mux.Vars(r)["id"],
+		Details:    auditJSON(res),
+		Before:     auditJSON(before),
+	})
+	json.NewEncoder(w).Encode(map[string]models.ReassignResult{"results": res})
+}
+
+type mergeRequest struct {
+	// From are the categories merged into the one in the URL
+	From []int `json:"from"`
+}
+
+// MergeCategories moves the posts and images of the categories in the
+// request body to the category in the URL and deletes them.
+func (env *Env) MergeCategories(w http.ResponseWriter, r *http.Request) {
+	if _, ok := env.requireSuperuser(w, r); !ok {
+		return
+	}
+	into, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var req mergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.From) == 0 {
+		writeValidationErrors(w, fieldErrors{"from": {"is required"}})
+		return
+	}
+	if _, ok := env.categoryOr404(w, r, into); !ok {
+		return
+	}
+	var before []interface{}
+	for _, id := range req.From {
+		if c := env.snapshot(r.Context(), "category", id); c != nil {
+			before = append(before, c)
+		}
+	}
+	res, err := env.blog.MergeCategories(r.Context(), into, req.From)
+	if err != nil {
+		reassignError(w, r, "from", err)
+		return
+	}
+	env.record(r, models.AuditEntry{
+		Actor:      actor(r),
+		Action:     "category.merge",
+		TargetType: "category",
+		TargetID:   mux.Vars(r)["id"],
+		Details:    auditJSON(res),
+		Before:     auditJSON(before),
+	})
+	json.NewEncoder(w).Encode(map[string]models.ReassignResult{"results": res})
+}
+
+// categoryOr404 returns the category with id, answering 404 Not Found if
+// there is none.
+func (env *Env) categoryOr404(w http.ResponseWriter, r *http.Request, id int) (models.Category, bool) {
+	c, err := env.blog.CategoryByID(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, models.ErrCategoryNotFound.Error(), http.StatusNotFound)
+		return models.Category{}, false
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return models.Category{}, false
+	}
+	return c, true
+}
+
+// reassignError answers a failed MergeCategories, with 422 Unprocessable
+// Entity on field when it names categories that can't be used.
+func reassignError(w http.ResponseWriter, r *http.Request, field string, err error) {
+	if errors.Is(err, models.ErrCategoryNotFound) || errors.Is(err, models.ErrMergeIntoItself) {
+		writeValidationErrors(w, fieldErrors{field: {err.Error()}})
 		return
 	}
-	env.blog.DeleteCategory(categoryId)
+	serverError(w, r, err)
 }
 
 func (env *Env) GetPosts(w http.ResponseWriter, r *http.Request) {
@@ -242,10 +458,9 @@ func (env *Env) GetPosts(w http.ResponseWriter, r *http.Request) {
 	// if responseCode != http.StatusOK {
 	// 	return
 	// }
-	posts, err := env.blog.AllPosts()
+	posts, err := env.blog.AllPosts(r.Context())
 	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+		serverError(w, r, err)
 		return
 	}
 	// fmt.Println("posts ", posts)
@@ -262,10 +477,9 @@ func (env *Env) GetPostById(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	post, err := env.blog.PostById(id)
+	post, err := env.blog.PostById(r.Context(), id)
 	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+		serverError(w, r, err)
 		return
 	}
 	json.NewEncoder(w).Encode(map[string][]models.Post{"results": post})
@@ -278,10 +492,9 @@ func (env *Env) GetPostBySlug(w http.ResponseWriter, r *http.Request) {
 	// }
 	vars := mux.Vars(r)
 	slug := vars["slug"]
-	post, err := env.blog.PostBySlug(slug)
+	post, err := env.blog.PostBySlug(r.Context(), slug)
 	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+		serverError(w, r, err)
 		return
 	}
 	json.NewEncoder(w).Encode(map[string][]models.Post{"results": post})
@@ -297,7 +510,7 @@ func (env *Env) GetPostsByCategoryId(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	posts, err := env.blog.AllPostsByCatID(categoryid)
+	posts, err := env.blog.AllPostsByCatID(r.Context(), categoryid)
 	json.NewEncoder(w).Encode(map[string][]models.Post{"results": posts})
 }
 
@@ -308,7 +521,7 @@ func (env *Env) GetPostsByCategorySlug(w http.ResponseWriter, r *http.Request) {
 	// }
 	vars := mux.Vars(r)
 	categorySlug := vars["slug"]
-	posts, err := env.blog.AllPostsByCatSlug(categorySlug)
+	posts, err := env.blog.AllPostsByCatSlug(r.Context(), categorySlug)
 	if err != nil {
 		return
 	}
@@ -322,31 +535,69 @@ func (env *Env) InsertPost(w http.ResponseWriter, r *http.Request) {
 	// }
 	post := models.Post{}
 	err := json.NewDecoder(r.Body).Decode(&post)
-	fmt.Println("post to insert ", post)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	me, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if post.UserID, err = authorFor(r, me, post.UserID); err != nil {
+		editError(w, r, err)
+		return
 	}
-	_, err = env.blog.AddPost(post)
+	id, err := env.blog.AddPost(r.Context(), post)
 	if err != nil {
+		serverError(w, r, err)
 		return
 	}
+	env.auditChange(r, "post.create", "post", strconv.FormatInt(id, 10), nil, env.snapshot(r.Context(), "post", int(id)))
 }
 
+// EditPost replaces a post with the one in the request body, which must have
+// every field.
 func (env *Env) EditPost(w http.ResponseWriter, r *http.Request) {
-	// responseCode := env.HandleCheck(w, r)
-	// if responseCode != http.StatusOK {
-	// 	return
-	// }
-	vars := mux.Vars(r)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Post Id: %v\n", vars["id"])
-	postid, err := strconv.Atoi(vars["id"])
+	env.editPost(w, r, replaceWith(postFields))
+}
+
+// PatchPost changes the fields of a post given in the request body, a JSON
+// merge patch.
+func (env *Env) PatchPost(w http.ResponseWriter, r *http.Request) {
+	env.editPost(w, r, mergePatch)
+}
+
+func (env *Env) editPost(w http.ResponseWriter, r *http.Request, change changeFunc) {
+	id, body, ok := editRequest(w, r)
+	if !ok {
+		return
+	}
+	me, err := env.currentUser(r)
 	if err != nil {
+		serverError(w, r, err)
 		return
 	}
-	newpost := models.Post{}
-	json.NewDecoder(r.Body).Decode(&newpost)
-	env.blog.PutPost(postid, newpost)
+	before := env.snapshot(r.Context(), "post", id)
+	p, err := env.blog.UpdatePost(r.Context(), id, func(p *models.Post) error {
+		if err := checkAuthor(r, me, p.UserID); err != nil {
+			return err
+		}
+		author := p.UserID
+		if err := applyChange(change, body, p); err != nil {
+			return err
+		}
+		if err := keepAuthor(r, me, &p.UserID, author); err != nil {
+			return err
+		}
+		return unchanged("post_id", p.PostID, int64(id))
+	})
+	if err != nil {
+		editError(w, r, err)
+		return
+	}
+	env.auditChange(r, "post.update", "post", strconv.Itoa(id), before, p)
+	json.NewEncoder(w).Encode(map[string]models.Post{"results": p})
 }
 
 func (env *Env) DeletePost(w http.ResponseWriter, r *http.Request) {
@@ -355,20 +606,40 @@ func (env *Env) DeletePost(w http.ResponseWriter, r *http.Request) {
 	// 	return
 	// }
 	vars := mux.Vars(r)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Post Id: %v\n", vars["id"])
 	postid, err := strconv.Atoi(vars["id"])
 	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	post, err := env.blog.PostById(r.Context(), postid)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if len(post) == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if !env.requireAuthor(w, r, post[0].UserID) {
+		return
+	}
+	deleted, err := env.blog.DelPost(r.Context(), postid)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !deleted {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	env.blog.DelPost(postid)
+	env.auditChange(r, "post.delete", "post", vars["id"], post[0], nil)
+	json.NewEncoder(w).Encode(map[string]models.Post{"results": post[0]})
 }
 
 func (env *Env) GetComments(w http.ResponseWriter, r *http.Request) {
-	comments, err := env.blog.AllComments()
+	comments, err := env.blog.AllComments(r.Context())
 	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+		serverError(w, r, err)
 		return
 	}
 	json.NewEncoder(w).Encode(map[string][]models.Comment{"results": comments})
@@ -385,24 +656,68 @@ func (env *Env) InsertComment(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
-	env.blog.AddComment(c)
+	me, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if c.UserID, err = authorFor(r, me, c.UserID); err != nil {
+		editError(w, r, err)
+		return
+	}
+	id, err := env.blog.AddComment(r.Context(), c)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	env.auditChange(r, "comment.create", "comment", strconv.FormatInt(id, 10), nil, env.snapshot(r.Context(), "comment", int(id)))
 }
 
+// EditComment replaces a comment with the one in the request body, which must
+// have every field.
 func (env *Env) EditComment(w http.ResponseWriter, r *http.Request) {
-	// responseCode := env.HandleCheck(w, r)
-	// if responseCode != http.StatusOK {
-	// 	return
-	// }
-	vars := mux.Vars(r)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Post Id: %v\n", vars["id"])
-	postid, err := strconv.Atoi(vars["id"])
+	env.editComment(w, r, replaceWith(commentFields))
+}
+
+// PatchComment changes the fields of a comment given in the request body, a
+// JSON merge patch.
+func (env *Env) PatchComment(w http.ResponseWriter, r *http.Request) {
+	env.editComment(w, r, mergePatch)
+}
+
+func (env *Env) editComment(w http.ResponseWriter, r *http.Request, change changeFunc) {
+	id, body, ok := editRequest(w, r)
+	if !ok {
+		return
+	}
+	me, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	before := env.snapshot(r.Context(), "comment", id)
+	c, err := env.blog.UpdateComment(r.Context(), id, func(c *models.Comment) error {
+		if err := checkAuthor(r, me, c.UserID); err != nil {
+			return err
+		}
+		postID, author := c.PostID, c.UserID
+		if err := applyChange(change, body, c); err != nil {
+			return err
+		}
+		if err := keepAuthor(r, me, &c.UserID, author); err != nil {
+			return err
+		}
+		if err := unchanged("comment_id", c.CommentID, int64(id)); err != nil {
+			return err
+		}
+		return unchanged("post_id", c.PostID, postID)
+	})
 	if err != nil {
+		editError(w, r, err)
 		return
 	}
-	newcomment := models.Comment{}
-	json.NewDecoder(r.Body).Decode(&newcomment)
-	env.blog.PutComment(postid, newcomment)
+	env.auditChange(r, "comment.update", "comment", strconv.Itoa(id), before, c)
+	json.NewEncoder(w).Encode(map[string]models.Comment{"results": c})
 }
 
 func (env *Env) DeleteComment(w http.ResponseWriter, r *http.Request) {
@@ -411,62 +726,199 @@ func (env *Env) DeleteComment(w http.ResponseWriter, r *http.Request) {
 	// 	return
 	// }
 	vars := mux.Vars(r)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Comment Id: %v\n", vars["id"])
 	commentid, err := strconv.Atoi(vars["id"])
 	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	comment, err := env.blog.CommentByID(r.Context(), commentid)
+	if err == sql.ErrNoRows {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
 		return
 	}
-	env.blog.DelComment(commentid)
+	if !env.requireAuthor(w, r, comment.UserID) {
+		return
+	}
+	deleted, err := env.blog.DelComment(r.Context(), commentid)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !deleted {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	env.auditChange(r, "comment.delete", "comment", vars["id"], comment, nil)
+	json.NewEncoder(w).Encode(map[string]models.Comment{"results": comment})
+}
+
+// registerRequest is what the public /register endpoint accepts. It leaves
+// out is_superuser and is_guest so nobody can grant themselves privileges.
+type registerRequest struct {
+	Username  string `json:"username"`
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+}
+
+func (req registerRequest) user() models.User {
+	return models.User{
+		Username:  req.Username,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Email:     req.Email,
+		Password:  req.Password,
+	}
 }
 
 func (env *Env) Register(w http.ResponseWriter, r *http.Request) {
 	// Get User Details from JSON
-	var u models.User
-	err := json.NewDecoder(r.Body).Decode(&u)
+	var req registerRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPasswordBody)).Decode(&req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	userAdded, err := env.blog.Register(u)
-	fmt.Fprintf(w, "%t", userAdded)
-	fmt.Fprintf(w, "Added user %s with password %s", u.Username, u.Password)
+	errs := fieldErrors{}
+	if req.Username == "" {
+		errs.add("username", "is required")
+	}
+	if err := env.checkPassword(errs, req.Password, req.Username, req.Email); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	_, err = env.blog.Register(r.Context(), req.user())
 	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+		registerError(w, r, err)
 		return
 	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"results": req.Username})
+}
+
+// registerError answers a failed registration, with 409 Conflict when the
+// username or email is already in use.
+func registerError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, models.ErrDuplicateUsername) || errors.Is(err, models.ErrDuplicateEmail) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	serverError(w, r, err)
 }
 
 func (env *Env) Login(w http.ResponseWriter, r *http.Request) {
+	lc, user, ok := env.checkCredentials(w, r)
+	if !ok {
+		return
+	}
+	if env.requireSecondFactor(w, r, user, loginModeSession) {
+		return
+	}
+	// The session belongs to the canonical username, whatever was typed
+	lc.Username = user.Username
+	sessionToken, err := env.cache.CreateSession(r.Context(), w, lc)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"results": sessionToken})
+}
+
+// checkCredentials decodes login credentials from the request body and
+// verifies them, enforcing the failed login lockouts. On failure it writes the
+// response itself and returns false.
+func (env *Env) checkCredentials(w http.ResponseWriter, r *http.Request) (auth.LoginCredentials, models.User, bool) {
 	var lc auth.LoginCredentials
 	err := json.NewDecoder(r.Body).Decode(&lc)
 	if err != nil {
-		fmt.Println("lc")
-		fmt.Println(lc)
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		fmt.Fprintf(w, "Bad Request")
-		return
+		return lc, models.User{}, false
 	}
-	loginSuccessful, err := env.blog.Login(lc)
 
+	// Refuse locked out accounts and IPs before spending time on the hash
+	ip := env.clientIP(r)
+	key, err := env.lockoutKey(r.Context(), lc.Identifier())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Fprintf(w, "Internal Server Error")
-		return
+		serverError(w, r, err)
+		return lc, models.User{}, false
+	}
+	wait, err := env.cache.LoginLockedFor(r.Context(), key, ip)
+	if err != nil {
+		serverError(w, r, err)
+		return lc, models.User{}, false
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return lc, models.User{}, false
 	}
 
-	if loginSuccessful {
-		sessionToken := env.cache.CreateSession(w, lc)
-		json.NewEncoder(w).Encode(map[string]string{"results": sessionToken})
-	} else {
-		http.SetCookie(w, &http.Cookie{
-			Name:    "session_token",
-			Value:   "",
-			Expires: time.Now(),
-		})
-		fmt.Fprintf(w, "Invalid Credentials")
+	user, loginSuccessful, err := env.blog.Login(r.Context(), lc)
+	if err != nil {
+		serverError(w, r, err)
+		return lc, models.User{}, false
+	}
+
+	if !loginSuccessful {
+		env.cache.SetSessionCookie(w, "", time.Time{})
+		wait, err := env.cache.RecordLoginFailure(r.Context(), key, ip)
+		if err != nil {
+			log.Print(err)
+		}
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return lc, models.User{}, false
+		}
+		http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+		return lc, models.User{}, false
+	}
+	if err := env.cache.ClearLoginFailures(r.Context(), key); err != nil {
+		log.Print(err)
+	}
+	return lc, user, true
+}
+
+// lockoutKey returns the name failed logins for identifier are counted
+// under. It finds the account the way Login does, by username first and then
+// by email, so that every way of naming an account shares one set of
+// attempts. Identifiers without an account are counted as given.
+func (env *Env) lockoutKey(ctx context.Context, identifier string) (string, error) {
+	if identifier == "" {
+		return "name:", nil
 	}
+	u, err := env.blog.UserByUsername(ctx, identifier)
+	if err == models.ErrUserNotFound {
+		u, err = env.blog.UserByEmail(ctx, identifier)
+	}
+	if err == models.ErrUserNotFound {
+		return "name:" + identifier, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return accountLockoutKey(u), nil
+}
+
+// accountLockoutKey is the name the failed logins and second factor attempts
+// of an account are counted under. It is the user id, which stays the same
+// through renames, prefixed so no typed identifier can collide with it.
+func accountLockoutKey(u models.User) string {
+	return "id:" + strconv.FormatInt(u.UserID, 10)
+}
+
+// tooManyAttempts rejects a login that is locked out, telling the client how
+// many seconds to wait before trying again.
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 }
 
 func (env *Env) Refresh(w http.ResponseWriter, r *http.Request) {
@@ -474,9 +926,5 @@ func (env *Env) Refresh(w http.ResponseWriter, r *http.Request) {
 }
 
 func (env *Env) Logout(w http.ResponseWriter, r *http.Request) {
-	responseCode := env.HandleCheck(w, r)
-	if responseCode != http.StatusOK {
-		return
-	}
 	env.cache.RemoveSession(w, r)
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"techblogapi/models"
+	"testing"
+	"time"
+)
+
+func TestRegisterAndLogin(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "alice")
+
+	res := ts.request(t, "POST", "/register", "", map[string]string{
+		"username": "Alice",
+		"email":    "other@example.com",
+		"password": testPassword,
+	})
+	expectStatus(t, res, http.StatusConflict)
+
+	res = ts.request(t, "POST", "/register", "", map[string]string{
+		"username": "bob",
+		"email":    "bob@example.com",
+		"password": "short",
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+
+	// Long passwords are refused before they are scored, which would take ages
+	start := time.Now()
+	res = ts.request(t, "POST", "/register", "", map[string]string{
+		"username": "bob",
+		"email":    "bob@example.com",
+		"password": strings.Repeat("correct horse ", 500),
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("registering with a 7000 character password took %v", d)
+	}
+	res = ts.request(t, "POST", "/register", "", map[string]string{"username": "bob", "password": strings.Repeat("x", 100<<10)})
+	expectStatus(t, res, http.StatusBadRequest)
+
+	token := ts.login(t, "alice")
+	if token == "" {
+		t.Fatal("login returned no session token")
+	}
+	res = ts.request(t, "GET", "/me", token, nil)
+	expectStatus(t, res, http.StatusOK)
+	var me struct {
+		Results models.User `json:"results"`
+	}
+	decode(t, res, &me)
+	if me.Results.Username != "alice" || me.Results.Email != "alice@example.com" {
+		t.Errorf("GET /me = %+v, want alice", me.Results)
+	}
+
+	res = ts.request(t, "POST", "/login", "", map[string]string{"username": "alice", "password": "wrong password"})
+	expectStatus(t, res, http.StatusUnauthorized)
+}
+
+func TestLoginLockout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "alice")
+
+	bad := map[string]string{"username": "alice", "password": "wrong password"}
+	// Attempts by username and by email, in either field, count against the
+	// same account
+	byEmail := map[string]string{"email": "ALICE@example.com", "password": "wrong password"}
+	emailAsUsername := map[string]string{"username": "alice@example.com", "password": "wrong password"}
+	attempts := []map[string]string{bad, byEmail, emailAsUsername}
+	for i := 0; i < ts.sessions.Lockout.FreeAttempts; i++ {
+		expectStatus(t, ts.request(t, "POST", "/login", "", attempts[i%len(attempts)]), http.StatusUnauthorized)
+	}
+	expectStatus(t, ts.request(t, "POST", "/login", "", emailAsUsername), http.StatusTooManyRequests)
+	expectStatus(t, ts.request(t, "POST", "/login", "", byEmail), http.StatusTooManyRequests)
+	expectStatus(t, ts.request(t, "POST", "/login", "", bad), http.StatusTooManyRequests)
+	res := ts.request(t, "POST", "/login", "", map[string]string{"username": "alice@example.com", "password": testPassword})
+	expectStatus(t, res, http.StatusTooManyRequests)
+	// Locked out even with the right password
+	res = ts.request(t, "POST", "/login", "", map[string]string{"username": "alice", "password": testPassword})
+	expectStatus(t, res, http.StatusTooManyRequests)
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("lockout response has no Retry-After header")
+	}
+
+	admin := ts.superuser(t, "admin")
+	res = ts.request(t, "POST", "/admin/unlock", admin, map[string]string{"username": "alice@example.com"})
+	expectStatus(t, res, http.StatusOK)
+	ts.login(t, "alice")
+}
+
+func TestContentLifecycle(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+
+	expectStatus(t, ts.request(t, "POST", "/category", "", models.Category{CategoryName: "Go", Slug: "go"}), http.StatusUnauthorized)
+	expectStatus(t, ts.request(t, "POST", "/category", token, models.Category{CategoryName: "Go", Slug: "go"}), http.StatusOK)
+
+	res := ts.request(t, "GET", "/categories", "", nil)
+	expectStatus(t, res, http.StatusOK)
+	var categories struct {
+		Results []models.Category `json:"results"`
+	}
+	decode(t, res, &categories)
+	if len(categories.Results) != 1 || categories.Results[0].CategoryName != "Go" {
+		t.Fatalf("GET /categories = %+v, want one Go category", categories.Results)
+	}
+	catID := categories.Results[0].CategoryID
+
+	post := models.Post{
+		UserID:     ts.userID(t, "alice"),
+		CategoryID: catID,
+		Slug:       "hello-world",
+		Title:      "Hello, World",
+		Message:    "First post",
+		ReadTime:   1,
+		DateTime:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	expectStatus(t, ts.request(t, "POST", "/post", token, "not a post"), http.StatusBadRequest)
+	if all, _ := ts.blog.AllPosts(context.Background()); len(all) != 0 {
+		t.Fatalf("posts after a POST /post that isn't a post = %+v", all)
+	}
+	// Nobody but a superuser writes in someone else's name
+	forged := post
+	forged.UserID = ts.userID(t, "alice") + 100
+	expectStatus(t, ts.request(t, "POST", "/post", token, forged), http.StatusUnprocessableEntity)
+	expectStatus(t, ts.request(t, "POST", "/post", token, post), http.StatusOK)
+
+	res = ts.request(t, "GET", "/post/slug/hello-world", "", nil)
+	expectStatus(t, res, http.StatusOK)
+	var posts struct {
+		Results []models.Post `json:"results"`
+	}
+	decode(t, res, &posts)
+	if len(posts.Results) != 1 || posts.Results[0].Title != "Hello, World" {
+		t.Fatalf("GET /post/slug/hello-world = %+v", posts.Results)
+	}
+	postID := posts.Results[0].PostID
+	if a := posts.Results[0].Author; a == nil || a.Username != "alice" {
+		t.Errorf("post author = %+v, want alice", a)
+	}
+
+	res = ts.request(t, "GET", "/posts/category/slug/go", "", nil)
+	expectStatus(t, res, http.StatusOK)
+	decode(t, res, &posts)
+	if len(posts.Results) != 1 || posts.Results[0].PostID != postID {
+		t.Fatalf("GET /posts/category/slug/go = %+v", posts.Results)
+	}
+
+	post.Title = "Hello again"
+	expectStatus(t, ts.request(t, "PUT", "/post/"+strconv.FormatInt(postID, 10), token, post), http.StatusOK)
+	res = ts.request(t, "GET", "/post/id/"+strconv.FormatInt(postID, 10), "", nil)
+	expectStatus(t, res, http.StatusOK)
+	decode(t, res, &posts)
+	if len(posts.Results) != 1 || posts.Results[0].Title != "Hello again" {
+		t.Fatalf("post after PUT = %+v", posts.Results)
+	}
+
+	// Comments without a user_id are the caller's
+	comment := models.Comment{PostID: postID, Message: "Nice"}
+	expectStatus(t, ts.request(t, "POST", "/comment", token, comment), http.StatusOK)
+	res = ts.request(t, "GET", "/comments", "", nil)
+	expectStatus(t, res, http.StatusOK)
+	var comments struct {
+		Results []models.Comment `json:"results"`
+	}
+	decode(t, res, &comments)
+	if len(comments.Results) != 1 || comments.Results[0].Message != "Nice" || comments.Results[0].UserID != post.UserID {
+		t.Fatalf("GET /comments = %+v", comments.Results)
+	}
+
+	commentID := strconv.FormatInt(comments.Results[0].CommentID, 10)
+	expectStatus(t, ts.request(t, "DELETE", "/comment/"+commentID, token, nil), http.StatusOK)
+	expectStatus(t, ts.request(t, "DELETE", "/post/"+strconv.FormatInt(postID, 10), token, nil), http.StatusOK)
+	expectStatus(t, ts.request(t, "DELETE", "/category/"+strconv.FormatInt(catID, 10), token, nil), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "DELETE", "/category/"+strconv.FormatInt(catID, 10), ts.superuser(t, "admin"), nil), http.StatusOK)
+
+	res = ts.request(t, "GET", "/posts", "", nil)
+	expectStatus(t, res, http.StatusOK)
+	decode(t, res, &posts)
+	if len(posts.Results) != 0 {
+		t.Errorf("GET /posts after delete = %+v, want none", posts.Results)
+	}
+
+	entries, err := ts.blog.AuditEntries(context.Background(), models.AuditFilter{Actor: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for i := len(entries) - 1; i >= 0; i-- {
+		actions = append(actions, entries[i].Action)
+	}
+	want := []string{
+		"category.create", "post.create", "post.update", "comment.create",
+		"comment.delete", "post.delete",
+	}
+	if b, w := mustJSON(t, actions), mustJSON(t, want); b != w {
+		t.Errorf("audit actions = %s, want %s", b, w)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
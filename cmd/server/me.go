@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"techblogapi/auth"
+	"techblogapi/models"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// accountUser loads the current user for the /me endpoints that change the
+// account, which API keys may not use.
+func (env *Env) accountUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	if p, _ := auth.PrincipalFrom(r.Context()); p.Method == auth.MethodAPIKey {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return models.User{}, false
+	}
+	u, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return models.User{}, false
+	}
+	return u, true
+}
+
+// GetMe returns the account and the public author profile of the current
+// user.
+func (env *Env) GetMe(w http.ResponseWriter, r *http.Request) {
+	u, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	profile, err := env.blog.AuthorByUserID(r.Context(), u.UserID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": u, "profile": profile})
+}
+
+// maxBioLength is the longest author bio accepted, in characters.
+const maxBioLength = 2000
+
+// updateMeRequest holds the profile fields to change; absent fields are kept.
+// An avatar_image_id of 0 removes the avatar, and an empty social link or
+// website removes it.
+type updateMeRequest struct {
+	FirstName     *string           `json:"firstname"`
+	LastName      *string           `json:"lastname"`
+	Email         *string           `json:"email"`
+	Bio           *string           `json:"bio"`
+	AvatarImageID *int64            `json:"avatar_image_id"`
+	Website       *string           `json:"website"`
+	SocialLinks   map[string]string `json:"social_links"`
+}
+
+func (req updateMeRequest) changesProfile() bool {
+	return req.Bio != nil || req.AvatarImageID != nil || req.Website != nil || req.SocialLinks != nil
+}
+
+// validate adds what is wrong with the request to errs.
+func (env *Env) validate(ctx context.Context, req updateMeRequest, errs fieldErrors) error {
+	if req.Email != nil && !strings.Contains(*req.Email, "@") {
+		errs.add("email", "must be a valid email address")
+	}
+	if req.Bio != nil && utf8.RuneCountInString(*req.Bio) > maxBioLength {
+		errs.add("bio", fmt.Sprintf("must be at most %d characters", maxBioLength))
+	}
+	if req.Website != nil && *req.Website != "" && !isWebURL(*req.Website) {
+		errs.add("website", "must be an http or https URL")
+	}
+	for network, link := range req.SocialLinks {
+		field := "social_links." + network
+		if !models.ValidSocialNetwork(network) {
+			errs.add(field, "must be one of "+strings.Join(models.SocialNetworks, ", "))
+		} else if link != "" && !isWebURL(link) {
+			errs.add(field, "must be an http or https URL")
+		}
+	}
+	if req.AvatarImageID != nil && *req.AvatarImageID != 0 {
+		exists, err := env.blog.ImageExists(ctx, *req.AvatarImageID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			errs.add("avatar_image_id", "no such image")
+		}
+	}
+	return nil
+}
+
+func isWebURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// UpdateMe changes the name and author profile of the current user. A new
+// email address only takes effect once the link sent to it is opened.
+func (env *Env) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	u, ok := env.accountUser(w, r)
+	if !ok {
+		return
+	}
+	var req updateMeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Email != nil {
+		*req.Email = strings.TrimSpace(*req.Email)
+	}
+	errs := fieldErrors{}
+	if err := env.validate(r.Context(), req, errs); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	before, err := env.blog.AuthorByUserID(r.Context(), u.UserID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if req.FirstName != nil || req.LastName != nil {
+		if req.FirstName != nil {
+			u.FirstName = *req.FirstName
+		}
+		if req.LastName != nil {
+			u.LastName = *req.LastName
+		}
+		if err := env.blog.UpdateName(r.Context(), u.UserID, u.FirstName, u.LastName); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+
+	if req.changesProfile() {
+		if err := env.updateAuthorProfile(r.Context(), u.UserID, req); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	profile, err := env.blog.AuthorByUserID(r.Context(), u.UserID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	env.auditChange(r, "user.update", "user", u.Username, before, profile)
+
+	response := map[string]interface{}{"results": u, "profile": profile}
+	if req.Email != nil && !strings.EqualFold(*req.Email, u.Email) {
+		if err := env.requestEmailChange(r.Context(), u, *req.Email); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		response["pending_email"] = *req.Email
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// updateAuthorProfile merges the profile fields of req into the stored
+// profile.
+func (env *Env) updateAuthorProfile(ctx context.Context, userID int64, req updateMeRequest) error {
+	current, err := env.blog.AuthorByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	p := models.AuthorProfile{
+		Bio:           current.Bio,
+		AvatarImageID: current.AvatarImageID,
+		Website:       current.Website,
+		SocialLinks:   current.SocialLinks,
+	}
+	if req.Bio != nil {
+		p.Bio = *req.Bio
+	}
+	if req.AvatarImageID != nil {
+		p.AvatarImageID = req.AvatarImageID
+		if *req.AvatarImageID == 0 {
+			p.AvatarImageID = nil
+		}
+	}
+	if req.Website != nil {
+		p.Website = *req.Website
+	}
+	for network, link := range req.SocialLinks {
+		if link == "" {
+			delete(p.SocialLinks, network)
+		} else {
+			p.SocialLinks[network] = link
+		}
+	}
+	return env.blog.UpdateAuthorProfile(ctx, userID, p)
+}
+
+// requestEmailChange sends a confirmation link to the new address, and lets
+// the old address know about the change.
+func (env *Env) requestEmailChange(ctx context.Context, u models.User, email string) error {
+	token, err := env.cache.IssueEmailChange(ctx, auth.EmailChange{UserID: u.UserID, Email: email})
+	if err != nil {
+		return err
+	}
+	link := env.emailVerifyURL + "?" + url.Values{"token": {token}}.Encode()
+	go func() {
+		body := fmt.Sprintf("Hi %s,\n\nOpen this link to use this address for your account. It expires in %s.\n\n%s\n\nIf you didn't ask for it, you can ignore this email.\n",
+			u.Username, auth.EmailChangeTTL, link)
+		if err := env.mailer.Send(email, "Confirm your new email address", body); err != nil {
+			log.Print(err)
+		}
+		if u.Email == "" {
+			return
+		}
+		body = fmt.Sprintf("Hi %s,\n\nSomeone asked to change the email address of your account to %s. If this wasn't you, change your password.\n",
+			u.Username, email)
+		if err := env.mailer.Send(u.Email, "Your email address is being changed", body); err != nil {
+			log.Print(err)
+		}
+	}()
+	return nil
+}
+
+// VerifyEmail confirms an email change with the token from the emailed link.
+func (env *Env) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	c, err := env.cache.RedeemEmailChange(r.Context(), r.URL.Query().Get("token"))
+	if err != nil {
+		if err != auth.ErrInvalidToken {
+			log.Print(err)
+		}
+		http.Error(w, "This link is invalid or has expired", http.StatusUnauthorized)
+		return
+	}
+	err = env.blog.SetEmail(r.Context(), c.UserID, c.Email)
+	if err == models.ErrDuplicateEmail {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// The link works without signing in, so the account is the actor
+	if author, err := env.blog.AuthorByUserID(r.Context(), c.UserID); err == nil {
+		env.audit(r, author.Username, "user.verify_email", "user", author.Username, nil)
+	} else {
+		log.Print(err)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"results": c.Email})
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword sets a new password after checking the current one, and
+// signs the user out everywhere else. Accounts without a password, created
+// through an identity provider, can set one without a current password.
+func (env *Env) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	u, ok := env.accountUser(w, r)
+	if !ok {
+		return
+	}
+	var req changePasswordRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPasswordBody)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Guesses count towards the login lockout, so a stolen session can't be
+	// used to guess the password
+	wait, err := env.cache.LoginLockedFor(r.Context(), accountLockoutKey(u), env.clientIP(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+	valid, err := env.blog.CheckPassword(r.Context(), u.UserID, req.CurrentPassword)
+	if err == models.ErrNoPassword {
+		valid, err = true, nil
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	errs := fieldErrors{}
+	if !valid {
+		wait, err := env.cache.RecordLoginFailure(r.Context(), accountLockoutKey(u), env.clientIP(r))
+		if err != nil {
+			log.Print(err)
+		}
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+		errs.add("current_password", "is incorrect")
+	}
+	if err := env.checkPassword(errs, req.NewPassword, u.Username, u.Email); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if err := env.blog.SetPassword(r.Context(), u.Username, req.NewPassword); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if _, err := env.cache.RevokeUserSessions(r.Context(), u.Username, env.sessionToken(r)); err != nil {
+		log.Print(err)
+	}
+	if err := env.cache.RevokeUserRefreshTokens(r.Context(), u.Username); err != nil {
+		log.Print(err)
+	}
+	env.audit(r, u.Username, "user.change_password", "user", u.Username, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionToken returns the session token r was authenticated with, or "" for
+// other kinds of credentials.
+func (env *Env) sessionToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := strings.TrimPrefix(h, "Bearer ")
+		if auth.IsAPIKey(token) || auth.LooksLikeJWT(token) {
+			return ""
+		}
+		return token
+	}
+	token, _ := env.cache.SessionCookie(r)
+	return token
+}
+
+// GetUser returns the public profile of a user.
+func (env *Env) GetUser(w http.ResponseWriter, r *http.Request) {
+	u, err := env.blog.UserByUsername(r.Context(), mux.Vars(r)["username"])
+	if err == models.ErrUserNotFound || (err == nil && u.Disabled) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]models.PublicUser{"results": u.Public()})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"techblogapi/auth"
+	"techblogapi/config"
+	"techblogapi/models"
+)
+
+// authenticate identifies the caller of r. A bearer token in the
+// Authorization header is either a JWT access token or a session token; without
+// one the session cookie is used.
+func (env *Env) authenticate(r *http.Request) (auth.Principal, error) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := strings.TrimPrefix(h, "Bearer ")
+		if auth.IsAPIKey(token) {
+			return env.authenticateAPIKey(r.Context(), token)
+		}
+		if auth.LooksLikeJWT(token) {
+			if !env.tokens.Enabled() {
+				return auth.Principal{}, auth.ErrInvalidToken
+			}
+			claims, err := env.tokens.ParseAccessToken(token)
+			if err != nil {
+				return auth.Principal{}, err
+			}
+			return auth.Principal{Username: claims.Subject, Method: auth.MethodJWT}, nil
+		}
+		session, err := env.cache.LookupSession(r.Context(), token)
+		if err != nil {
+			return auth.Principal{}, err
+		}
+		return auth.Principal{Username: session.Username, Method: auth.MethodSession}, nil
+	}
+	cookie, err := env.cache.SessionCookie(r)
+	if err != nil {
+		return auth.Principal{}, auth.ErrNoSession
+	}
+	session, err := env.cache.LookupSession(r.Context(), cookie)
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	return auth.Principal{Username: session.Username, Method: auth.MethodCookie}, nil
+}
+
+func (env *Env) authenticateAPIKey(ctx context.Context, token string) (auth.Principal, error) {
+	key, user, err := env.blog.APIKeyByHash(ctx, auth.HashAPIKey(token))
+	if err == models.ErrAPIKeyNotFound {
+		return auth.Principal{}, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	if key.Expired() || user.Disabled {
+		return auth.Principal{}, auth.ErrInvalidToken
+	}
+	if err := env.blog.TouchAPIKey(ctx, key.ID); err != nil {
+		log.Print(err)
+	}
+	return auth.Principal{Username: user.Username, Method: auth.MethodAPIKey, Scopes: key.Scopes}, nil
+}
+
+// requireAuth only lets authenticated requests through to next, with the
+// principal stored in the request context.
+func (env *Env) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := env.authenticate(r)
+		if err != nil && (models.IsTimeout(err) || r.Context().Err() != nil) {
+			serverError(w, r, err)
+			return
+		}
+		if err != nil {
+			if err != auth.ErrNoSession && err != auth.ErrInvalidToken {
+				log.Print(err)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(auth.WithPrincipal(r.Context(), p)))
+	}
+}
+
+// requireScope is requireAuth for routes that API keys may only use when they
+// were granted scope.
+func (env *Env) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return env.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := auth.PrincipalFrom(r.Context())
+		if !p.HasScope(scope) {
+			http.Error(w, "API key is missing the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// csrfProtect requires the session's CSRF token in the X-CSRF-Token header on
+// state-changing requests that carry a valid session cookie. Requests with a
+// bearer token are exempt: browsers never attach those on their own, and
+// authenticate ignores the cookie when one is present.
+func (env *Env) csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := env.cache.SessionCookie(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		session, err := env.cache.LookupSession(r.Context(), cookie)
+		if err == auth.ErrNoSession {
+			// A stale cookie doesn't authenticate anything
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if !session.ValidCSRFToken(r.Header.Get(auth.CSRFHeader)) {
+			http.Error(w, "missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetCSRFToken returns the CSRF token of the session cookie, for single page
+// apps to send back in the X-CSRF-Token header.
+func (env *Env) GetCSRFToken(w http.ResponseWriter, r *http.Request) {
+	cookie, err := env.cache.SessionCookie(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	token, err := env.cache.CSRFToken(r.Context(), cookie)
+	if err == auth.ErrNoSession {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"results": token})
+}
+
+// securityHeaders sets the configured security headers on every response.
+func securityHeaders(h config.SecurityHeaders) func(http.Handler) http.Handler {
+	csp := h.ContentSecurityPolicy
+	if h.FrameAncestors != "" && !strings.Contains(csp, "frame-ancestors") {
+		if csp != "" {
+			csp += "; "
+		}
+		csp += "frame-ancestors " + h.FrameAncestors
+	}
+	var hsts string
+	if h.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(h.HSTSMaxAge.Seconds()))
+		if h.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+	var frameOptions string
+	switch h.FrameAncestors {
+	case "'none'":
+		frameOptions = "DENY"
+	case "'self'":
+		frameOptions = "SAMEORIGIN"
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := w.Header()
+			if csp != "" {
+				header.Set("Content-Security-Policy", csp)
+			}
+			if hsts != "" {
+				header.Set("Strict-Transport-Security", hsts)
+			}
+			if frameOptions != "" {
+				header.Set("X-Frame-Options", frameOptions)
+			}
+			if h.ReferrerPolicy != "" {
+				header.Set("Referrer-Policy", h.ReferrerPolicy)
+			}
+			header.Set("X-Content-Type-Options", "nosniff")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
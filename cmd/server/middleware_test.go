@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"techblogapi/models"
+	"testing"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "alice")
+	browser := cookieClient(t)
+
+	res := ts.send(t, browser, "POST", "/login", "", map[string]string{"username": "alice", "password": testPassword}, nil)
+	expectStatus(t, res, http.StatusOK)
+
+	category := models.Category{CategoryName: "Go", Slug: "go"}
+	res = ts.send(t, browser, "POST", "/category", "", category, nil)
+	expectStatus(t, res, http.StatusForbidden)
+
+	res = ts.send(t, browser, "GET", "/csrf", "", nil, nil)
+	expectStatus(t, res, http.StatusOK)
+	var csrf struct {
+		Results string `json:"results"`
+	}
+	decode(t, res, &csrf)
+	header := http.Header{"X-Csrf-Token": {csrf.Results}}
+	expectStatus(t, ts.send(t, browser, "POST", "/category", "", category, header), http.StatusOK)
+
+	expectStatus(t, ts.send(t, browser, "POST", "/logout", "", nil, header), http.StatusOK)
+	expectStatus(t, ts.send(t, browser, "GET", "/me", "", nil, nil), http.StatusUnauthorized)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+
+	res := ts.request(t, "POST", "/apikeys", token, map[string]interface{}{
+		"name":   "deploy",
+		"scopes": []string{"posts:read", "categories:write"},
+	})
+	expectStatus(t, res, http.StatusCreated)
+	var created struct {
+		Key string `json:"key"`
+	}
+	decode(t, res, &created)
+
+	category := models.Category{CategoryName: "Go", Slug: "go"}
+	expectStatus(t, ts.request(t, "POST", "/category", created.Key, category), http.StatusOK)
+	comment := models.Comment{UserID: ts.userID(t, "alice"), PostID: 1, Message: "Nice"}
+	expectStatus(t, ts.request(t, "POST", "/comment", created.Key, comment), http.StatusForbidden)
+
+	res = ts.request(t, "GET", "/apikeys", token, nil)
+	expectStatus(t, res, http.StatusOK)
+	var keys struct {
+		Results []models.APIKey `json:"results"`
+	}
+	decode(t, res, &keys)
+	if len(keys.Results) != 1 {
+		t.Fatalf("GET /apikeys = %+v, want one key", keys.Results)
+	}
+	id := keys.Results[0].ID
+	expectStatus(t, ts.request(t, "DELETE", "/apikeys/"+strconv.FormatInt(id, 10), token, nil), http.StatusNoContent)
+	expectStatus(t, ts.request(t, "POST", "/category", created.Key, category), http.StatusUnauthorized)
+}
+
+func TestSecurityHeadersAndRequestID(t *testing.T) {
+	ts := newTestServer(t)
+
+	res := ts.request(t, "GET", "/categories", "", nil)
+	expectStatus(t, res, http.StatusOK)
+	if got := res.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+	}
+	if got := res.Header.Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options = %q, want DENY", got)
+	}
+	if got := res.Header.Get("Content-Security-Policy"); !strings.Contains(got, "frame-ancestors 'none'") {
+		t.Errorf("Content-Security-Policy = %q, want frame-ancestors 'none'", got)
+	}
+	if res.Header.Get(RequestIDHeader) == "" {
+		t.Errorf("response has no %s header", RequestIDHeader)
+	}
+
+	res = ts.send(t, http.DefaultClient, "GET", "/categories", "", nil, http.Header{RequestIDHeader: {"req-123"}})
+	if got := res.Header.Get(RequestIDHeader); got != "req-123" {
+		t.Errorf("%s = %q, want the incoming req-123", RequestIDHeader, got)
+	}
+	res = ts.send(t, http.DefaultClient, "GET", "/categories", "", nil, http.Header{RequestIDHeader: {"bad id!"}})
+	if got := res.Header.Get(RequestIDHeader); got == "" || got == "bad id!" {
+		t.Errorf("%s = %q, want a fresh id", RequestIDHeader, got)
+	}
+}
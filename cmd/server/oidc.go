@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"techblogapi/auth"
+	"techblogapi/models"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// oidcStateTTL is how long a user has to finish signing in at the provider.
+const oidcStateTTL = 10 * time.Minute
+
+// OIDCLogin starts the authorization code flow with PKCE by redirecting to the
+// identity provider.
+func (env *Env) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := env.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	target, ok := env.startOIDC(w, r, provider, "")
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// LinkIdentity starts linking an account at an identity provider to the
+// current user. It returns the URL to send the browser to, and the callback
+// links the account once the user signed in there.
+func (env *Env) LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	u, ok := env.accountUser(w, r)
+	if !ok {
+		return
+	}
+	provider, ok := env.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	target, ok := env.startOIDC(w, r, provider, u.Username)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"results": target})
+}
+
+// startOIDC saves the state of a new sign in with provider, on behalf of
+// linkUsername if it links the provider account, ties it to the browser with
+// the state cookie and returns the authorization URL.
+func (env *Env) startOIDC(w http.ResponseWriter, r *http.Request, provider *auth.OIDCProvider, linkUsername string) (string, bool) {
+	var secrets [3]string
+	for i := range secrets {
+		s, err := auth.RandomToken()
+		if err != nil {
+			serverError(w, r, err)
+			return "", false
+		}
+		secrets[i] = s
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+	err := env.cache.SaveOIDCState(r.Context(), state, auth.OIDCState{Provider: provider.Name, Nonce: nonce, Verifier: verifier, LinkUsername: linkUsername}, oidcStateTTL)
+	if err != nil {
+		serverError(w, r, err)
+		return "", false
+	}
+	target, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return "", false
+	}
+	auth.SetOIDCStateCookie(w, state, oidcStateTTL)
+	return target, true
+}
+
+// OIDCCallback finishes signing in with an identity provider and creates a
+// session just like a password login.
+func (env *Env) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := env.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	// The state cookie is good for one callback, whatever comes of it
+	auth.SetOIDCStateCookie(w, "", 0)
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "sign in failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	// A state this browser didn't start is someone else's sign in
+	if !auth.OIDCStateCookieMatches(r, q.Get("state")) {
+		http.Error(w, "invalid or expired sign in attempt", http.StatusBadRequest)
+		return
+	}
+	state, err := env.cache.TakeOIDCState(r.Context(), q.Get("state"))
+	if err != nil || state.Provider != provider.Name {
+		if err != nil && err != auth.ErrInvalidToken {
+			log.Print(err)
+		}
+		http.Error(w, "invalid or expired sign in attempt", http.StatusBadRequest)
+		return
+	}
+	claims, err := provider.Exchange(r.Context(), q.Get("code"), state.Verifier, state.Nonce)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "sign in failed", http.StatusUnauthorized)
+		return
+	}
+	if state.LinkUsername != "" {
+		env.finishLink(w, r, provider.Name, state.LinkUsername, claims)
+		return
+	}
+
+	u, err := env.userForIdentity(r.Context(), provider.Name, claims)
+	if errors.Is(err, models.ErrDuplicateEmail) {
+		http.Error(w, "an account with this email already exists, sign in to it and link the provider from there", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if u.Disabled {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if env.requireSecondFactor(w, r, u, loginModeOIDC) {
+		return
+	}
+	env.finishLogin(w, r, u, loginModeOIDC, nil)
+}
+
+// finishLink links the provider account of claims to the user who started
+// linking it, unless it already belongs to someone else, and sends the
+// browser back like a sign in.
+func (env *Env) finishLink(w http.ResponseWriter, r *http.Request, provider, username string, claims auth.IDTokenClaims) {
+	u, err := env.blog.UserByUsername(r.Context(), username)
+	if err == models.ErrUserNotFound {
+		http.Error(w, "invalid or expired sign in attempt", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	linked, err := env.blog.UserByIdentity(r.Context(), provider, claims.Subject)
+	switch {
+	case err == models.ErrUserNotFound:
+		identity := models.ExternalIdentity{Provider: provider, Subject: claims.Subject, Email: claims.Email}
+		if err := env.blog.LinkIdentity(r.Context(), u.UserID, identity); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		env.audit(r, u.Username, "identity.link", "user", u.Username, map[string]string{"provider": provider, "subject": claims.Subject})
+	case err != nil:
+		serverError(w, r, err)
+		return
+	case linked.UserID != u.UserID:
+		http.Error(w, "this "+provider+" account is linked to another user", http.StatusConflict)
+		return
+	}
+	http.Redirect(w, r, env.oidcSuccessRedirect, http.StatusFound)
+}
+
+// userForIdentity finds the user for a verified ID token. Known identities map
+// to their user; otherwise a user with the same email, verified on both
+// sides, is linked, or a new passwordless user is created.
+func (env *Env) userForIdentity(ctx context.Context, provider string, claims auth.IDTokenClaims) (models.User, error) {
+	identity := models.ExternalIdentity{Provider: provider, Subject: claims.Subject, Email: claims.Email}
+	u, err := env.blog.UserByIdentity(ctx, provider, claims.Subject)
+	if err != models.ErrUserNotFound {
+		return u, err
+	}
+
+	if claims.Email != "" {
+		u, err := env.blog.UserByEmail(ctx, claims.Email)
+		switch {
+		case err == nil && bool(claims.EmailVerified) && u.EmailVerified:
+			return u, env.blog.LinkIdentity(ctx, u.UserID, identity)
+		case err == nil:
+			// An unverified email proves nothing about owning the account,
+			// on either side. Someone may have registered the address with
+			// a password of their own to take over whoever signs in with
+			// the provider later, so the owner has to sign in and link it.
+			return models.User{}, models.ErrDuplicateEmail
+		case err != models.ErrUserNotFound:
+			return models.User{}, err
+		}
+	}
+
+	u = models.User{
+		Username:  usernameFromClaims(claims),
+		FirstName: claims.GivenName,
+		LastName:  claims.FamilyName,
+	}
+	if claims.EmailVerified {
+		u.Email = claims.Email
+	}
+	return env.blog.CreateExternalUser(ctx, u, identity)
+}
+
+func usernameFromClaims(claims auth.IDTokenClaims) string {
+	for _, candidate := range []string{claims.PreferredUsername, strings.Split(claims.Email, "@")[0]} {
+		if name := models.Slugify(candidate); name != "" {
+			return name
+		}
+	}
+	return "user"
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"techblogapi/auth"
+	"testing"
+	"time"
+)
+
+// mockIssuer is an OpenID provider that signs in whoever the test says,
+// checking PKCE at its token endpoint like a real one.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// user is who signs in at the next authorization request
+	user map[string]interface{}
+	// nonce, if set, replaces the nonce of the next ID token
+	nonce string
+	codes map[string]mockGrant
+}
+
+// mockGrant is what an authorization code was issued for.
+type mockGrant struct {
+	claims    map[string]interface{}
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", m.handleAuthorize)
+	mux.HandleFunc("/token", m.handleToken)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// signInAs makes the next authorization request sign in subject.
+func (m *mockIssuer) signInAs(subject, email string, verified bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user = map[string]interface{}{"sub": subject, "email": email, "email_verified": verified}
+}
+
+func (m *mockIssuer) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE is required", http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	claims := map[string]interface{}{
+		"iss":   m.URL,
+		"aud":   q.Get("client_id"),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": q.Get("nonce"),
+	}
+	for k, v := range m.user {
+		claims[k] = v
+	}
+	if m.nonce != "" {
+		claims["nonce"] = m.nonce
+	}
+	code := strings.Repeat("c", len(m.codes)+1)
+	m.codes[code] = mockGrant{claims: claims, challenge: q.Get("code_challenge")}
+	m.mu.Unlock()
+	callback := q.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, callback, http.StatusFound)
+}
+
+func (m *mockIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	grant, ok := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	m.mu.Unlock()
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "mock", "typ": "JWT"})
+	claims, _ := json.Marshal(grant.claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": signed + "." + base64.RawURLEncoding.EncodeToString(sig)})
+}
+
+// withMockProvider adds the mock issuer as provider "mock".
+func (ts *testServer) withMockProvider(t *testing.T) *mockIssuer {
+	t.Helper()
+	m := newMockIssuer(t)
+	ts.env.providers["mock"] = &auth.OIDCProvider{
+		Name:         "mock",
+		Issuer:       m.URL,
+		ClientID:     "techblogapi",
+		ClientSecret: "client secret",
+		RedirectURL:  ts.URL + "/login/mock/callback",
+	}
+	return m
+}
+
+// oidcAttempt is a sign in started at the blog, up to the provider's
+// redirect back to the callback.
+type oidcAttempt struct {
+	callback string
+	// cookie is the state cookie of the browser that started it
+	cookie *http.Cookie
+}
+
+// authorize has the mock provider answer the authorization request start
+// redirected or linked to.
+func (m *mockIssuer) authorize(t *testing.T, target string, cookies []*http.Cookie) oidcAttempt {
+	t.Helper()
+	var attempt oidcAttempt
+	for _, c := range cookies {
+		if c.Name == auth.OIDCStateCookieName {
+			attempt.cookie = c
+		}
+	}
+	if attempt.cookie == nil || !attempt.cookie.Secure || attempt.cookie.Path != "/" || attempt.cookie.MaxAge <= 0 {
+		t.Fatalf("state cookie = %+v, want a Secure one for Path=/ that expires", attempt.cookie)
+	}
+	res, err := cookieClient(t).Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("GET %s: got status %d, want a redirect", target, res.StatusCode)
+	}
+	attempt.callback = res.Header.Get("Location")
+	return attempt
+}
+
+// startSignIn starts signing in with the mock provider.
+func (ts *testServer) startSignIn(t *testing.T, m *mockIssuer) oidcAttempt {
+	t.Helper()
+	res := ts.send(t, cookieClient(t), "GET", "/login/mock", "", nil, nil)
+	expectStatus(t, res, http.StatusFound)
+	return m.authorize(t, res.Header.Get("Location"), res.Cookies())
+}
+
+// finish opens the callback in a browser with the given state cookie.
+func (a oidcAttempt) finish(t *testing.T, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("GET", a.callback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	res, err := cookieClient(t).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// sessionUser returns who the session a callback handed out belongs to.
+func (ts *testServer) sessionUser(t *testing.T, res *http.Response) string {
+	t.Helper()
+	expectStatus(t, res, http.StatusFound)
+	if got := res.Header.Get("Location"); got != ts.env.oidcSuccessRedirect {
+		t.Fatalf("callback redirected to %q, want %q", got, ts.env.oidcSuccessRedirect)
+	}
+	for _, c := range res.Cookies() {
+		if c.Name == auth.SessionCookieName && c.Value != "" {
+			me := ts.request(t, "GET", "/me", c.Value, nil)
+			expectStatus(t, me, http.StatusOK)
+			var body struct {
+				Results struct {
+					Username string `json:"username"`
+				} `json:"results"`
+			}
+			decode(t, me, &body)
+			return body.Results.Username
+		}
+	}
+	t.Fatal("callback set no session cookie")
+	return ""
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	ts := newTestServer(t)
+	m := ts.withMockProvider(t)
+
+	m.signInAs("carol-sub", "carol@example.com", true)
+	attempt := ts.startSignIn(t, m)
+	if got := ts.sessionUser(t, attempt.finish(t, attempt.cookie)); got != "carol" {
+		t.Errorf("signed in as %q, want a new user carol", got)
+	}
+	if u, err := ts.blog.UserByEmail(context.Background(), "carol@example.com"); err != nil || !u.EmailVerified {
+		t.Errorf("user made for a verified email = %+v, %v, want it verified", u, err)
+	}
+	// Every callback clears the state cookie
+	var cleared bool
+	for _, c := range attempt.finish(t, attempt.cookie).Cookies() {
+		cleared = cleared || c.Name == auth.OIDCStateCookieName && c.MaxAge < 0
+	}
+	if !cleared {
+		t.Error("callback doesn't clear the state cookie")
+	}
+
+	// The state can't be used twice
+	expectStatus(t, attempt.finish(t, attempt.cookie), http.StatusBadRequest)
+
+	// A callback for a sign in another browser started, say the attacker's
+	// own, is refused with another state cookie or none
+	attacker := ts.startSignIn(t, m)
+	victim := ts.startSignIn(t, m)
+	expectStatus(t, attacker.finish(t, nil), http.StatusBadRequest)
+	expectStatus(t, attacker.finish(t, victim.cookie), http.StatusBadRequest)
+	if got := ts.sessionUser(t, attacker.finish(t, attacker.cookie)); got != "carol" {
+		t.Errorf("signed in as %q after the refused callbacks, want carol", got)
+	}
+
+	// An ID token for another sign in's nonce is refused
+	m.mu.Lock()
+	m.nonce = "someone else's nonce"
+	m.mu.Unlock()
+	attempt = ts.startSignIn(t, m)
+	expectStatus(t, attempt.finish(t, attempt.cookie), http.StatusUnauthorized)
+	m.mu.Lock()
+	m.nonce = ""
+	m.mu.Unlock()
+
+	// The provider only hands out tokens for the PKCE verifier the sign in
+	// started with
+	attempt = ts.startSignIn(t, m)
+	m.mu.Lock()
+	for code, grant := range m.codes {
+		grant.challenge = "not the challenge"
+		m.codes[code] = grant
+	}
+	m.mu.Unlock()
+	expectStatus(t, attempt.finish(t, attempt.cookie), http.StatusUnauthorized)
+}
+
+func TestOIDCLinking(t *testing.T) {
+	ts := newTestServer(t)
+	m := ts.withMockProvider(t)
+	ctx := context.Background()
+
+	// Someone registered alice's address with a password of their own, so
+	// signing in with her provider account mustn't end up in it
+	expectStatus(t, ts.request(t, "POST", "/register", "", map[string]string{
+		"username": "placeholder", "email": "alice@example.com", "password": testPassword,
+	}), http.StatusCreated)
+	m.signInAs("alice-sub", "alice@example.com", true)
+	attempt := ts.startSignIn(t, m)
+	expectStatus(t, attempt.finish(t, attempt.cookie), http.StatusConflict)
+	if _, err := ts.blog.UserByIdentity(ctx, "mock", "alice-sub"); err == nil {
+		t.Error("provider account was linked to an account with an unverified email")
+	}
+
+	// The owner of the account links it after signing in
+	token := ts.login(t, "placeholder")
+	expectStatus(t, ts.request(t, "POST", "/me/identities/nope", token, nil), http.StatusNotFound)
+	res := ts.request(t, "POST", "/me/identities/mock", token, nil)
+	expectStatus(t, res, http.StatusOK)
+	var link struct {
+		Results string `json:"results"`
+	}
+	decode(t, res, &link)
+	attempt = m.authorize(t, link.Results, res.Cookies())
+	res = attempt.finish(t, attempt.cookie)
+	expectStatus(t, res, http.StatusFound)
+	if u, err := ts.blog.UserByIdentity(ctx, "mock", "alice-sub"); err != nil || u.Username != "placeholder" {
+		t.Errorf("user linked to the provider account = %+v, %v", u, err)
+	}
+	attempt = ts.startSignIn(t, m)
+	if got := ts.sessionUser(t, attempt.finish(t, attempt.cookie)); got != "placeholder" {
+		t.Errorf("signed in as %q after linking, want placeholder", got)
+	}
+
+	// A provider account linked to one user can't be linked to another
+	bob := ts.user(t, "bob")
+	res = ts.request(t, "POST", "/me/identities/mock", bob, nil)
+	expectStatus(t, res, http.StatusOK)
+	decode(t, res, &link)
+	attempt = m.authorize(t, link.Results, res.Cookies())
+	expectStatus(t, attempt.finish(t, attempt.cookie), http.StatusConflict)
+
+	// Verified on both sides, the address is enough to link
+	if err := ts.blog.SetEmail(ctx, ts.userID(t, "bob"), "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	m.signInAs("bob-sub", "bob@example.com", true)
+	attempt = ts.startSignIn(t, m)
+	if got := ts.sessionUser(t, attempt.finish(t, attempt.cookie)); got != "bob" {
+		t.Errorf("signed in as %q, want bob, whose email is verified", got)
+	}
+	// but not when the provider didn't verify it
+	m.signInAs("other-sub", "bob@example.com", false)
+	attempt = ts.startSignIn(t, m)
+	expectStatus(t, attempt.finish(t, attempt.cookie), http.StatusConflict)
+}
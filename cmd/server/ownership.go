@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"techblogapi/auth"
+	"techblogapi/models"
+)
+
+// errNotAuthor fails a change to a post or comment the caller didn't write,
+// answered with 403 Forbidden.
+var errNotAuthor = errors.New("only the author or a superuser can change this")
+
+// actsForAnyone reports whether me, the caller of r, may write content in
+// other users' names and change or delete anyone's. Only superusers can, and
+// not through an API key, which the admin endpoints refuse as well.
+func actsForAnyone(r *http.Request, me models.User) bool {
+	p, _ := auth.PrincipalFrom(r.Context())
+	return me.IsSuperuser && p.Method != auth.MethodAPIKey
+}
+
+// authorFor returns the user new content of me is stored under, given the
+// user_id in the request. Content without one is the caller's, and only a
+// caller who acts for anyone may name someone else.
+func authorFor(r *http.Request, me models.User, userID int64) (int64, error) {
+	if userID == 0 {
+		return me.UserID, nil
+	}
+	if userID != me.UserID && !actsForAnyone(r, me) {
+		return 0, models.ValidationError{"user_id": {fmt.Sprintf("must be left out or be %d", me.UserID)}}
+	}
+	return userID, nil
+}
+
+// checkAuthor fails with errNotAuthor unless me may change content written
+// by userID.
+func checkAuthor(r *http.Request, me models.User, userID int64) error {
+	if userID != me.UserID && !actsForAnyone(r, me) {
+		return errNotAuthor
+	}
+	return nil
+}
+
+// keepAuthor checks the user_id a PUT or PATCH left in *userID against the
+// stored author. Left out, the author stays; a different one is only taken
+// from callers who act for anyone.
+func keepAuthor(r *http.Request, me models.User, userID *int64, stored int64) error {
+	if *userID == 0 {
+		*userID = stored
+		return nil
+	}
+	if actsForAnyone(r, me) {
+		return nil
+	}
+	return unchanged("user_id", *userID, stored)
+}
+
+// requireAuthor answers 403 Forbidden unless the caller may change content
+// written by userID.
+func (env *Env) requireAuthor(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	me, err := env.currentUser(r)
+	if err != nil {
+		serverError(w, r, err)
+		return false
+	}
+	if err := checkAuthor(r, me, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"techblogapi/auth"
+	"time"
+)
+
+// tokenResponse follows the OAuth2 token response format.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// IssueToken is the stateless alternative to /login. It takes the same
+// credentials and returns a short lived access token and a refresh token.
+func (env *Env) IssueToken(w http.ResponseWriter, r *http.Request) {
+	_, user, ok := env.checkCredentials(w, r)
+	if !ok {
+		return
+	}
+	if env.requireSecondFactor(w, r, user, loginModeToken) {
+		return
+	}
+	env.issueTokens(w, r, user.Username, nil)
+}
+
+// issueTokens starts a new token family for username and writes the access
+// and refresh token.
+func (env *Env) issueTokens(w http.ResponseWriter, r *http.Request, username string, recoveryCodes []string) {
+	refreshToken, err := env.cache.IssueRefreshToken(r.Context(), username, "", env.tokens.RefreshTTL)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	env.writeTokens(w, username, refreshToken, recoveryCodes...)
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token.
+// Each refresh token can be used once; presenting it again revokes the login.
+func (env *Env) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+	username, refreshToken, err := env.cache.RotateRefreshToken(r.Context(), req.RefreshToken, env.tokens.RefreshTTL)
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		// Either the client or someone who stole the token used it twice, so
+		// every token of the login is revoked
+		log.Printf("refresh token reused for %s from %s, revoked the token family", username, env.clientIP(r))
+		env.audit(r, username, "refresh_token.reuse", "user", username, map[string]string{"revoked": "token family"})
+	}
+	if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrRefreshTokenReused) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// Accounts disabled since the last refresh don't get new tokens
+	u, err := env.blog.UserByUsername(r.Context(), username)
+	if err != nil || u.Disabled {
+		env.cache.RevokeRefreshToken(r.Context(), refreshToken)
+		http.Error(w, auth.ErrInvalidToken.Error(), http.StatusUnauthorized)
+		return
+	}
+	env.writeTokens(w, username, refreshToken)
+}
+
+// RevokeToken logs a token client out by revoking its refresh token and every
+// token rotated from it. Access tokens run out on their own.
+func (env *Env) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+	if err := env.cache.RevokeRefreshToken(r.Context(), req.RefreshToken); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) writeTokens(w http.ResponseWriter, username, refreshToken string, recoveryCodes ...string) {
+	accessToken, expiresAt, err := env.tokens.IssueAccessToken(username)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(expiresAt).Seconds()),
+		RefreshToken: refreshToken,
+		// Only set when the login enrolled two-factor authentication
+		RecoveryCodes: recoveryCodes,
+	})
+}
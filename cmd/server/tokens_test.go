@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"techblogapi/models"
+	"testing"
+)
+
+func TestRefreshTokenReuse(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "alice")
+
+	res := ts.request(t, "POST", "/token", "", map[string]string{"username": "alice", "password": testPassword})
+	expectStatus(t, res, http.StatusOK)
+	var first tokenResponse
+	decode(t, res, &first)
+
+	res = ts.request(t, "POST", "/token/refresh", "", map[string]string{"refresh_token": first.RefreshToken})
+	expectStatus(t, res, http.StatusOK)
+	var second tokenResponse
+	decode(t, res, &second)
+	expectStatus(t, ts.request(t, "GET", "/me", second.AccessToken, nil), http.StatusOK)
+	// The key a refresh token is stored under doesn't pass as a session token
+	sum := sha256.Sum256([]byte(second.RefreshToken))
+	expectStatus(t, ts.request(t, "GET", "/me", "refresh:"+hex.EncodeToString(sum[:]), nil), http.StatusUnauthorized)
+
+	// Using the first refresh token again revokes the whole login
+	expectStatus(t, ts.request(t, "POST", "/token/refresh", "", map[string]string{"refresh_token": first.RefreshToken}), http.StatusUnauthorized)
+	expectStatus(t, ts.request(t, "POST", "/token/refresh", "", map[string]string{"refresh_token": second.RefreshToken}), http.StatusUnauthorized)
+
+	admin := ts.superuser(t, "admin")
+	res = ts.request(t, "GET", "/admin/audit?action=refresh_token.reuse", admin, nil)
+	expectStatus(t, res, http.StatusOK)
+	var log struct {
+		Results []models.AuditEntry `json:"results"`
+	}
+	decode(t, res, &log)
+	if len(log.Results) != 1 || log.Results[0].TargetID != "alice" {
+		t.Errorf("audit entries for the reused refresh token = %+v", log.Results)
+	}
+}
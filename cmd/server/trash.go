@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"techblogapi/models"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trashTypes maps the {type} of the restore endpoint to the audit target
+// type and the store method restoring it.
+var trashTypes = map[string]struct {
+	target  string
+	restore func(models.Store, context.Context, int) error
+}{
+	"categories": {"category", models.Store.RestoreCategory},
+	"posts":      {"post", models.Store.RestorePost},
+	"comments":   {"comment", models.Store.RestoreComment},
+}
+
+// GetTrash lists the deleted categories, posts and comments that haven't
+// been purged yet.
+func (env *Env) GetTrash(w http.ResponseWriter, r *http.Request) {
+	if _, ok := env.requireSuperuser(w, r); !ok {
+		return
+	}
+	trash, err := env.blog.Trash(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]models.Trash{"results": trash})
+}
+
+// RestoreFromTrash takes a category, post or comment out of the trash and
+// returns it. A post can't be restored while its category is in the trash,
+// nor a comment while its post is.
+func (env *Env) RestoreFromTrash(w http.ResponseWriter, r *http.Request) {
+	admin, ok := env.requireSuperuser(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	t, ok := trashTypes[vars["type"]]
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch err := t.restore(env.blog, r.Context(), id); err {
+	case nil:
+	case models.ErrNotInTrash:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case models.ErrParentInTrash:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		serverError(w, r, err)
+		return
+	}
+	restored := env.snapshot(r.Context(), t.target, id)
+	env.record(r, models.AuditEntry{
+		Actor:      admin.Username,
+		Action:     t.target + ".restore",
+		TargetType: t.target,
+		TargetID:   vars["id"],
+		After:      auditJSON(restored),
+	})
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": restored})
+}
+
+// purgeTrash deletes what has been in the trash for longer than retention,
+// once an hour.
+func (env *Env) purgeTrash(retention time.Duration) {
+	for {
+		res, err := env.blog.PurgeTrash(context.Background(), time.Now().Add(-retention))
+		if err != nil {
+			log.Print(err)
+		} else if res != (models.PurgeResult{}) {
+			log.Printf("Purged %d categories, %d posts, %d comments and %d images from the trash", res.Categories, res.Posts, res.Comments, res.Images)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"techblogapi/models"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+	admin := ts.superuser(t, "admin")
+	ctx := context.Background()
+
+	catID, err := ts.blog.AddCategory(ctx, models.Category{CategoryName: "Go", Slug: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	postID, err := ts.blog.AddPost(ctx, models.Post{UserID: ts.userID(t, "alice"), CategoryID: catID, Slug: "hello", Title: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := ts.blog.AddComment(ctx, models.Comment{UserID: ts.userID(t, "alice"), PostID: postID, Message: "Nice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := strconv.FormatInt(postID, 10)
+	comment := strconv.FormatInt(commentID, 10)
+	category := strconv.FormatInt(catID, 10)
+
+	expectStatus(t, ts.request(t, "DELETE", "/post/"+post, token, nil), http.StatusOK)
+	var posts struct {
+		Results []models.Post `json:"results"`
+	}
+	res := ts.request(t, "GET", "/post/id/"+post, "", nil)
+	expectStatus(t, res, http.StatusOK)
+	decode(t, res, &posts)
+	if len(posts.Results) != 0 {
+		t.Errorf("GET /post/id/%s after delete = %+v, want none", post, posts.Results)
+	}
+
+	expectStatus(t, ts.request(t, "GET", "/admin/trash", token, nil), http.StatusForbidden)
+	res = ts.request(t, "GET", "/admin/trash", admin, nil)
+	expectStatus(t, res, http.StatusOK)
+	var trash struct {
+		Results models.Trash `json:"results"`
+	}
+	decode(t, res, &trash)
+	if len(trash.Results.Posts) != 1 || len(trash.Results.Comments) != 1 || len(trash.Results.Categories) != 0 {
+		t.Fatalf("GET /admin/trash = %+v, want the post and its comment", trash.Results)
+	}
+	if trash.Results.Posts[0].DeletedAt.IsZero() {
+		t.Error("trashed post has no deletion time")
+	}
+
+	// The comment comes back with its post
+	expectStatus(t, ts.request(t, "POST", "/admin/trash/comments/"+comment+"/restore", admin, nil), http.StatusConflict)
+	expectStatus(t, ts.request(t, "POST", "/admin/trash/posts/"+post+"/restore", token, nil), http.StatusForbidden)
+	expectStatus(t, ts.request(t, "POST", "/admin/trash/posts/"+post+"/restore", admin, nil), http.StatusOK)
+	expectStatus(t, ts.request(t, "POST", "/admin/trash/posts/"+post+"/restore", admin, nil), http.StatusNotFound)
+	comments, err := ts.blog.CommentsByPost(ctx, int(postID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 1 {
+		t.Errorf("comments after restoring the post = %+v, want one", comments)
+	}
+	expectStatus(t, ts.request(t, "POST", "/admin/trash/users/1/restore", admin, nil), http.StatusNotFound)
+
+	// A category with posts stays, and its posts can't come back without it
+	if _, err := ts.blog.DeleteCategory(ctx, int(catID)); err != models.ErrCategoryInUse {
+		t.Errorf("deleting a category with posts: err = %v, want ErrCategoryInUse", err)
+	}
+	expectStatus(t, ts.request(t, "DELETE", "/post/"+post, token, nil), http.StatusOK)
+	expectStatus(t, ts.request(t, "DELETE", "/category/"+category, admin, nil), http.StatusOK)
+	expectStatus(t, ts.request(t, "POST", "/admin/trash/posts/"+post+"/restore", admin, nil), http.StatusConflict)
+
+	purged, err := ts.blog.PurgeTrash(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (models.PurgeResult{Categories: 1, Posts: 1, Comments: 1}); purged != want {
+		t.Errorf("PurgeTrash = %+v, want %+v", purged, want)
+	}
+	res = ts.request(t, "GET", "/admin/trash", admin, nil)
+	expectStatus(t, res, http.StatusOK)
+	decode(t, res, &trash)
+	if len(trash.Results.Posts) != 0 || len(trash.Results.Comments) != 0 || len(trash.Results.Categories) != 0 {
+		t.Errorf("GET /admin/trash after purging = %+v, want it empty", trash.Results)
+	}
+	expectStatus(t, ts.request(t, "POST", "/admin/trash/categories/"+category+"/restore", admin, nil), http.StatusNotFound)
+}
+
+// brokenTrashStore is a store that fails to move posts and comments to the
+// trash.
+type brokenTrashStore struct {
+	models.Store
+}
+
+func (brokenTrashStore) DelPost(ctx context.Context, postid int) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func (brokenTrashStore) DelComment(ctx context.Context, commentid int) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func TestDeletePostAndComment(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+	ctx := context.Background()
+
+	catID, err := ts.blog.AddCategory(ctx, models.Category{CategoryName: "Go", Slug: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	postID, err := ts.blog.AddPost(ctx, models.Post{UserID: ts.userID(t, "alice"), CategoryID: catID, Slug: "hello", Title: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := ts.blog.AddComment(ctx, models.Comment{UserID: ts.userID(t, "alice"), PostID: postID, Message: "Nice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := "/post/" + strconv.FormatInt(postID, 10)
+	comment := "/comment/" + strconv.FormatInt(commentID, 10)
+
+	// Nothing is answered as deleted that wasn't
+	ts.env.blog = brokenTrashStore{ts.blog}
+	expectStatus(t, ts.request(t, "DELETE", post, token, nil), http.StatusInternalServerError)
+	expectStatus(t, ts.request(t, "DELETE", comment, token, nil), http.StatusInternalServerError)
+	ts.env.blog = ts.blog
+	if p, _ := ts.blog.PostById(ctx, int(postID)); len(p) != 1 {
+		t.Errorf("post after a failed delete = %+v, want it kept", p)
+	}
+
+	res := ts.request(t, "DELETE", comment, token, nil)
+	expectStatus(t, res, http.StatusOK)
+	var deletedComment struct {
+		Results models.Comment `json:"results"`
+	}
+	decode(t, res, &deletedComment)
+	if deletedComment.Results.CommentID != commentID || deletedComment.Results.Message != "Nice" {
+		t.Errorf("DELETE %s = %+v, want the deleted comment", comment, deletedComment.Results)
+	}
+	expectStatus(t, ts.request(t, "DELETE", comment, token, nil), http.StatusNotFound)
+
+	res = ts.request(t, "DELETE", post, token, nil)
+	expectStatus(t, res, http.StatusOK)
+	var deletedPost struct {
+		Results models.Post `json:"results"`
+	}
+	decode(t, res, &deletedPost)
+	if deletedPost.Results.PostID != postID || deletedPost.Results.Title != "Hello" {
+		t.Errorf("DELETE %s = %+v, want the deleted post", post, deletedPost.Results)
+	}
+	expectStatus(t, ts.request(t, "DELETE", post, token, nil), http.StatusNotFound)
+	expectStatus(t, ts.request(t, "DELETE", "/post/999", token, nil), http.StatusNotFound)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"techblogapi/auth"
+	"techblogapi/models"
+	"time"
+)
+
+// What a login hands out once every factor is verified.
+const (
+	loginModeSession = "session" // session cookie and token, from /login
+	loginModeToken   = "token"   // access and refresh token, from /token
+	loginModeOIDC    = "oidc"    // session after signing in with a provider
+	loginModeMagic   = "magic"   // session after opening an emailed login link
+)
+
+// loginRedirect returns where the browser goes after a login in mode, or ""
+// if the result is returned as JSON. Only logins that start with a browser
+// navigation, not an API call, are redirected.
+func (env *Env) loginRedirect(mode string) string {
+	if mode == loginModeOIDC || mode == loginModeMagic {
+		return env.oidcSuccessRedirect
+	}
+	return ""
+}
+
+// recoveryCodeCount is how many recovery codes a user gets at a time.
+const recoveryCodeCount = 10
+
+type secondFactorRequest struct {
+	PendingToken string `json:"pending_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// requireSecondFactor checks whether u has to pass a second factor before the
+// login completes. If so it answers with a pending login token and returns
+// true; the client then finishes at /login/2fa.
+func (env *Env) requireSecondFactor(w http.ResponseWriter, r *http.Request, u models.User, mode string) bool {
+	pending := auth.PendingLogin{Username: u.Username, Mode: mode}
+	if !u.TwoFactor {
+		required, err := env.blog.TwoFactorRequired(r.Context(), u.Role())
+		if err != nil {
+			serverError(w, r, err)
+			return true
+		}
+		if !required {
+			return false
+		}
+		pending.Enroll = true
+	}
+	token, err := env.cache.CreatePendingLogin(r.Context(), pending)
+	if err != nil {
+		serverError(w, r, err)
+		return true
+	}
+	if redirect := env.loginRedirect(mode); redirect != "" {
+		// The fragment keeps the token out of server logs and referrers
+		q := url.Values{"pending_2fa": {token}}
+		if pending.Enroll {
+			q.Set("enroll", "true")
+		}
+		http.Redirect(w, r, redirect+"#"+q.Encode(), http.StatusFound)
+		return true
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pending_2fa": token,
+		"enroll":      pending.Enroll,
+		"expires_in":  int(auth.PendingLoginTTL.Seconds()),
+	})
+	return true
+}
+
+// finishLogin hands out the credentials for a login that passed every
+// factor. recoveryCodes are included when the login just enrolled 2FA.
+func (env *Env) finishLogin(w http.ResponseWriter, r *http.Request, u models.User, mode string, recoveryCodes []string) {
+	if mode == loginModeToken {
+		env.issueTokens(w, r, u.Username, recoveryCodes)
+		return
+	}
+	sessionToken, err := env.cache.CreateSession(r.Context(), w, auth.LoginCredentials{Username: u.Username})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if redirect := env.loginRedirect(mode); redirect != "" && recoveryCodes == nil {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	response := map[string]interface{}{"results": sessionToken}
+	if recoveryCodes != nil {
+		response["recovery_codes"] = recoveryCodes
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// LoginSecondFactor completes a pending login with a TOTP code or a recovery
+// code. For users who have to enroll, the code confirms the new secret.
+func (env *Env) LoginSecondFactor(w http.ResponseWriter, r *http.Request) {
+	var req secondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pending, u, ok := env.pendingLogin(w, r, req.PendingToken)
+	if !ok {
+		return
+	}
+	// Wrong codes are also counted per user, since every correct password
+	// starts a new pending login with attempts of its own
+	wait, err := env.cache.SecondFactorLockedFor(r.Context(), accountLockoutKey(u))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+
+	var recoveryCodes []string
+	verified := false
+	if pending.Enroll {
+		recoveryCodes, verified, err = env.confirmEnrollment(r.Context(), u, req.Code)
+	} else {
+		verified, err = env.checkSecondFactor(r.Context(), u, req.Code, req.RecoveryCode)
+	}
+	if err != nil && err != models.ErrNoTOTPSecret {
+		serverError(w, r, err)
+		return
+	}
+	if !verified {
+		if err := env.cache.FailPendingLogin(r.Context(), req.PendingToken); err != nil {
+			log.Print(err)
+		}
+		wait, err := env.cache.RecordSecondFactorFailure(r.Context(), accountLockoutKey(u))
+		if err != nil {
+			log.Print(err)
+		}
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+	// Only one request can finish a pending login
+	if err := env.cache.FinishPendingLogin(r.Context(), req.PendingToken); err != nil {
+		http.Error(w, auth.ErrInvalidToken.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := env.cache.ClearSecondFactorFailures(r.Context(), accountLockoutKey(u)); err != nil {
+		log.Print(err)
+	}
+	env.finishLogin(w, r, u, pending.Mode, recoveryCodes)
+}
+
+// LoginEnrollSecondFactor hands out a TOTP secret to a user whose role
+// requires two-factor authentication, in the middle of their first login.
+func (env *Env) LoginEnrollSecondFactor(w http.ResponseWriter, r *http.Request) {
+	var req secondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pending, u, ok := env.pendingLogin(w, r, req.PendingToken)
+	if !ok {
+		return
+	}
+	if !pending.Enroll {
+		http.Error(w, "two-factor authentication is already set up", http.StatusConflict)
+		return
+	}
+	env.startEnrollment(w, r, u)
+}
+
+func (env *Env) pendingLogin(w http.ResponseWriter, r *http.Request, token string) (auth.PendingLogin, models.User, bool) {
+	pending, err := env.cache.LookupPendingLogin(r.Context(), token)
+	if err != nil {
+		if err != auth.ErrInvalidToken {
+			log.Print(err)
+		}
+		http.Error(w, auth.ErrInvalidToken.Error(), http.StatusUnauthorized)
+		return auth.PendingLogin{}, models.User{}, false
+	}
+	u, err := env.blog.UserByUsername(r.Context(), pending.Username)
+	if err != nil || u.Disabled {
+		http.Error(w, auth.ErrInvalidToken.Error(), http.StatusUnauthorized)
+		return auth.PendingLogin{}, models.User{}, false
+	}
+	return pending, u, true
+}
+
+// checkSecondFactor verifies a TOTP code or, failing that, a recovery code.
+func (env *Env) checkSecondFactor(ctx context.Context, u models.User, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		secret, err := env.blog.TOTPSecret(ctx, u.UserID)
+		if err != nil {
+			return false, err
+		}
+		step, ok := auth.ValidateTOTP(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return env.blog.UseTOTPStep(ctx, u.UserID, step)
+	}
+	if recoveryCode != "" {
+		return env.blog.UseRecoveryCode(ctx, u.UserID, auth.HashRecoveryCode(recoveryCode))
+	}
+	return false, nil
+}
+
+// startEnrollment stores a new TOTP secret for u and writes it out.
+func (env *Env) startEnrollment(w http.ResponseWriter, r *http.Request, u models.User) {
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := env.blog.SetTOTPSecret(r.Context(), u.UserID, secret); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]totpEnrollment{"results": {
+		Secret: secret,
+		URI:    auth.TOTPURI(env.totpIssuer, u.Username, secret),
+	}})
+}
+
+// confirmEnrollment turns on two-factor authentication once the user shows a
+// valid code for the new secret, and returns their recovery codes.
+func (env *Env) confirmEnrollment(ctx context.Context, u models.User, code string) ([]string, bool, error) {
+	secret, err := env.blog.TOTPSecret(ctx, u.UserID)
+	if err != nil {
+		return nil, false, err
+	}
+	step, ok := auth.ValidateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, false, nil
+	}
+	if ok, err := env.blog.UseTOTPStep(ctx, u.UserID, step); err != nil || !ok {
+		return nil, false, err
+	}
+	codes, hashes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := env.blog.EnableTOTP(ctx, u.UserID, hashes); err != nil {
+		return nil, false, err
+	}
+	return codes, true, nil
+}
+
+func (env *Env) EnrollSecondFactor(w http.ResponseWriter, r *http.Request) {
+	u, ok := env.accountUser(w, r)
+	if !ok {
+		return
+	}
+	if u.TwoFactor {
+		http.Error(w, "two-factor authentication is already set up", http.StatusConflict)
+		return
+	}
+	env.startEnrollment(w, r, u)
+}
+
+func (env *Env) ConfirmSecondFactor(w http.ResponseWriter, r *http.Request) {
+	u, ok := env.accountUser(w, r)
+	if !ok {
+		return
+	}
+	var req secondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u.TwoFactor {
+		http.Error(w, "two-factor authentication is already set up", http.StatusConflict)
+		return
+	}
+	codes, ok, err := env.confirmEnrollment(r.Context(), u, req.Code)
+	if err == models.ErrNoTOTPSecret {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+	env.audit(r, u.Username, "two_factor.enable", "user", u.Username, nil)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a
+// current TOTP code.
+func (env *Env) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	u, ok := env.verifiedSecondFactorUser(w, r)
+	if !ok {
+		return
+	}
+	codes, hashes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err == nil {
+		err = env.blog.ReplaceRecoveryCodes(r.Context(), u.UserID, hashes)
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	env.audit(r, u.Username, "two_factor.recovery_codes", "user", u.Username, nil)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableSecondFactor turns two-factor authentication off, unless the role of
+// the user requires it.
+func (env *Env) DisableSecondFactor(w http.ResponseWriter, r *http.Request) {
+	u, ok := env.verifiedSecondFactorUser(w, r)
+	if !ok {
+		return
+	}
+	required, err := env.blog.TwoFactorRequired(r.Context(), u.Role())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if required {
+		http.Error(w, "two-factor authentication is required for "+u.Role()+" accounts", http.StatusForbidden)
+		return
+	}
+	if err := env.blog.DisableTOTP(r.Context(), u.UserID); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	env.audit(r, u.Username, "two_factor.disable", "user", u.Username, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifiedSecondFactorUser is accountUser for changes to an enrolled
+// second factor, which need a current TOTP or recovery code in the body.
+// Wrong codes count towards the same lockout as at login.
+func (env *Env) verifiedSecondFactorUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	u, ok := env.accountUser(w, r)
+	if !ok {
+		return models.User{}, false
+	}
+	var req secondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return models.User{}, false
+	}
+	if !u.TwoFactor {
+		http.Error(w, models.ErrNoTOTPSecret.Error(), http.StatusConflict)
+		return models.User{}, false
+	}
+	wait, err := env.cache.SecondFactorLockedFor(r.Context(), accountLockoutKey(u))
+	if err != nil {
+		serverError(w, r, err)
+		return models.User{}, false
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return models.User{}, false
+	}
+	verified, err := env.checkSecondFactor(r.Context(), u, req.Code, req.RecoveryCode)
+	if err != nil {
+		serverError(w, r, err)
+		return models.User{}, false
+	}
+	if !verified {
+		wait, err := env.cache.RecordSecondFactorFailure(r.Context(), accountLockoutKey(u))
+		if err != nil {
+			log.Print(err)
+		}
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return models.User{}, false
+		}
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return models.User{}, false
+	}
+	if err := env.cache.ClearSecondFactorFailures(r.Context(), accountLockoutKey(u)); err != nil {
+		log.Print(err)
+	}
+	return u, true
+}
+
+type twoFactorPolicyRequest struct {
+	Role     string `json:"role"`
+	Required bool   `json:"required"`
+}
+
+func (env *Env) GetTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	if _, ok := env.requireSuperuser(w, r); !ok {
+		return
+	}
+	policy, err := env.blog.TwoFactorPolicy(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]map[string]bool{"results": policy})
+}
+
+// SetTwoFactorPolicy makes two-factor authentication required or optional
+// for a role. Users of the role without it have to enroll at their next login.
+func (env *Env) SetTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	admin, ok := env.requireSuperuser(w, r)
+	if !ok {
+		return
+	}
+	var req twoFactorPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.Role {
+	case models.RoleSuperuser, models.RoleUser, models.RoleGuest:
+	default:
+		http.Error(w, "role must be superuser, user or guest", http.StatusBadRequest)
+		return
+	}
+	if err := env.blog.SetTwoFactorRequired(r.Context(), req.Role, req.Required); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	env.audit(r, admin.Username, "two_factor_policy.set", "role", req.Role, req)
+	json.NewEncoder(w).Encode(map[string]twoFactorPolicyRequest{"results": req})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTwoFactorLogin(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+
+	res := ts.request(t, "POST", "/me/2fa/enroll", token, nil)
+	expectStatus(t, res, http.StatusOK)
+	var enroll struct {
+		Results struct {
+			Secret string `json:"secret"`
+			URI    string `json:"otpauth_uri"`
+		} `json:"results"`
+	}
+	decode(t, res, &enroll)
+
+	stale := totpCode(t, enroll.Results.Secret, time.Now().Add(-time.Hour))
+	res = ts.request(t, "POST", "/me/2fa/confirm", token, map[string]string{"code": stale})
+	expectStatus(t, res, http.StatusUnauthorized)
+	res = ts.request(t, "POST", "/me/2fa/confirm", token, map[string]string{"code": totpCode(t, enroll.Results.Secret, time.Now())})
+	expectStatus(t, res, http.StatusOK)
+	var confirm struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	decode(t, res, &confirm)
+	if len(confirm.RecoveryCodes) == 0 {
+		t.Fatal("confirming two-factor returned no recovery codes")
+	}
+
+	res = ts.request(t, "POST", "/login", "", map[string]string{"username": "alice", "password": testPassword})
+	expectStatus(t, res, http.StatusAccepted)
+	var pending struct {
+		Token string `json:"pending_2fa"`
+	}
+	decode(t, res, &pending)
+
+	// The code that confirmed enrollment can't be replayed
+	res = ts.request(t, "POST", "/login/2fa", "", map[string]string{
+		"pending_token": pending.Token,
+		"code":          totpCode(t, enroll.Results.Secret, time.Now()),
+	})
+	expectStatus(t, res, http.StatusUnauthorized)
+
+	res = ts.request(t, "POST", "/login/2fa", "", map[string]string{
+		"pending_token": pending.Token,
+		"recovery_code": confirm.RecoveryCodes[0],
+	})
+	expectStatus(t, res, http.StatusOK)
+	var session struct {
+		Results string `json:"results"`
+	}
+	decode(t, res, &session)
+	expectStatus(t, ts.request(t, "GET", "/me", session.Results, nil), http.StatusOK)
+
+	// Each recovery code works once
+	res = ts.request(t, "POST", "/login", "", map[string]string{"username": "alice", "password": testPassword})
+	expectStatus(t, res, http.StatusAccepted)
+	decode(t, res, &pending)
+	res = ts.request(t, "POST", "/login/2fa", "", map[string]string{
+		"pending_token": pending.Token,
+		"recovery_code": confirm.RecoveryCodes[0],
+	})
+	expectStatus(t, res, http.StatusUnauthorized)
+
+	// Logging in again with the password doesn't buy more guesses at the code
+	failures := 1
+	for failures < ts.sessions.Lockout.FreeAttempts {
+		res = ts.request(t, "POST", "/login", "", map[string]string{"username": "alice", "password": testPassword})
+		expectStatus(t, res, http.StatusAccepted)
+		decode(t, res, &pending)
+		for i := 0; i < 2 && failures < ts.sessions.Lockout.FreeAttempts; i++ {
+			res = ts.request(t, "POST", "/login/2fa", "", map[string]string{"pending_token": pending.Token, "code": "000000"})
+			expectStatus(t, res, http.StatusUnauthorized)
+			failures++
+		}
+	}
+	res = ts.request(t, "POST", "/login", "", map[string]string{"username": "alice", "password": testPassword})
+	expectStatus(t, res, http.StatusAccepted)
+	decode(t, res, &pending)
+	res = ts.request(t, "POST", "/login/2fa", "", map[string]string{"pending_token": pending.Token, "code": "000000"})
+	expectStatus(t, res, http.StatusTooManyRequests)
+	res = ts.request(t, "POST", "/login", "", map[string]string{"username": "alice", "password": testPassword})
+	expectStatus(t, res, http.StatusAccepted)
+	decode(t, res, &pending)
+	res = ts.request(t, "POST", "/login/2fa", "", map[string]string{"pending_token": pending.Token, "recovery_code": confirm.RecoveryCodes[1]})
+	expectStatus(t, res, http.StatusTooManyRequests)
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("second factor lockout has no Retry-After header")
+	}
+
+	admin := ts.superuser(t, "admin")
+	expectStatus(t, ts.request(t, "POST", "/admin/unlock", admin, map[string]string{"username": "alice"}), http.StatusOK)
+	res = ts.request(t, "POST", "/login/2fa", "", map[string]string{"pending_token": pending.Token, "recovery_code": confirm.RecoveryCodes[1]})
+	expectStatus(t, res, http.StatusOK)
+}
+
+func TestSecondFactorChangeLockout(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.user(t, "alice")
+
+	res := ts.request(t, "POST", "/me/2fa/enroll", token, nil)
+	expectStatus(t, res, http.StatusOK)
+	var enroll struct {
+		Results struct {
+			Secret string `json:"secret"`
+		} `json:"results"`
+	}
+	decode(t, res, &enroll)
+	res = ts.request(t, "POST", "/me/2fa/confirm", token, map[string]string{"code": totpCode(t, enroll.Results.Secret, time.Now())})
+	expectStatus(t, res, http.StatusOK)
+	var confirm struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	decode(t, res, &confirm)
+
+	// Wrong codes to either endpoint count towards one lockout
+	for i := 0; i < ts.sessions.Lockout.FreeAttempts; i++ {
+		if i%2 == 0 {
+			expectStatus(t, ts.request(t, "DELETE", "/me/2fa", token, map[string]string{"code": "000000"}), http.StatusUnauthorized)
+		} else {
+			expectStatus(t, ts.request(t, "POST", "/me/2fa/recovery-codes", token, map[string]string{"recovery_code": "wrong"}), http.StatusUnauthorized)
+		}
+	}
+	expectStatus(t, ts.request(t, "DELETE", "/me/2fa", token, map[string]string{"code": "000000"}), http.StatusTooManyRequests)
+	res = ts.request(t, "DELETE", "/me/2fa", token, map[string]string{"recovery_code": confirm.RecoveryCodes[0]})
+	expectStatus(t, res, http.StatusTooManyRequests)
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("second factor lockout has no Retry-After header")
+	}
+
+	admin := ts.superuser(t, "admin")
+	expectStatus(t, ts.request(t, "POST", "/admin/unlock", admin, map[string]string{"username": "alice"}), http.StatusOK)
+	expectStatus(t, ts.request(t, "DELETE", "/me/2fa", token, map[string]string{"recovery_code": confirm.RecoveryCodes[0]}), http.StatusNoContent)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// maxPasswordBody limits the bodies of the requests that carry passwords, so
+// nobody can make the server read or hash arbitrarily much.
+const maxPasswordBody = 64 << 10
+
+// fieldErrors maps request fields to what is wrong with them.
+type fieldErrors map[string][]string
+
+func (e fieldErrors) add(field string, problems ...string) {
+	if len(problems) > 0 {
+		e[field] = append(e[field], problems...)
+	}
+}
+
+// writeValidationErrors answers with 422 Unprocessable Entity and the
+// problems per field, e.g. {"errors": {"password": ["must be at least 10 characters"]}}.
+func writeValidationErrors(w http.ResponseWriter, e fieldErrors) {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]fieldErrors{"errors": e})
+}
+
+// checkPassword adds the password policy violations of a new password to e.
+func (env *Env) checkPassword(e fieldErrors, password, username, email string) error {
+	problems, err := env.passwords.Check(password, username, email)
+	e.add("password", problems...)
+	return err
+}
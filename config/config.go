@@ -0,0 +1,389 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"techblogapi/auth"
+	"techblogapi/mail"
+	"techblogapi/models"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Config holds the settings shared by the server and the command line tools.
+type Config struct {
+	DBHost string
+	DBPort int
+	DBUser string
+	DBPass string
+	DBName string
+
+	RedisAddr string
+	// RedisTimeout limits dialing Redis and each read and write.
+	RedisTimeout time.Duration
+
+	// DBTimeouts limit each database call the server makes. The command line
+	// tools run without them.
+	DBTimeouts models.Timeouts
+
+	// TrustProxy makes the server take the client IP from X-Forwarded-For.
+	// Only enable it when running behind a reverse proxy that sets the header.
+	TrustProxy bool
+
+	Lockout auth.LockoutPolicy
+
+	// Argon2 are the Argon2id parameters used for new password hashes.
+	// Existing hashes are upgraded to them on the next successful login.
+	Argon2 auth.AuthParams
+
+	// Tokens configures JWT access and refresh tokens. They are disabled
+	// unless JWT_KEYS is set.
+	Tokens auth.TokenIssuer
+
+	// OIDCProviders are the identity providers users can sign in with, from
+	// OIDC_PROVIDERS and the OIDC_<NAME>_* variables of each one.
+	OIDCProviders []*auth.OIDCProvider
+	// OIDCSuccessRedirect is where browsers are sent after signing in with a
+	// provider. Empty means the session token is returned as JSON.
+	OIDCSuccessRedirect string
+
+	// TOTPIssuer names the blog in authenticator apps.
+	TOTPIssuer string
+
+	// MagicLink configures passwordless login links. They are disabled unless
+	// MAGIC_LINK_SECRET is set.
+	MagicLink auth.MagicLinkPolicy
+
+	// SMTP is the server outgoing email goes through. Without SMTP_ADDR
+	// emails are only logged.
+	SMTP mail.SMTPMailer
+
+	// Cookie sets the attributes of the session cookie.
+	Cookie auth.CookiePolicy
+
+	Headers SecurityHeaders
+
+	// Passwords is the policy new passwords have to meet.
+	Passwords auth.PasswordPolicy
+
+	// EmailVerifyURL is where links confirming a changed email address point;
+	// ?token=... is appended.
+	EmailVerifyURL string
+
+	// AccountDeletion is what happens when users delete their account:
+	// "anonymize" keeps the row without personal data, "delete" moves their
+	// posts and comments to a placeholder user and removes the row.
+	AccountDeletion string
+
+	// AuditRetention is how long audit log entries are kept; zero keeps them
+	// forever.
+	AuditRetention time.Duration
+
+	// TrashRetention is how long deleted categories, posts and comments can
+	// be restored before they are purged; zero keeps them forever.
+	TrashRetention time.Duration
+}
+
+// SecurityHeaders are the security headers sent with every response.
+type SecurityHeaders struct {
+	ContentSecurityPolicy string
+	// FrameAncestors is added to the policy as frame-ancestors unless it
+	// already has that directive, and decides X-Frame-Options for old browsers.
+	FrameAncestors string
+	ReferrerPolicy string
+	// HSTSMaxAge of zero sends no Strict-Transport-Security header, which is
+	// what plain HTTP development setups need.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+}
+
+// Load reads the env file at path into the process environment and builds a
+// Config from it. Variables already set in the environment take precedence.
+func Load(path string) (Config, error) {
+	err := godotenv.Load(path)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg := Config{
+		DBHost:    os.Getenv("host"),
+		DBUser:    os.Getenv("user"),
+		DBPass:    os.Getenv("pass"),
+		DBName:    os.Getenv("db"),
+		RedisAddr: getString("REDIS_ADDR", "localhost:6379"),
+		Lockout:   auth.DefaultLockoutPolicy,
+		Argon2:    auth.DefaultAuthParams,
+		MagicLink: auth.DefaultMagicLinkPolicy,
+		Cookie:    auth.DefaultCookiePolicy,
+		Passwords: auth.DefaultPasswordPolicy,
+	}
+	cfg.DBPort, err = strconv.Atoi(os.Getenv("port"))
+	if err != nil {
+		return Config{}, err
+	}
+	if cfg.TrustProxy, err = getBool("TRUST_PROXY", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.RedisTimeout, err = getDuration("REDIS_TIMEOUT", 3*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBTimeouts.Read, err = getDuration("DB_READ_TIMEOUT", 5*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.DBTimeouts.Write, err = getDuration("DB_WRITE_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	l := &cfg.Lockout
+	if l.FreeAttempts, err = getInt("LOGIN_FREE_ATTEMPTS", l.FreeAttempts); err != nil {
+		return Config{}, err
+	}
+	if l.IPFreeAttempts, err = getInt("LOGIN_IP_FREE_ATTEMPTS", l.IPFreeAttempts); err != nil {
+		return Config{}, err
+	}
+	if l.BaseDelay, err = getDuration("LOGIN_LOCKOUT_BASE", l.BaseDelay); err != nil {
+		return Config{}, err
+	}
+	if l.MaxDelay, err = getDuration("LOGIN_LOCKOUT_MAX", l.MaxDelay); err != nil {
+		return Config{}, err
+	}
+	if l.Window, err = getDuration("LOGIN_FAILURE_WINDOW", l.Window); err != nil {
+		return Config{}, err
+	}
+
+	a := &cfg.Argon2
+	if a.Memory, err = getUint32("ARGON2_MEMORY_KIB", a.Memory); err != nil {
+		return Config{}, err
+	}
+	if a.Iterations, err = getUint32("ARGON2_ITERATIONS", a.Iterations); err != nil {
+		return Config{}, err
+	}
+	if a.Iterations == 0 {
+		return Config{}, fmt.Errorf("ARGON2_ITERATIONS: must be at least 1")
+	}
+	parallelism, err := getUint32("ARGON2_PARALLELISM", uint32(a.Parallelism))
+	if err != nil {
+		return Config{}, err
+	}
+	if parallelism == 0 || parallelism > 255 {
+		return Config{}, fmt.Errorf("ARGON2_PARALLELISM: must be between 1 and 255")
+	}
+	a.Parallelism = uint8(parallelism)
+	// Argon2 needs 8 KiB per lane
+	if a.Memory < 8*parallelism {
+		return Config{}, fmt.Errorf("ARGON2_MEMORY_KIB: must be at least 8 times ARGON2_PARALLELISM")
+	}
+	if a.SaltLength, err = getUint32("ARGON2_SALT_LENGTH", a.SaltLength); err != nil {
+		return Config{}, err
+	}
+	if a.SaltLength < 16 {
+		return Config{}, fmt.Errorf("ARGON2_SALT_LENGTH: must be at least 16")
+	}
+	if a.KeyLength, err = getUint32("ARGON2_KEY_LENGTH", a.KeyLength); err != nil {
+		return Config{}, err
+	}
+	if a.KeyLength < 16 {
+		return Config{}, fmt.Errorf("ARGON2_KEY_LENGTH: must be at least 16")
+	}
+
+	t := &cfg.Tokens
+	if t.Keys, err = auth.ParseSigningKeys(os.Getenv("JWT_KEYS")); err != nil {
+		return Config{}, err
+	}
+	t.ActiveKeyID = getString("JWT_ACTIVE_KEY", "")
+	if t.ActiveKeyID == "" && len(t.Keys) > 0 {
+		t.ActiveKeyID = t.Keys[0].ID
+	}
+	t.Issuer = getString("JWT_ISSUER", "techblogapi")
+	if t.AccessTTL, err = getDuration("JWT_ACCESS_TTL", 15*time.Minute); err != nil {
+		return Config{}, err
+	}
+	if t.RefreshTTL, err = getDuration("JWT_REFRESH_TTL", 30*24*time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.OIDCProviders, err = loadOIDCProviders(); err != nil {
+		return Config{}, err
+	}
+	cfg.OIDCSuccessRedirect = getString("OIDC_SUCCESS_REDIRECT", "")
+	cfg.TOTPIssuer = getString("TOTP_ISSUER", "techblogapi")
+
+	m := &cfg.MagicLink
+	if secret := getString("MAGIC_LINK_SECRET", ""); secret != "" {
+		if m.Secret, err = base64.StdEncoding.DecodeString(secret); err != nil {
+			return Config{}, fmt.Errorf("MAGIC_LINK_SECRET: %w", err)
+		}
+	}
+	if m.TTL, err = getDuration("MAGIC_LINK_TTL", m.TTL); err != nil {
+		return Config{}, err
+	}
+	if m.PerAddress, err = getInt("MAGIC_LINK_PER_ADDRESS", m.PerAddress); err != nil {
+		return Config{}, err
+	}
+	if m.PerIP, err = getInt("MAGIC_LINK_PER_IP", m.PerIP); err != nil {
+		return Config{}, err
+	}
+	if m.Window, err = getDuration("MAGIC_LINK_WINDOW", m.Window); err != nil {
+		return Config{}, err
+	}
+	m.RedirectURL = getString("MAGIC_LINK_URL", "http://localhost:8080/login/magic/verify")
+
+	cfg.SMTP = mail.SMTPMailer{
+		Addr:     getString("SMTP_ADDR", ""),
+		Username: getString("SMTP_USERNAME", ""),
+		Password: getString("SMTP_PASSWORD", ""),
+		From:     getString("MAIL_FROM", "techblogapi <no-reply@localhost>"),
+	}
+
+	c := &cfg.Cookie
+	if c.Secure, err = getBool("COOKIE_SECURE", c.Secure); err != nil {
+		return Config{}, err
+	}
+	if c.HTTPOnly, err = getBool("COOKIE_HTTP_ONLY", c.HTTPOnly); err != nil {
+		return Config{}, err
+	}
+	if v := getString("COOKIE_SAME_SITE", ""); v != "" {
+		if c.SameSite, err = auth.ParseSameSite(v); err != nil {
+			return Config{}, fmt.Errorf("COOKIE_SAME_SITE: %w", err)
+		}
+	}
+	c.Path = getString("COOKIE_PATH", c.Path)
+	c.Domain = getString("COOKIE_DOMAIN", c.Domain)
+	if c.HostPrefix, err = getBool("COOKIE_HOST_PREFIX", c.HostPrefix); err != nil {
+		return Config{}, err
+	}
+	if err := c.Validate(); err != nil {
+		return Config{}, fmt.Errorf("session cookie: %w", err)
+	}
+
+	h := &cfg.Headers
+	h.ContentSecurityPolicy = getString("CONTENT_SECURITY_POLICY", "default-src 'none'")
+	h.FrameAncestors = getString("FRAME_ANCESTORS", "'none'")
+	h.ReferrerPolicy = getString("REFERRER_POLICY", "no-referrer")
+	if h.HSTSMaxAge, err = getDuration("HSTS_MAX_AGE", 180*24*time.Hour); err != nil {
+		return Config{}, err
+	}
+	if h.HSTSIncludeSubdomains, err = getBool("HSTS_INCLUDE_SUBDOMAINS", false); err != nil {
+		return Config{}, err
+	}
+
+	pw := &cfg.Passwords
+	if pw.MinLength, err = getInt("PASSWORD_MIN_LENGTH", pw.MinLength); err != nil {
+		return Config{}, err
+	}
+	if pw.MaxLength, err = getInt("PASSWORD_MAX_LENGTH", pw.MaxLength); err != nil {
+		return Config{}, err
+	}
+	if pw.MaxLength < pw.MinLength || pw.MaxLength > 1024 {
+		return Config{}, fmt.Errorf("PASSWORD_MAX_LENGTH: must be between PASSWORD_MIN_LENGTH and 1024")
+	}
+	if pw.MinScore, err = getInt("PASSWORD_MIN_SCORE", pw.MinScore); err != nil {
+		return Config{}, err
+	}
+	if pw.MinScore < 0 || pw.MinScore > 4 {
+		return Config{}, fmt.Errorf("PASSWORD_MIN_SCORE: must be between 0 and 4")
+	}
+	pw.BreachedPath = getString("BREACHED_PASSWORDS_PATH", "")
+
+	cfg.EmailVerifyURL = getString("EMAIL_VERIFY_URL", "http://localhost:8080/verify-email")
+
+	cfg.AccountDeletion = strings.ToLower(getString("ACCOUNT_DELETION", "anonymize"))
+	if cfg.AccountDeletion != "anonymize" && cfg.AccountDeletion != "delete" {
+		return Config{}, fmt.Errorf("ACCOUNT_DELETION: must be anonymize or delete")
+	}
+
+	if cfg.AuditRetention, err = getDuration("AUDIT_RETENTION", 365*24*time.Hour); err != nil {
+		return Config{}, err
+	}
+	if cfg.TrashRetention, err = getDuration("TRASH_RETENTION", 30*24*time.Hour); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func loadOIDCProviders() ([]*auth.OIDCProvider, error) {
+	var providers []*auth.OIDCProvider
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		p := &auth.OIDCProvider{
+			Name:         name,
+			Issuer:       getString(prefix+"ISSUER", ""),
+			ClientID:     getString(prefix+"CLIENT_ID", ""),
+			ClientSecret: getString(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  getString(prefix+"REDIRECT_URL", ""),
+			Scopes:       strings.Fields(getString(prefix+"SCOPES", "openid email profile")),
+		}
+		if p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return nil, fmt.Errorf("OIDC provider %s: %sISSUER, %sCLIENT_ID and %sREDIRECT_URL are required", name, prefix, prefix, prefix)
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+// DSN returns the connection string for the Postgres database.
+func (c Config) DSN() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", c.DBHost, c.DBPort, c.DBUser, c.DBPass, c.DBName)
+}
+
+func getString(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+func getInt(key string, def int) (int, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+func getUint32(key string, def uint32) (uint32, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return uint32(n), nil
+}
+
+func getBool(key string, def bool) (bool, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	return b, nil
+}
+
+func getDuration(key string, def time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,67 @@
+// Package mail sends the emails the blog needs, such as login links.
+package mail
+
+import (
+	"fmt"
+	"log"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+)
+
+// Mailer sends a plain text email.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends email through an SMTP server. Username and Password are
+// optional; without them no authentication is attempted.
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+// New returns an SMTPMailer for s, or a LogMailer when no server is set so
+// development setups can read the emails from the server log.
+func New(s SMTPMailer) Mailer {
+	if s.Addr == "" {
+		return LogMailer{}
+	}
+	return s
+}
+
+func (m SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("mail: invalid header value")
+	}
+	from, err := netmail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("mail: from address: %w", err)
+	}
+	var a smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		a = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(m.Addr, a, from.Address, []string{to}, []byte(msg))
+}
+
+// LogMailer writes emails to the log instead of sending them.
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeletedUsername is the placeholder account that keeps the posts and
+// comments of deleted users, so their foreign keys still hold.
+const DeletedUsername = "[deleted]"
+
+// What DELETE /me does with an account.
+const (
+	DeletionAnonymize = "anonymize" // keep the row, strip everything personal
+	DeletionDelete    = "delete"    // move content to DeletedUsername and drop the row
+)
+
+var ErrSuperuserDeletion = errors.New("superusers can't delete their own account")
+
+// ReservedUsername reports whether username is kept for the accounts of
+// deleted users and can't be registered.
+func ReservedUsername(username string) bool {
+	username = strings.ToLower(username)
+	return username == DeletedUsername || strings.HasPrefix(username, "deleted-")
+}
+
+// ExportedImage is an image that belongs to a user, as an avatar or attached
+// to one of their posts.
+type ExportedImage struct {
+	ID     int64  `json:"id"`
+	URL    string `json:"image_url"`
+	PostID *int64 `json:"post_id,omitempty"`
+	Avatar bool   `json:"avatar,omitempty"`
+}
+
+// ExportedIdentity is an identity provider account linked to a user.
+type ExportedIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CommentsByUser lists the comments written by userID.
+func (m BlogModel) CommentsByUser(ctx context.Context, userID int64) ([]Comment, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return m.queryComments(ctx, "SELECT "+commentColumns+" FROM comment WHERE user_id = $1 AND deleted_at IS NULL ORDER BY id", userID)
+}
+
+// ImagesForUser lists the avatar of userID and the images of their posts.
+func (m BlogModel) ImagesForUser(ctx context.Context, userID int64) ([]ExportedImage, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, `SELECT i.id, i.image_url, i.post_id, i.id = u.avatar_image_id
+		FROM image i JOIN users u ON u.id = $1
+		WHERE i.id = u.avatar_image_id OR i.post_id IN (SELECT id FROM post WHERE user_id = $1)
+		ORDER BY i.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	images := []ExportedImage{}
+	for rows.Next() {
+		var img ExportedImage
+		var postID sql.NullInt64
+		var avatar sql.NullBool
+		if err := rows.Scan(&img.ID, &img.URL, &postID, &avatar); err != nil {
+			return nil, err
+		}
+		if postID.Valid {
+			img.PostID = &postID.Int64
+		}
+		img.Avatar = avatar.Bool
+		images = append(images, img)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// IdentitiesForUser lists the identity provider accounts linked to userID.
+func (m BlogModel) IdentitiesForUser(ctx context.Context, userID int64) ([]ExportedIdentity, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, "SELECT provider, subject, COALESCE(email, ''), created_at FROM user_identities WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []ExportedIdentity{}
+	for rows.Next() {
+		var id ExportedIdentity
+		if err := rows.Scan(&id.Provider, &id.Subject, &id.Email, &id.CreatedAt); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// RemoveAccount deletes or anonymizes the account of userID according to
+// policy, one of DeletionAnonymize or DeletionDelete. Credentials, linked
+// identities and two-factor settings are dropped either way.
+func (m BlogModel) RemoveAccount(ctx context.Context, userID int64, policy string) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		var superuser bool
+		err := tx.QueryRowContext(ctx, "SELECT is_superuser FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&superuser)
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if superuser {
+			return ErrSuperuserDeletion
+		}
+		for _, q := range []string{
+			"DELETE FROM api_keys WHERE user_id = $1",
+			"DELETE FROM user_identities WHERE user_id = $1",
+			"DELETE FROM recovery_codes WHERE user_id = $1",
+		} {
+			if _, err := tx.ExecContext(ctx, q, userID); err != nil {
+				return err
+			}
+		}
+
+		switch policy {
+		case DeletionAnonymize:
+			_, err = tx.ExecContext(ctx, `UPDATE users SET username = $1, firstname = NULL, lastname = NULL, email = NULL, email_verified = FALSE, password = NULL,
+				bio = NULL, avatar_image_id = NULL, website = NULL, social_links = NULL,
+				totp_secret = NULL, totp_enabled = FALSE, totp_last_step = NULL, disabled = TRUE WHERE id = $2`,
+				fmt.Sprintf("deleted-%d", userID), userID)
+			return err
+		case DeletionDelete:
+			placeholder, err := deletedUserID(ctx, tx)
+			if err != nil {
+				return err
+			}
+			for _, q := range []string{
+				"UPDATE post SET user_id = $1 WHERE user_id = $2",
+				"UPDATE comment SET user_id = $1 WHERE user_id = $2",
+			} {
+				if _, err := tx.ExecContext(ctx, q, placeholder, userID); err != nil {
+					return err
+				}
+			}
+			_, err = tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", userID)
+			return err
+		default:
+			return fmt.Errorf("unknown account deletion policy %q", policy)
+		}
+	})
+}
+
+// deletedUserID returns the id of the DeletedUsername placeholder, creating
+// it the first time. It can't log in: it has no password and is disabled.
+func deletedUserID(ctx context.Context, tx *sql.Tx) (int64, error) {
+	_, err := tx.ExecContext(ctx, "INSERT INTO users (is_guest, is_superuser, username, disabled) VALUES (TRUE, FALSE, $1, TRUE) ON CONFLICT DO NOTHING", DeletedUsername)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE LOWER(username) = LOWER($1)", DeletedUsername).Scan(&id)
+	return id, err
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey is a personal API key. Only the hash of the key is stored; Prefix is
+// kept so users can tell their keys apart.
+type APIKey struct {
+	ID         int64      `json:"id" db:"id"`
+	UserID     int64      `json:"user_id" db:"user_id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	Scopes     []string   `json:"scopes" db:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Expired reports whether the key is past its expiry.
+func (k APIKey) Expired() bool {
+	return k.ExpiresAt != nil && k.ExpiresAt.Before(time.Now())
+}
+
+const apiKeyColumns = "id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at"
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }, extra ...interface{}) (APIKey, error) {
+	var k APIKey
+	var expiresAt, lastUsedAt sql.NullTime
+	dest := append([]interface{}{&k.ID, &k.UserID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &expiresAt, &lastUsedAt, &k.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return APIKey{}, err
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if k.Scopes == nil {
+		k.Scopes = []string{}
+	}
+	return k, nil
+}
+
+// AddAPIKey stores a new key under its hash and returns it with the id and
+// creation time filled in.
+func (m BlogModel) AddAPIKey(ctx context.Context, k APIKey, hash string) (APIKey, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	row := m.DB.QueryRowContext(ctx, "INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING "+apiKeyColumns,
+		k.UserID, k.Name, k.Prefix, hash, pq.Array(k.Scopes), k.ExpiresAt)
+	return scanAPIKey(row)
+}
+
+// APIKeysForUser lists the keys of a user that haven't been revoked.
+func (m BlogModel) APIKeysForUser(ctx context.Context, userID int64) ([]APIKey, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// APIKeyByHash finds an unrevoked key by its hash, together with the
+// username of its owner. Expired keys are returned too, callers check Expired.
+func (m BlogModel) APIKeyByHash(ctx context.Context, hash string) (APIKey, User, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	var username string
+	var disabled bool
+	row := m.DB.QueryRowContext(ctx, "SELECT k.id, k.user_id, k.name, k.prefix, k.scopes, k.expires_at, k.last_used_at, k.created_at, u.username, u.disabled FROM api_keys k JOIN users u ON u.id = k.user_id WHERE k.key_hash = $1 AND k.revoked_at IS NULL", hash)
+	k, err := scanAPIKey(row, &username, &disabled)
+	if err == sql.ErrNoRows {
+		return APIKey{}, User{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, User{}, err
+	}
+	return k, User{UserID: k.UserID, Username: username, Disabled: disabled}, nil
+}
+
+// TouchAPIKey records that a key was just used. To keep writes down the
+// timestamp is only moved once a minute.
+func (m BlogModel) TouchAPIKey(ctx context.Context, id int64) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, "UPDATE api_keys SET last_used_at = NOW() WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')", id)
+	return err
+}
+
+// RevokeAPIKey revokes key id if it belongs to userID.
+func (m BlogModel) RevokeAPIKey(ctx context.Context, userID, id int64) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	res, err := m.DB.ExecContext(ctx, "UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL", id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEntry records a privileged or state-changing action, such as creating
+// an admin account or deleting a post. Before and After hold the target as
+// JSON around a change, when there is one.
+type AuditEntry struct {
+	ID         int64           `json:"id" db:"id"`
+	Actor      string          `json:"actor" db:"actor"`
+	Action     string          `json:"action" db:"action"`
+	TargetType string          `json:"target_type" db:"target_type"`
+	TargetID   string          `json:"target_id" db:"target_id"`
+	Details    json.RawMessage `json:"details,omitempty" db:"details"`
+	Before     json.RawMessage `json:"before,omitempty" db:"before"`
+	After      json.RawMessage `json:"after,omitempty" db:"after"`
+	IP         string          `json:"ip,omitempty" db:"ip"`
+	RequestID  string          `json:"request_id,omitempty" db:"request_id"`
+	CreatedAt  time.Time       `json:"created_at" db:"created_at"`
+}
+
+// AuditFilter narrows down the entries returned by AuditEntries. Zero fields
+// don't filter.
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+}
+
+const auditColumns = "id, actor, action, target_type, target_id, details, before, after, COALESCE(ip, ''), COALESCE(request_id, ''), created_at"
+
+func scanAuditEntry(row interface{ Scan(...interface{}) error }) (AuditEntry, error) {
+	var e AuditEntry
+	var details, before, after []byte
+	err := row.Scan(&e.ID, &e.Actor, &e.Action, &e.TargetType, &e.TargetID, &details, &before, &after, &e.IP, &e.RequestID, &e.CreatedAt)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	e.Details, e.Before, e.After = details, before, after
+	return e, nil
+}
+
+func (m BlogModel) AddAuditEntry(ctx context.Context, e AuditEntry) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, `INSERT INTO audit_log (actor, action, target_type, target_id, details, before, after, ip, request_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		e.Actor, e.Action, e.TargetType, e.TargetID, nullJSON(e.Details), nullJSON(e.Before), nullJSON(e.After),
+		nullIfEmpty(e.IP), nullIfEmpty(e.RequestID))
+	return err
+}
+
+func nullJSON(b json.RawMessage) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return string(b)
+}
+
+// AuditEntries lists the entries matching f, newest first.
+func (m BlogModel) AuditEntries(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.Actor != "" {
+		add("actor = $%d", f.Actor)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.TargetType != "" {
+		add("target_type = $%d", f.TargetType)
+	}
+	if f.TargetID != "" {
+		add("target_id = $%d", f.TargetID)
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= $%d", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("created_at < $%d", f.Until)
+	}
+	q := "SELECT " + auditColumns + " FROM audit_log"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		q += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if f.Offset > 0 {
+		args = append(args, f.Offset)
+		q += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+	return m.queryAuditEntries(ctx, q, args...)
+}
+
+// AuditEntriesByActor lists the audit log entries of actions taken by
+// username.
+func (m BlogModel) AuditEntriesByActor(ctx context.Context, username string) ([]AuditEntry, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return m.queryAuditEntries(ctx, "SELECT "+auditColumns+" FROM audit_log WHERE actor = $1 ORDER BY id", username)
+}
+
+func (m BlogModel) queryAuditEntries(ctx context.Context, q string, args ...interface{}) ([]AuditEntry, error) {
+	rows, err := m.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// PruneAuditLog deletes the entries older than cutoff and returns how many
+// were deleted. The table refuses deletes unless techblogapi.audit_prune is
+// set for the transaction, so this is the only way entries go away.
+func (m BlogModel) PruneAuditLog(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var n int64
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "SET LOCAL techblogapi.audit_prune = 'on'"); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, "DELETE FROM audit_log WHERE created_at < $1", cutoff)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// CategoryByID returns the category with id, or sql.ErrNoRows.
+func (m BlogModel) CategoryByID(ctx context.Context, id int) (Category, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return scanCategory(m.DB.QueryRowContext(ctx, "SELECT "+categoryColumns+" FROM category WHERE id = $1 AND deleted_at IS NULL", id))
+}
+
+// CommentsByPost lists the comments on postID.
+func (m BlogModel) CommentsByPost(ctx context.Context, postID int) ([]Comment, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return m.queryComments(ctx, "SELECT "+commentColumns+" FROM comment WHERE post_id = $1 AND deleted_at IS NULL ORDER BY id", postID)
+}
+
+// CommentByID returns the comment with id, or sql.ErrNoRows.
+func (m BlogModel) CommentByID(ctx context.Context, id int) (Comment, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return scanComment(m.DB.QueryRowContext(ctx, "SELECT "+commentColumns+" FROM comment WHERE id = $1 AND deleted_at IS NULL", id))
+}
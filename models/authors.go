@@ -0,0 +1,186 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/lib/pq"
+)
+
+// SocialNetworks are the keys allowed in Author.SocialLinks.
+var SocialNetworks = []string{"github", "twitter", "linkedin", "mastodon", "youtube", "bluesky"}
+
+// AuthorSummary is the short form of an author embedded in posts.
+type AuthorSummary struct {
+	Username  string `json:"username"`
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+}
+
+// Author is the public profile of a user.
+type Author struct {
+	AuthorSummary
+	Bio           string            `json:"bio"`
+	AvatarImageID *int64            `json:"avatar_image_id,omitempty"`
+	Website       string            `json:"website,omitempty"`
+	SocialLinks   map[string]string `json:"social_links"`
+	PostCount     int64             `json:"post_count"`
+}
+
+// AuthorProfile holds the profile fields a user edits themselves.
+type AuthorProfile struct {
+	Bio           string
+	AvatarImageID *int64
+	Website       string
+	SocialLinks   map[string]string
+}
+
+const authorColumns = `u.username, COALESCE(u.firstname, ''), COALESCE(u.lastname, ''), COALESCE(i.image_url, ''),
+	COALESCE(u.bio, ''), u.avatar_image_id, COALESCE(u.website, ''), u.social_links,
+	(SELECT COUNT(*) FROM post p WHERE p.user_id = u.id AND p.deleted_at IS NULL)`
+
+const authorFrom = " FROM users u LEFT JOIN image i ON i.id = u.avatar_image_id"
+
+func scanAuthor(row interface{ Scan(...interface{}) error }) (Author, error) {
+	var a Author
+	var avatarID sql.NullInt64
+	var links []byte
+	err := row.Scan(&a.Username, &a.FirstName, &a.LastName, &a.AvatarURL, &a.Bio, &avatarID, &a.Website, &links, &a.PostCount)
+	if err != nil {
+		return Author{}, err
+	}
+	if avatarID.Valid {
+		a.AvatarImageID = &avatarID.Int64
+	}
+	a.SocialLinks = map[string]string{}
+	if len(links) > 0 {
+		if err := json.Unmarshal(links, &a.SocialLinks); err != nil {
+			return Author{}, err
+		}
+	}
+	return a, nil
+}
+
+// Authors lists the enabled users who have written at least one post.
+func (m BlogModel) Authors(ctx context.Context) ([]Author, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, "SELECT "+authorColumns+authorFrom+
+		" WHERE NOT u.disabled AND EXISTS (SELECT 1 FROM post p WHERE p.user_id = u.id AND p.deleted_at IS NULL) ORDER BY LOWER(u.username)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	authors := []Author{}
+	for rows.Next() {
+		a, err := scanAuthor(rows)
+		if err != nil {
+			return nil, err
+		}
+		authors = append(authors, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return authors, nil
+}
+
+// AuthorByUsername returns the profile of an enabled user, or ErrUserNotFound.
+func (m BlogModel) AuthorByUsername(ctx context.Context, username string) (Author, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	a, err := scanAuthor(m.DB.QueryRowContext(ctx, "SELECT "+authorColumns+authorFrom+" WHERE LOWER(u.username) = LOWER($1) AND NOT u.disabled", username))
+	if err == sql.ErrNoRows {
+		return Author{}, ErrUserNotFound
+	}
+	return a, err
+}
+
+// AuthorByUserID returns the profile of userID, or ErrUserNotFound.
+func (m BlogModel) AuthorByUserID(ctx context.Context, userID int64) (Author, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	a, err := scanAuthor(m.DB.QueryRowContext(ctx, "SELECT "+authorColumns+authorFrom+" WHERE u.id = $1", userID))
+	if err == sql.ErrNoRows {
+		return Author{}, ErrUserNotFound
+	}
+	return a, err
+}
+
+// UpdateAuthorProfile replaces the profile fields of userID.
+func (m BlogModel) UpdateAuthorProfile(ctx context.Context, userID int64, p AuthorProfile) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var links interface{}
+	if len(p.SocialLinks) > 0 {
+		b, err := json.Marshal(p.SocialLinks)
+		if err != nil {
+			return err
+		}
+		links = string(b)
+	}
+	return updateUser(ctx, m.DB, "UPDATE users SET bio = $1, avatar_image_id = $2, website = $3, social_links = $4 WHERE id = $5",
+		nullIfEmpty(p.Bio), p.AvatarImageID, nullIfEmpty(p.Website), links, userID)
+}
+
+// ImageExists reports whether there is an image with id.
+func (m BlogModel) ImageExists(ctx context.Context, id int64) (bool, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM image WHERE id = $1)", id).Scan(&exists)
+	return exists, err
+}
+
+// PostsByAuthor lists the posts of a user, newest first.
+func (m BlogModel) PostsByAuthor(ctx context.Context, username string) ([]Post, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return m.queryPosts(ctx, "SELECT "+postColumns+" FROM post WHERE user_id = (SELECT id FROM users WHERE LOWER(username) = LOWER($1)) AND deleted_at IS NULL ORDER BY datetime DESC", username)
+}
+
+// withAuthors fills in the author of each post with one query for all of
+// them.
+func (m BlogModel) withAuthors(ctx context.Context, posts []Post) ([]Post, error) {
+	if len(posts) == 0 {
+		return posts, nil
+	}
+	ids := make([]int64, 0, len(posts))
+	for _, p := range posts {
+		ids = append(ids, p.UserID)
+	}
+	rows, err := m.DB.QueryContext(ctx, `SELECT u.id, u.username, COALESCE(u.firstname, ''), COALESCE(u.lastname, ''), COALESCE(i.image_url, '')`+authorFrom+
+		" WHERE u.id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	authors := map[int64]*AuthorSummary{}
+	for rows.Next() {
+		var id int64
+		var a AuthorSummary
+		if err := rows.Scan(&id, &a.Username, &a.FirstName, &a.LastName, &a.AvatarURL); err != nil {
+			return nil, err
+		}
+		authors[id] = &a
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range posts {
+		posts[i].Author = authors[posts[i].UserID]
+	}
+	return posts, nil
+}
+
+// ValidSocialNetwork reports whether name is one of SocialNetworks.
+func ValidSocialNetwork(name string) bool {
+	for _, n := range SocialNetworks {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
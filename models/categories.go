@@ -0,0 +1,96 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrCategoryNotFound = errors.New("no such category")
+	ErrMergeIntoItself  = errors.New("a category can't be merged into itself")
+)
+
+// ReassignResult reports what deleting or merging categories changed. To is
+// zero when the deleted category had nothing to move.
+type ReassignResult struct {
+	To          int64   `json:"to,omitempty"`
+	Deleted     []int64 `json:"deleted"`
+	PostsMoved  int64   `json:"posts_moved"`
+	ImagesMoved int64   `json:"images_moved"`
+}
+
+// MergeCategories moves the posts and images of the from categories,
+// including the ones in the trash, to the category into, and moves the from
+// categories to the trash. Nothing changes unless all of that succeeds.
+func (m BlogModel) MergeCategories(ctx context.Context, into int, from []int) (ReassignResult, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	ids := make([]int64, 0, len(from))
+	for _, id := range from {
+		if id == into {
+			return ReassignResult{}, ErrMergeIntoItself
+		}
+		ids = append(ids, int64(id))
+	}
+	var res ReassignResult
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		res = ReassignResult{To: int64(into), Deleted: []int64{}}
+		// Lock the categories so none is deleted or merged elsewhere meanwhile
+		rows, err := tx.QueryContext(ctx, "SELECT id FROM category WHERE id = ANY($1) AND deleted_at IS NULL ORDER BY id FOR UPDATE",
+			pq.Array(append([]int64{int64(into)}, ids...)))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		found := map[int64]bool{}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			found[id] = true
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, id := range append([]int64{int64(into)}, ids...) {
+			if !found[id] {
+				return fmt.Errorf("category %d: %w", id, ErrCategoryNotFound)
+			}
+		}
+
+		for _, step := range []struct {
+			query string
+			n     *int64
+		}{
+			{"UPDATE post SET category_id = $1 WHERE category_id = ANY($2)", &res.PostsMoved},
+			{"UPDATE image SET category_id = $1 WHERE category_id = ANY($2)", &res.ImagesMoved},
+		} {
+			r, err := tx.ExecContext(ctx, step.query, into, pq.Array(ids))
+			if err != nil {
+				return err
+			}
+			if *step.n, err = r.RowsAffected(); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE category SET deleted_at = NOW() WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if found[id] {
+				res.Deleted = append(res.Deleted, id)
+				delete(found, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ReassignResult{}, err
+	}
+	return res, nil
+}
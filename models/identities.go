@@ -0,0 +1,101 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ExternalIdentity links an account at an external identity provider to a
+// user.
+type ExternalIdentity struct {
+	Provider string
+	Subject  string
+	Email    string
+}
+
+// UserByIdentity returns the user linked to the provider account, or
+// ErrUserNotFound.
+func (m BlogModel) UserByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	u, err := scanUser(m.DB.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = (SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2)", provider, subject))
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+// UserByEmail returns the user with the given email, ignoring case, or
+// ErrUserNotFound.
+func (m BlogModel) UserByEmail(ctx context.Context, email string) (User, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	u, err := scanUser(m.DB.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE LOWER(email) = LOWER($1)", email))
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+// LinkIdentity links an external identity to userID.
+func (m BlogModel) LinkIdentity(ctx context.Context, userID int64, id ExternalIdentity) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return linkIdentity(ctx, m.DB, userID, id)
+}
+
+func linkIdentity(ctx context.Context, q querier, userID int64, id ExternalIdentity) error {
+	_, err := q.ExecContext(ctx, "INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)",
+		userID, id.Provider, id.Subject, nullIfEmpty(id.Email))
+	return err
+}
+
+// CreateExternalUser creates a user without a password for someone signing
+// in through an identity provider, and links the identity to it in the same
+// transaction. If the wanted username is taken a numeric suffix is added.
+// The email of u, if any, is one the provider verified.
+func (m BlogModel) CreateExternalUser(ctx context.Context, u User, id ExternalIdentity) (User, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	base := strings.ToLower(u.Username)
+	if base == "" || ReservedUsername(base) {
+		base = "user"
+	}
+	u.EmailVerified = u.Email != ""
+	for attempt := 0; attempt < 5; attempt++ {
+		u.Username = base
+		if attempt > 0 {
+			n, err := rand.Int(rand.Reader, big.NewInt(100000))
+			if err != nil {
+				return User{}, err
+			}
+			u.Username = fmt.Sprintf("%s%d", base, n)
+		}
+		err := m.WithTx(ctx, func(tx *sql.Tx) error {
+			err := tx.QueryRowContext(ctx, "INSERT INTO users (is_guest, is_superuser, username, firstname, lastname, email, email_verified, password) VALUES (FALSE, FALSE, $1, $2, $3, $4, $5, NULL) RETURNING id",
+				u.Username, u.FirstName, u.LastName, nullIfEmpty(u.Email), u.Email != "").Scan(&u.UserID)
+			if err != nil {
+				return duplicateUserError(err)
+			}
+			return linkIdentity(ctx, tx, u.UserID, id)
+		})
+		if err == ErrDuplicateUsername {
+			continue
+		}
+		if err != nil {
+			return User{}, err
+		}
+		return u, nil
+	}
+	return User{}, ErrDuplicateUsername
+}
@@ -0,0 +1,286 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ImportMode decides what an import does with its valid items when some of
+// the others are invalid.
+type ImportMode string
+
+const (
+	// AllOrNothing stores the items only if every one of them is valid
+	AllOrNothing ImportMode = "all-or-nothing"
+	// BestEffort stores the valid items and reports the others
+	BestEffort ImportMode = "best-effort"
+)
+
+// The status of an imported item. Skipped items are valid but weren't stored
+// because an all-or-nothing import had invalid ones.
+const (
+	ImportCreated = "created"
+	ImportFailed  = "failed"
+	ImportSkipped = "skipped"
+)
+
+// ImportResult is what became of one item of an import: its ID when it was
+// stored, or what is wrong with it per field.
+type ImportResult struct {
+	Index  int                 `json:"index"`
+	Status string              `json:"status"`
+	ID     int64               `json:"id,omitempty"`
+	Errors map[string][]string `json:"errors,omitempty"`
+}
+
+// Fail marks the item as invalid because of problem with field.
+func (r *ImportResult) Fail(field, problem string) {
+	if r.Errors == nil {
+		r.Errors = map[string][]string{}
+	}
+	r.Errors[field] = append(r.Errors[field], problem)
+	r.Status = ImportFailed
+}
+
+func newImportResults(n int) []ImportResult {
+	results := make([]ImportResult, n)
+	for i := range results {
+		results[i].Index = i
+	}
+	return results
+}
+
+// settle decides the status of the items not failed yet, and reports whether
+// they are to be stored.
+func settle(results []ImportResult, mode ImportMode) bool {
+	failed := false
+	for _, r := range results {
+		failed = failed || r.Status == ImportFailed
+	}
+	store := !failed || mode == BestEffort
+	for i := range results {
+		if results[i].Status == ImportFailed {
+			continue
+		}
+		results[i].Status = ImportSkipped
+		if store {
+			results[i].Status = ImportCreated
+		}
+	}
+	return store
+}
+
+// fail marks the item as invalid because of every problem in e.
+func (r *ImportResult) fail(e ValidationError) {
+	for field, problems := range e {
+		for _, problem := range problems {
+			r.Fail(field, problem)
+		}
+	}
+}
+
+func (c *Category) checkImport(r *ImportResult) {
+	if c.Slug == "" {
+		c.Slug = Slugify(c.CategoryName)
+	}
+	r.fail(c.problems())
+}
+
+func (p *Post) checkImport(r *ImportResult, now time.Time) {
+	if p.Slug == "" {
+		p.Slug = Slugify(p.Title)
+	}
+	if p.DateTime.IsZero() {
+		p.DateTime = now
+	}
+	r.fail(p.problems())
+}
+
+func (c *Comment) checkImport(r *ImportResult) {
+	r.fail(c.problems())
+}
+
+// ImportCategories stores categories in one transaction. It returns a result
+// per category, in order.
+func (m BlogModel) ImportCategories(ctx context.Context, categories []Category, mode ImportMode) ([]ImportResult, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var results []ImportResult
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		results = newImportResults(len(categories))
+		for i := range categories {
+			categories[i].checkImport(&results[i])
+		}
+		if !settle(results, mode) {
+			return nil
+		}
+		return copyRows(ctx, tx, "category", []string{"category_name", "slug"}, results, func(i int) []interface{} {
+			c := categories[i]
+			return []interface{}{c.CategoryName, c.Slug}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ImportPosts stores posts in one transaction. It returns a result per post,
+// in order. Posts fail when their author or category doesn't exist.
+func (m BlogModel) ImportPosts(ctx context.Context, posts []Post, mode ImportMode) ([]ImportResult, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var results []ImportResult
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		results = newImportResults(len(posts))
+		now := time.Now()
+		users := make([]int64, len(posts))
+		categories := make([]int64, len(posts))
+		for i := range posts {
+			posts[i].checkImport(&results[i], now)
+			users[i], categories[i] = posts[i].UserID, posts[i].CategoryID
+		}
+		liveUsers, err := lockIDs(ctx, tx, lockUsers, users)
+		if err != nil {
+			return err
+		}
+		liveCategories, err := lockIDs(ctx, tx, lockCategories, categories)
+		if err != nil {
+			return err
+		}
+		for i, p := range posts {
+			if !liveUsers[p.UserID] {
+				results[i].Fail("user_id", "no such user")
+			}
+			if !liveCategories[p.CategoryID] {
+				results[i].Fail("category_id", ErrCategoryNotFound.Error())
+			}
+		}
+		if !settle(results, mode) {
+			return nil
+		}
+		columns := []string{"user_id", "category_id", "title", "slug", "read_time", "datetime", "message"}
+		return copyRows(ctx, tx, "post", columns, results, func(i int) []interface{} {
+			p := posts[i]
+			return []interface{}{p.UserID, p.CategoryID, p.Title, p.Slug, p.ReadTime, p.DateTime, p.Message}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ImportComments stores comments in one transaction. It returns a result per
+// comment, in order. Comments fail when their author or post doesn't exist.
+func (m BlogModel) ImportComments(ctx context.Context, comments []Comment, mode ImportMode) ([]ImportResult, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var results []ImportResult
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		results = newImportResults(len(comments))
+		users := make([]int64, len(comments))
+		posts := make([]int64, len(comments))
+		for i := range comments {
+			comments[i].checkImport(&results[i])
+			users[i], posts[i] = comments[i].UserID, comments[i].PostID
+		}
+		liveUsers, err := lockIDs(ctx, tx, lockUsers, users)
+		if err != nil {
+			return err
+		}
+		livePosts, err := lockIDs(ctx, tx, lockPosts, posts)
+		if err != nil {
+			return err
+		}
+		for i, c := range comments {
+			if !liveUsers[c.UserID] {
+				results[i].Fail("user_id", "no such user")
+			}
+			if !livePosts[c.PostID] {
+				results[i].Fail("post_id", "no such post")
+			}
+		}
+		if !settle(results, mode) {
+			return nil
+		}
+		return copyRows(ctx, tx, "comment", []string{"user_id", "post_id", "message"}, results, func(i int) []interface{} {
+			c := comments[i]
+			return []interface{}{c.UserID, c.PostID, c.Message}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// lockIDs returns which of ids query finds, and keeps those rows from being
+// deleted or moved to the trash until tx ends.
+func lockIDs(ctx context.Context, tx *sql.Tx, query string, ids []int64) (map[int64]bool, error) {
+	rows, err := tx.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		found[id] = true
+	}
+	return found, rows.Err()
+}
+
+// copyRows stores row(i) in table for every created result with COPY. COPY
+// doesn't return the ids it assigns, so they are taken from the table's
+// sequence beforehand and copied along with the rows.
+func copyRows(ctx context.Context, tx *sql.Tx, table string, columns []string, results []ImportResult, row func(i int) []interface{}) error {
+	var created []int
+	for i, r := range results {
+		if r.Status == ImportCreated {
+			created = append(created, i)
+		}
+	}
+	if len(created) == 0 {
+		return nil
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT nextval(pg_get_serial_sequence($1, 'id')) FROM generate_series(1, $2)", table, len(created))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for _, i := range created {
+		if !rows.Next() {
+			return fmt.Errorf("%s: got fewer ids than rows to import", table)
+		}
+		if err := rows.Scan(&results[i].ID); err != nil {
+			return err
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, append([]string{"id"}, columns...)...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, i := range created {
+		if _, err := stmt.ExecContext(ctx, append([]interface{}{results[i].ID}, row(i)...)...); err != nil {
+			return err
+		}
+	}
+	// The final Exec without arguments flushes the COPY
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+	return stmt.Close()
+}
@@ -0,0 +1,1438 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"techblogapi/auth"
+	"time"
+)
+
+// MemoryStore is a Store kept in memory, for tests and for running the server
+// without PostgreSQL. It follows the behaviour of BlogModel, including the
+// unique and foreign key constraints of the schema. Nothing it does blocks, so
+// it ignores contexts. The zero value is not ready to use, create one with
+// NewMemoryStore.
+type MemoryStore struct {
+	// Params are the Argon2id parameters for new password hashes. Nil means
+	// auth.DefaultAuthParams.
+	Params *auth.AuthParams
+
+	mu         sync.Mutex
+	lastID     map[string]int64
+	users      map[int64]*memUser
+	identities []memIdentity
+	recovery   []memRecoveryCode
+	twoFactor  map[string]bool
+	apiKeys    map[int64]*memAPIKey
+	categories map[int64]Category
+	posts      map[int64]Post
+	comments   map[int64]Comment
+	images     map[int64]memImage
+	audit      []AuditEntry
+	// deletedAt holds when the categories, posts and comments in the trash
+	// were deleted
+	deletedAt map[trashKey]time.Time
+}
+
+type trashKey struct {
+	table string
+	id    int64
+}
+
+type memUser struct {
+	User
+	password     *string
+	bio          string
+	avatarID     *int64
+	website      string
+	socialLinks  map[string]string
+	totpSecret   *string
+	totpLastStep *int64
+}
+
+type memIdentity struct {
+	userID int64
+	ExportedIdentity
+}
+
+type memRecoveryCode struct {
+	userID int64
+	hash   string
+	used   bool
+}
+
+type memAPIKey struct {
+	APIKey
+	hash    string
+	revoked bool
+}
+
+type memImage struct {
+	url    string
+	postID *int64
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		lastID:     map[string]int64{},
+		users:      map[int64]*memUser{},
+		twoFactor:  map[string]bool{},
+		apiKeys:    map[int64]*memAPIKey{},
+		categories: map[int64]Category{},
+		posts:      map[int64]Post{},
+		comments:   map[int64]Comment{},
+		images:     map[int64]memImage{},
+		deletedAt:  map[trashKey]time.Time{},
+	}
+}
+
+func (s *MemoryStore) authParams() *auth.AuthParams {
+	return BlogModel{Params: s.Params}.authParams()
+}
+
+func (s *MemoryStore) nextID(table string) int64 {
+	s.lastID[table]++
+	return s.lastID[table]
+}
+
+// sortedIDs returns the keys of a table in insertion order.
+func sortedIDs(n int, each func(func(int64))) []int64 {
+	ids := make([]int64, 0, n)
+	each(func(id int64) { ids = append(ids, id) })
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (s *MemoryStore) postIDs() []int64 {
+	return sortedIDs(len(s.posts), func(f func(int64)) {
+		for id := range s.posts {
+			f(id)
+		}
+	})
+}
+
+func (s *MemoryStore) commentIDs() []int64 {
+	return sortedIDs(len(s.comments), func(f func(int64)) {
+		for id := range s.comments {
+			f(id)
+		}
+	})
+}
+
+func (s *MemoryStore) trashed(table string, id int64) bool {
+	_, ok := s.deletedAt[trashKey{table, id}]
+	return ok
+}
+
+// AddImage stores an image, attached to a post unless postID is nil, and
+// returns its id. The server has no endpoint for images yet, so tests use
+// this to set up avatars.
+func (s *MemoryStore) AddImage(url string, postID *int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if postID != nil {
+		if _, ok := s.posts[*postID]; !ok {
+			return 0, fmt.Errorf("image: post %d does not exist", *postID)
+		}
+	}
+	id := s.nextID("image")
+	s.images[id] = memImage{url: url, postID: postID}
+	return id, nil
+}
+
+// Posts
+
+func (s *MemoryStore) selectPosts(match func(Post) bool) []Post {
+	var posts []Post
+	for _, id := range s.postIDs() {
+		if p := s.posts[id]; !s.trashed("post", id) && match(p) {
+			posts = append(posts, p)
+		}
+	}
+	return s.withAuthors(posts)
+}
+
+func (s *MemoryStore) withAuthors(posts []Post) []Post {
+	for i := range posts {
+		if u, ok := s.users[posts[i].UserID]; ok {
+			a := s.summary(u)
+			posts[i].Author = &a
+		}
+	}
+	return posts
+}
+
+func (s *MemoryStore) AllPosts(ctx context.Context) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.selectPosts(func(Post) bool { return true }), nil
+}
+
+func (s *MemoryStore) AllPostsByCatID(ctx context.Context, categoryid int) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.selectPosts(func(p Post) bool { return p.CategoryID == int64(categoryid) }), nil
+}
+
+func (s *MemoryStore) AllPostsByCatSlug(ctx context.Context, slug string) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var categoryID int64
+	for _, c := range s.categories {
+		if c.Slug == slug && !s.trashed("category", c.CategoryID) {
+			categoryID = c.CategoryID
+		}
+	}
+	return s.selectPosts(func(p Post) bool { return p.CategoryID == categoryID }), nil
+}
+
+func (s *MemoryStore) PostById(ctx context.Context, id int) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.selectPosts(func(p Post) bool { return p.PostID == int64(id) }), nil
+}
+
+func (s *MemoryStore) PostBySlug(ctx context.Context, slug string) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.selectPosts(func(p Post) bool { return p.Slug == slug }), nil
+}
+
+func (s *MemoryStore) PostsByAuthor(ctx context.Context, username string) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userByUsername(username)
+	if u == nil {
+		return []Post{}, nil
+	}
+	posts := s.selectPosts(func(p Post) bool { return p.UserID == u.UserID })
+	sort.SliceStable(posts, func(i, j int) bool { return posts[i].DateTime.After(posts[j].DateTime) })
+	if posts == nil {
+		posts = []Post{}
+	}
+	return posts, nil
+}
+
+// checkPost enforces the foreign keys of the post table.
+func (s *MemoryStore) checkPost(p Post) error {
+	if _, ok := s.users[p.UserID]; !ok {
+		return fmt.Errorf("post: user %d does not exist", p.UserID)
+	}
+	if _, ok := s.categories[p.CategoryID]; !ok {
+		return fmt.Errorf("post: category %d does not exist", p.CategoryID)
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddPost(ctx context.Context, p Post) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.Slug == "" {
+		p.Slug = Slugify(p.Title)
+	}
+	if err := s.checkPost(p); err != nil {
+		return 0, err
+	}
+	p.PostID = s.nextID("post")
+	p.Author = nil
+	s.posts[p.PostID] = p
+	return p.PostID, nil
+}
+
+func (s *MemoryStore) ImportPosts(ctx context.Context, posts []Post, mode ImportMode) ([]ImportResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := newImportResults(len(posts))
+	now := time.Now()
+	for i := range posts {
+		posts[i].checkImport(&results[i], now)
+		if _, ok := s.users[posts[i].UserID]; !ok {
+			results[i].Fail("user_id", "no such user")
+		}
+		if _, ok := s.categories[posts[i].CategoryID]; !ok || s.trashed("category", posts[i].CategoryID) {
+			results[i].Fail("category_id", ErrCategoryNotFound.Error())
+		}
+	}
+	if settle(results, mode) {
+		for i, p := range posts {
+			if results[i].Status == ImportCreated {
+				p.PostID = s.nextID("post")
+				p.Author = nil
+				s.posts[p.PostID] = p
+				results[i].ID = p.PostID
+			}
+		}
+	}
+	return results, nil
+}
+
+func (s *MemoryStore) UpdatePost(ctx context.Context, id int, update func(p *Post) error) (Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.posts[int64(id)]
+	if !ok || s.trashed("post", int64(id)) {
+		return Post{}, sql.ErrNoRows
+	}
+	if err := update(&p); err != nil {
+		return Post{}, err
+	}
+	p.PostID, p.Author = int64(id), nil
+	if p.Slug == "" {
+		p.Slug = Slugify(p.Title)
+	}
+	problems := p.problems()
+	if _, ok := s.users[p.UserID]; !ok {
+		problems.add("user_id", "no such user")
+	}
+	if _, ok := s.categories[p.CategoryID]; !ok || s.trashed("category", p.CategoryID) {
+		problems.add("category_id", ErrCategoryNotFound.Error())
+	}
+	if len(problems) > 0 {
+		return Post{}, problems
+	}
+	s.posts[p.PostID] = p
+	return s.withAuthors([]Post{p})[0], nil
+}
+
+func (s *MemoryStore) DelPost(ctx context.Context, postid int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.posts[int64(postid)]; !ok || s.trashed("post", int64(postid)) {
+		return false, nil
+	}
+	now := time.Now()
+	s.deletedAt[trashKey{"post", int64(postid)}] = now
+	for id, c := range s.comments {
+		if c.PostID == int64(postid) && !s.trashed("comment", id) {
+			s.deletedAt[trashKey{"comment", id}] = now
+		}
+	}
+	return true, nil
+}
+
+// Categories
+
+func (s *MemoryStore) AllCategories(ctx context.Context) ([]Category, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := sortedIDs(len(s.categories), func(f func(int64)) {
+		for id := range s.categories {
+			f(id)
+		}
+	})
+	var categories []Category
+	for _, id := range ids {
+		if !s.trashed("category", id) {
+			categories = append(categories, s.categories[id])
+		}
+	}
+	return categories, nil
+}
+
+func (s *MemoryStore) CategoryByID(ctx context.Context, id int) (Category, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.categories[int64(id)]
+	if !ok || s.trashed("category", int64(id)) {
+		return Category{}, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (s *MemoryStore) GetCatNameByID(ctx context.Context, id int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.trashed("category", int64(id)) {
+		return "", nil
+	}
+	return s.categories[int64(id)].CategoryName, nil
+}
+
+func (s *MemoryStore) GetCatIDByName(ctx context.Context, name string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.categories {
+		if c.CategoryName == name && !s.trashed("category", c.CategoryID) {
+			return int(c.CategoryID), nil
+		}
+	}
+	return -1, nil
+}
+
+func (s *MemoryStore) AddCategory(ctx context.Context, c Category) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.Slug == "" {
+		c.Slug = Slugify(c.CategoryName)
+	}
+	c.CategoryID = s.nextID("category")
+	s.categories[c.CategoryID] = c
+	return c.CategoryID, nil
+}
+
+func (s *MemoryStore) ImportCategories(ctx context.Context, categories []Category, mode ImportMode) ([]ImportResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := newImportResults(len(categories))
+	for i := range categories {
+		categories[i].checkImport(&results[i])
+	}
+	if settle(results, mode) {
+		for i, c := range categories {
+			if results[i].Status == ImportCreated {
+				c.CategoryID = s.nextID("category")
+				s.categories[c.CategoryID] = c
+				results[i].ID = c.CategoryID
+			}
+		}
+	}
+	return results, nil
+}
+
+func (s *MemoryStore) UpdateCategory(ctx context.Context, id int, update func(c *Category) error) (Category, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.categories[int64(id)]
+	if !ok || s.trashed("category", int64(id)) {
+		return Category{}, sql.ErrNoRows
+	}
+	if err := update(&c); err != nil {
+		return Category{}, err
+	}
+	c.CategoryID = int64(id)
+	if c.Slug == "" {
+		c.Slug = Slugify(c.CategoryName)
+	}
+	if problems := c.problems(); len(problems) > 0 {
+		return Category{}, problems
+	}
+	s.categories[c.CategoryID] = c
+	return c, nil
+}
+
+func (s *MemoryStore) DeleteCategory(ctx context.Context, categoryId int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.posts {
+		if p.CategoryID == int64(categoryId) && !s.trashed("post", p.PostID) {
+			return false, ErrCategoryInUse
+		}
+	}
+	return s.trash("category", int64(categoryId)), nil
+}
+
+func (s *MemoryStore) MergeCategories(ctx context.Context, into int, from []int) (ReassignResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range from {
+		if id == into {
+			return ReassignResult{}, ErrMergeIntoItself
+		}
+	}
+	for _, id := range append([]int{into}, from...) {
+		if _, ok := s.categories[int64(id)]; !ok || s.trashed("category", int64(id)) {
+			return ReassignResult{}, fmt.Errorf("category %d: %w", id, ErrCategoryNotFound)
+		}
+	}
+	res := ReassignResult{To: int64(into), Deleted: []int64{}}
+	merged := map[int64]bool{}
+	for _, id := range from {
+		if !merged[int64(id)] {
+			merged[int64(id)] = true
+			res.Deleted = append(res.Deleted, int64(id))
+		}
+	}
+	for id, p := range s.posts {
+		if merged[p.CategoryID] {
+			p.CategoryID = int64(into)
+			s.posts[id] = p
+			res.PostsMoved++
+		}
+	}
+	for _, id := range res.Deleted {
+		s.trash("category", id)
+	}
+	return res, nil
+}
+
+// Comments
+
+func (s *MemoryStore) selectComments(match func(Comment) bool) []Comment {
+	var comments []Comment
+	for _, id := range s.commentIDs() {
+		if c := s.comments[id]; !s.trashed("comment", id) && match(c) {
+			comments = append(comments, c)
+		}
+	}
+	return comments
+}
+
+func (s *MemoryStore) AllComments(ctx context.Context) ([]Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.selectComments(func(Comment) bool { return true }), nil
+}
+
+func (s *MemoryStore) CommentByID(ctx context.Context, id int) (Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.comments[int64(id)]
+	if !ok || s.trashed("comment", int64(id)) {
+		return Comment{}, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (s *MemoryStore) CommentsByPost(ctx context.Context, postID int) ([]Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Comment{}, s.selectComments(func(c Comment) bool { return c.PostID == int64(postID) })...), nil
+}
+
+func (s *MemoryStore) CommentsByUser(ctx context.Context, userID int64) ([]Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Comment{}, s.selectComments(func(c Comment) bool { return c.UserID == userID })...), nil
+}
+
+func (s *MemoryStore) AddComment(ctx context.Context, c Comment) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[c.UserID]; !ok {
+		return 0, fmt.Errorf("comment: user %d does not exist", c.UserID)
+	}
+	if _, ok := s.posts[c.PostID]; !ok {
+		return 0, fmt.Errorf("comment: post %d does not exist", c.PostID)
+	}
+	c.CommentID = s.nextID("comment")
+	s.comments[c.CommentID] = c
+	return c.CommentID, nil
+}
+
+func (s *MemoryStore) ImportComments(ctx context.Context, comments []Comment, mode ImportMode) ([]ImportResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := newImportResults(len(comments))
+	for i := range comments {
+		comments[i].checkImport(&results[i])
+		if _, ok := s.users[comments[i].UserID]; !ok {
+			results[i].Fail("user_id", "no such user")
+		}
+		if _, ok := s.posts[comments[i].PostID]; !ok || s.trashed("post", comments[i].PostID) {
+			results[i].Fail("post_id", "no such post")
+		}
+	}
+	if settle(results, mode) {
+		for i, c := range comments {
+			if results[i].Status == ImportCreated {
+				c.CommentID = s.nextID("comment")
+				s.comments[c.CommentID] = c
+				results[i].ID = c.CommentID
+			}
+		}
+	}
+	return results, nil
+}
+
+func (s *MemoryStore) UpdateComment(ctx context.Context, id int, update func(c *Comment) error) (Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.comments[int64(id)]
+	if !ok || s.trashed("comment", int64(id)) {
+		return Comment{}, sql.ErrNoRows
+	}
+	postID := c.PostID
+	if err := update(&c); err != nil {
+		return Comment{}, err
+	}
+	c.CommentID, c.PostID = int64(id), postID
+	problems := c.problems()
+	if _, ok := s.users[c.UserID]; !ok {
+		problems.add("user_id", "no such user")
+	}
+	if len(problems) > 0 {
+		return Comment{}, problems
+	}
+	s.comments[c.CommentID] = c
+	return c, nil
+}
+
+func (s *MemoryStore) DelComment(ctx context.Context, commentid int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.trash("comment", int64(commentid)), nil
+}
+
+// Users
+
+func (s *MemoryStore) userByUsername(username string) *memUser {
+	for _, u := range s.users {
+		if strings.EqualFold(u.Username, username) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) userByEmail(email string) *memUser {
+	for _, u := range s.users {
+		if u.Email != "" && strings.EqualFold(u.Email, email) {
+			return u
+		}
+	}
+	return nil
+}
+
+// checkUnique enforces the case insensitive unique indexes on username and
+// email, ignoring the user with id self.
+func (s *MemoryStore) checkUnique(self int64, username, email string) error {
+	if u := s.userByUsername(username); u != nil && u.UserID != self {
+		return ErrDuplicateUsername
+	}
+	if u := s.userByEmail(email); email != "" && u != nil && u.UserID != self {
+		return ErrDuplicateEmail
+	}
+	return nil
+}
+
+func (s *MemoryStore) insertUser(u User, password *string) (*memUser, error) {
+	if err := s.checkUnique(0, u.Username, u.Email); err != nil {
+		return nil, err
+	}
+	u.UserID = s.nextID("users")
+	u.TwoFactor = false
+	mu := &memUser{User: u, password: password}
+	s.users[u.UserID] = mu
+	return mu, nil
+}
+
+func (s *MemoryStore) Register(ctx context.Context, u User) (bool, error) {
+	if ReservedUsername(u.Username) {
+		return false, ErrDuplicateUsername
+	}
+	encodedHash, err := auth.GenerateFromPassword(u.Password, s.authParams())
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u.Disabled, u.EmailVerified = false, false
+	if _, err := s.insertUser(u, &encodedHash); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) Login(ctx context.Context, lc auth.LoginCredentials) (User, bool, error) {
+	s.mu.Lock()
+	u := s.userByUsername(lc.Identifier())
+	if u == nil {
+		u = s.userByEmail(lc.Identifier())
+	}
+	if u == nil || u.Disabled || u.password == nil {
+		s.mu.Unlock()
+		return User{}, false, nil
+	}
+	user, hash := u.User, *u.password
+	s.mu.Unlock()
+
+	ok, err := auth.ComparePasswordAndHash(lc.Password, hash)
+	if err != nil || !ok {
+		return User{}, false, err
+	}
+	s.rehashIfNeeded(user.UserID, lc.Password, hash)
+	return user, true, nil
+}
+
+func (s *MemoryStore) rehashIfNeeded(userID int64, password, oldHash string) {
+	p := s.authParams()
+	stale, err := auth.NeedsRehash(oldHash, p)
+	if err != nil || !stale {
+		return
+	}
+	newHash, err := auth.GenerateFromPassword(password, p)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[userID]; ok && u.password != nil && *u.password == oldHash {
+		u.password = &newHash
+	}
+}
+
+func (s *MemoryStore) UserByUsername(ctx context.Context, username string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userByUsername(username)
+	if u == nil {
+		return User{}, ErrUserNotFound
+	}
+	return u.User, nil
+}
+
+func (s *MemoryStore) UserByEmail(ctx context.Context, email string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userByEmail(email)
+	if u == nil {
+		return User{}, ErrUserNotFound
+	}
+	return u.User, nil
+}
+
+func (s *MemoryStore) UserByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.identities {
+		if id.Provider == provider && id.Subject == subject {
+			if u, ok := s.users[id.userID]; ok {
+				return u.User, nil
+			}
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (s *MemoryStore) linkIdentity(userID int64, id ExternalIdentity) error {
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("user_identities: user %d does not exist", userID)
+	}
+	for _, existing := range s.identities {
+		if existing.Provider == id.Provider && existing.Subject == id.Subject {
+			return fmt.Errorf("user_identities: %s account %s is already linked", id.Provider, id.Subject)
+		}
+	}
+	s.identities = append(s.identities, memIdentity{userID: userID, ExportedIdentity: ExportedIdentity{
+		Provider:  id.Provider,
+		Subject:   id.Subject,
+		Email:     id.Email,
+		CreatedAt: time.Now(),
+	}})
+	return nil
+}
+
+func (s *MemoryStore) LinkIdentity(ctx context.Context, userID int64, id ExternalIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.linkIdentity(userID, id)
+}
+
+func (s *MemoryStore) CreateExternalUser(ctx context.Context, u User, id ExternalIdentity) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	base := strings.ToLower(u.Username)
+	if base == "" || ReservedUsername(base) {
+		base = "user"
+	}
+	u.IsGuest, u.IsSuperuser, u.Disabled = false, false, false
+	u.EmailVerified = u.Email != ""
+	for n := 0; n < 5; n++ {
+		u.Username = base
+		if n > 0 {
+			u.Username = fmt.Sprintf("%s%d", base, s.lastID["users"]+int64(n))
+		}
+		created, err := s.insertUser(u, nil)
+		if err == ErrDuplicateUsername {
+			continue
+		}
+		if err != nil {
+			return User{}, err
+		}
+		if err := s.linkIdentity(created.UserID, id); err != nil {
+			return User{}, err
+		}
+		return created.User, nil
+	}
+	return User{}, ErrDuplicateUsername
+}
+
+func (s *MemoryStore) IdentitiesForUser(ctx context.Context, userID int64) ([]ExportedIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []ExportedIdentity{}
+	for _, id := range s.identities {
+		if id.userID == userID {
+			ids = append(ids, id.ExportedIdentity)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) CheckPassword(ctx context.Context, userID int64, password string) (bool, error) {
+	s.mu.Lock()
+	u, ok := s.users[userID]
+	if !ok {
+		s.mu.Unlock()
+		return false, ErrUserNotFound
+	}
+	if u.password == nil {
+		s.mu.Unlock()
+		return false, ErrNoPassword
+	}
+	hash := *u.password
+	s.mu.Unlock()
+
+	ok, err := auth.ComparePasswordAndHash(password, hash)
+	if err != nil || !ok {
+		return false, err
+	}
+	s.rehashIfNeeded(userID, password, hash)
+	return true, nil
+}
+
+func (s *MemoryStore) SetPassword(ctx context.Context, username, password string) error {
+	encodedHash, err := auth.GenerateFromPassword(password, s.authParams())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userByUsername(username)
+	if u == nil {
+		return ErrUserNotFound
+	}
+	u.password = &encodedHash
+	return nil
+}
+
+func (s *MemoryStore) UpdateName(ctx context.Context, userID int64, firstName, lastName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.FirstName, u.LastName = firstName, lastName
+	return nil
+}
+
+func (s *MemoryStore) SetEmail(ctx context.Context, userID int64, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if err := s.checkUnique(userID, u.Username, email); err != nil {
+		return err
+	}
+	u.Email, u.EmailVerified = email, true
+	return nil
+}
+
+func (s *MemoryStore) RemoveAccount(ctx context.Context, userID int64, policy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if u.IsSuperuser {
+		return ErrSuperuserDeletion
+	}
+	if policy != DeletionAnonymize && policy != DeletionDelete {
+		return fmt.Errorf("unknown account deletion policy %q", policy)
+	}
+	s.dropCredentials(userID)
+
+	if policy == DeletionAnonymize {
+		*u = memUser{User: User{
+			UserID:      userID,
+			IsGuest:     u.IsGuest,
+			IsSuperuser: u.IsSuperuser,
+			Username:    fmt.Sprintf("deleted-%d", userID),
+			Disabled:    true,
+		}}
+		return nil
+	}
+	placeholder := s.userByUsername(DeletedUsername)
+	if placeholder == nil {
+		placeholder, _ = s.insertUser(User{IsGuest: true, Username: DeletedUsername}, nil)
+		placeholder.Disabled = true
+	}
+	for id, p := range s.posts {
+		if p.UserID == userID {
+			p.UserID = placeholder.UserID
+			s.posts[id] = p
+		}
+	}
+	for id, c := range s.comments {
+		if c.UserID == userID {
+			c.UserID = placeholder.UserID
+			s.comments[id] = c
+		}
+	}
+	delete(s.users, userID)
+	return nil
+}
+
+// dropCredentials removes the API keys, linked identities and recovery codes
+// of userID.
+func (s *MemoryStore) dropCredentials(userID int64) {
+	for id, k := range s.apiKeys {
+		if k.UserID == userID {
+			delete(s.apiKeys, id)
+		}
+	}
+	identities := s.identities[:0]
+	for _, id := range s.identities {
+		if id.userID != userID {
+			identities = append(identities, id)
+		}
+	}
+	s.identities = identities
+	s.dropRecoveryCodes(userID)
+}
+
+func (s *MemoryStore) dropRecoveryCodes(userID int64) {
+	codes := s.recovery[:0]
+	for _, c := range s.recovery {
+		if c.userID != userID {
+			codes = append(codes, c)
+		}
+	}
+	s.recovery = codes
+}
+
+// Two-factor authentication
+
+func (s *MemoryStore) TOTPSecret(ctx context.Context, userID int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return "", ErrUserNotFound
+	}
+	if u.totpSecret == nil {
+		return "", ErrNoTOTPSecret
+	}
+	return *u.totpSecret, nil
+}
+
+func (s *MemoryStore) SetTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.totpSecret, u.TwoFactor, u.totpLastStep = &secret, false, nil
+	return nil
+}
+
+func (s *MemoryStore) EnableTOTP(ctx context.Context, userID int64, recoveryHashes []string) error {
+	s.mu.Lock()
+	u, ok := s.users[userID]
+	if !ok || u.totpSecret == nil {
+		s.mu.Unlock()
+		return ErrUserNotFound
+	}
+	u.TwoFactor = true
+	s.mu.Unlock()
+	return s.ReplaceRecoveryCodes(ctx, userID, recoveryHashes)
+}
+
+func (s *MemoryStore) DisableTOTP(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.totpSecret, u.TwoFactor, u.totpLastStep = nil, false, nil
+	s.dropRecoveryCodes(userID)
+	return nil
+}
+
+func (s *MemoryStore) UseTOTPStep(ctx context.Context, userID, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok || (u.totpLastStep != nil && *u.totpLastStep >= step) {
+		return false, nil
+	}
+	u.totpLastStep = &step
+	return true, nil
+}
+
+func (s *MemoryStore) ReplaceRecoveryCodes(ctx context.Context, userID int64, hashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("recovery_codes: user %d does not exist", userID)
+	}
+	s.dropRecoveryCodes(userID)
+	for _, hash := range hashes {
+		s.recovery = append(s.recovery, memRecoveryCode{userID: userID, hash: hash})
+	}
+	return nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(ctx context.Context, userID int64, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range s.recovery {
+		if c.userID == userID && c.hash == hash && !c.used {
+			s.recovery[i].used = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) TwoFactorRequired(ctx context.Context, role string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.twoFactor[role], nil
+}
+
+func (s *MemoryStore) TwoFactorPolicy(ctx context.Context) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policy := map[string]bool{}
+	for role, required := range s.twoFactor {
+		policy[role] = required
+	}
+	return policy, nil
+}
+
+func (s *MemoryStore) SetTwoFactorRequired(ctx context.Context, role string, required bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.twoFactor[role] = required
+	return nil
+}
+
+// API keys
+
+func (k *memAPIKey) copy() APIKey {
+	c := k.APIKey
+	c.Scopes = append([]string{}, k.Scopes...)
+	return c
+}
+
+func (s *MemoryStore) AddAPIKey(ctx context.Context, k APIKey, hash string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[k.UserID]; !ok {
+		return APIKey{}, fmt.Errorf("api_keys: user %d does not exist", k.UserID)
+	}
+	for _, existing := range s.apiKeys {
+		if existing.hash == hash {
+			return APIKey{}, fmt.Errorf("api_keys: duplicate key hash")
+		}
+	}
+	k.ID = s.nextID("api_keys")
+	k.CreatedAt = time.Now()
+	k.LastUsedAt = nil
+	stored := &memAPIKey{APIKey: k, hash: hash}
+	stored.Scopes = append([]string{}, k.Scopes...)
+	s.apiKeys[k.ID] = stored
+	return stored.copy(), nil
+}
+
+func (s *MemoryStore) APIKeysForUser(ctx context.Context, userID int64) ([]APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := sortedIDs(len(s.apiKeys), func(f func(int64)) {
+		for id := range s.apiKeys {
+			f(id)
+		}
+	})
+	keys := []APIKey{}
+	for _, id := range ids {
+		if k := s.apiKeys[id]; k.UserID == userID && !k.revoked {
+			keys = append(keys, k.copy())
+		}
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) APIKeyByHash(ctx context.Context, hash string) (APIKey, User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.apiKeys {
+		if k.hash == hash && !k.revoked {
+			u := s.users[k.UserID]
+			return k.copy(), User{UserID: u.UserID, Username: u.Username, Disabled: u.Disabled}, nil
+		}
+	}
+	return APIKey{}, User{}, ErrAPIKeyNotFound
+}
+
+func (s *MemoryStore) TouchAPIKey(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.apiKeys[id]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if k.LastUsedAt == nil || k.LastUsedAt.Before(now.Add(-time.Minute)) {
+		k.LastUsedAt = &now
+	}
+	return nil
+}
+
+func (s *MemoryStore) RevokeAPIKey(ctx context.Context, userID, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.apiKeys[id]
+	if !ok || k.UserID != userID || k.revoked {
+		return ErrAPIKeyNotFound
+	}
+	k.revoked = true
+	return nil
+}
+
+// Authors
+
+func (s *MemoryStore) summary(u *memUser) AuthorSummary {
+	a := AuthorSummary{Username: u.Username, FirstName: u.FirstName, LastName: u.LastName}
+	if u.avatarID != nil {
+		a.AvatarURL = s.images[*u.avatarID].url
+	}
+	return a
+}
+
+func (s *MemoryStore) author(u *memUser) Author {
+	a := Author{
+		AuthorSummary: s.summary(u),
+		Bio:           u.bio,
+		Website:       u.website,
+		SocialLinks:   map[string]string{},
+	}
+	if u.avatarID != nil {
+		id := *u.avatarID
+		a.AvatarImageID = &id
+	}
+	for network, link := range u.socialLinks {
+		a.SocialLinks[network] = link
+	}
+	for _, p := range s.posts {
+		if p.UserID == u.UserID && !s.trashed("post", p.PostID) {
+			a.PostCount++
+		}
+	}
+	return a
+}
+
+func (s *MemoryStore) Authors(ctx context.Context) ([]Author, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authors := []Author{}
+	for _, u := range s.users {
+		if a := s.author(u); !u.Disabled && a.PostCount > 0 {
+			authors = append(authors, a)
+		}
+	}
+	sort.Slice(authors, func(i, j int) bool {
+		return strings.ToLower(authors[i].Username) < strings.ToLower(authors[j].Username)
+	})
+	return authors, nil
+}
+
+func (s *MemoryStore) AuthorByUsername(ctx context.Context, username string) (Author, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userByUsername(username)
+	if u == nil || u.Disabled {
+		return Author{}, ErrUserNotFound
+	}
+	return s.author(u), nil
+}
+
+func (s *MemoryStore) AuthorByUserID(ctx context.Context, userID int64) (Author, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return Author{}, ErrUserNotFound
+	}
+	return s.author(u), nil
+}
+
+func (s *MemoryStore) UpdateAuthorProfile(ctx context.Context, userID int64, p AuthorProfile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if p.AvatarImageID != nil {
+		if _, ok := s.images[*p.AvatarImageID]; !ok {
+			return fmt.Errorf("users: image %d does not exist", *p.AvatarImageID)
+		}
+		id := *p.AvatarImageID
+		p.AvatarImageID = &id
+	}
+	u.bio, u.avatarID, u.website = p.Bio, p.AvatarImageID, p.Website
+	u.socialLinks = map[string]string{}
+	for network, link := range p.SocialLinks {
+		u.socialLinks[network] = link
+	}
+	return nil
+}
+
+func (s *MemoryStore) ImageExists(ctx context.Context, id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.images[id]
+	return ok, nil
+}
+
+func (s *MemoryStore) ImagesForUser(ctx context.Context, userID int64) ([]ExportedImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	images := []ExportedImage{}
+	u, ok := s.users[userID]
+	if !ok {
+		return images, nil
+	}
+	ids := sortedIDs(len(s.images), func(f func(int64)) {
+		for id := range s.images {
+			f(id)
+		}
+	})
+	for _, id := range ids {
+		img := s.images[id]
+		avatar := u.avatarID != nil && *u.avatarID == id
+		ownPost := img.postID != nil && s.posts[*img.postID].UserID == userID
+		if !avatar && !ownPost {
+			continue
+		}
+		e := ExportedImage{ID: id, URL: img.url, Avatar: avatar}
+		if img.postID != nil {
+			postID := *img.postID
+			e.PostID = &postID
+		}
+		images = append(images, e)
+	}
+	return images, nil
+}
+
+// Audit log
+
+func (s *MemoryStore) AddAuditEntry(ctx context.Context, e AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.ID = s.nextID("audit_log")
+	e.CreatedAt = time.Now()
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+func (s *MemoryStore) AuditEntries(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := []AuditEntry{}
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		e := s.audit[i]
+		switch {
+		case f.Actor != "" && e.Actor != f.Actor,
+			f.Action != "" && e.Action != f.Action,
+			f.TargetType != "" && e.TargetType != f.TargetType,
+			f.TargetID != "" && e.TargetID != f.TargetID,
+			!f.Since.IsZero() && e.CreatedAt.Before(f.Since),
+			!f.Until.IsZero() && !e.CreatedAt.Before(f.Until):
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if f.Offset >= len(entries) {
+		return []AuditEntry{}, nil
+	}
+	entries = entries[f.Offset:]
+	if f.Limit > 0 && f.Limit < len(entries) {
+		entries = entries[:f.Limit]
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) AuditEntriesByActor(ctx context.Context, username string) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := []AuditEntry{}
+	for _, e := range s.audit {
+		if e.Actor == username {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) PruneAuditLog(ctx context.Context, cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.audit[:0]
+	for _, e := range s.audit {
+		if !e.CreatedAt.Before(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	n := int64(len(s.audit) - len(kept))
+	s.audit = kept
+	return n, nil
+}
+
+// Trash
+
+// trash moves a category, post or comment to the trash unless it is there
+// already, and reports whether it did.
+func (s *MemoryStore) trash(table string, id int64) bool {
+	var ok bool
+	switch table {
+	case "category":
+		_, ok = s.categories[id]
+	case "post":
+		_, ok = s.posts[id]
+	case "comment":
+		_, ok = s.comments[id]
+	}
+	if !ok || s.trashed(table, id) {
+		return false
+	}
+	s.deletedAt[trashKey{table, id}] = time.Now()
+	return true
+}
+
+// inTrash returns the ids of a table in the trash, most recently deleted
+// first.
+func (s *MemoryStore) inTrash(table string) []int64 {
+	var ids []int64
+	for k := range s.deletedAt {
+		if k.table == table {
+			ids = append(ids, k.id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := s.deletedAt[trashKey{table, ids[i]}], s.deletedAt[trashKey{table, ids[j]}]
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+func (s *MemoryStore) Trash(ctx context.Context) (Trash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := Trash{Categories: []TrashedCategory{}, Posts: []TrashedPost{}, Comments: []TrashedComment{}}
+	for _, id := range s.inTrash("category") {
+		t.Categories = append(t.Categories, TrashedCategory{s.categories[id], s.deletedAt[trashKey{"category", id}]})
+	}
+	for _, id := range s.inTrash("post") {
+		p := s.withAuthors([]Post{s.posts[id]})[0]
+		t.Posts = append(t.Posts, TrashedPost{p, s.deletedAt[trashKey{"post", id}]})
+	}
+	for _, id := range s.inTrash("comment") {
+		t.Comments = append(t.Comments, TrashedComment{s.comments[id], s.deletedAt[trashKey{"comment", id}]})
+	}
+	return t, nil
+}
+
+func (s *MemoryStore) restore(table string, id int64) error {
+	if !s.trashed(table, id) {
+		return ErrNotInTrash
+	}
+	delete(s.deletedAt, trashKey{table, id})
+	return nil
+}
+
+func (s *MemoryStore) RestoreCategory(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.restore("category", int64(id))
+}
+
+func (s *MemoryStore) RestorePost(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.posts[int64(id)]
+	if !ok {
+		return ErrNotInTrash
+	}
+	if s.trashed("category", p.CategoryID) {
+		return ErrParentInTrash
+	}
+	deletedAt, ok := s.deletedAt[trashKey{"post", p.PostID}]
+	if !ok {
+		return ErrNotInTrash
+	}
+	for cid, c := range s.comments {
+		if at, ok := s.deletedAt[trashKey{"comment", cid}]; ok && c.PostID == p.PostID && at.Equal(deletedAt) {
+			delete(s.deletedAt, trashKey{"comment", cid})
+		}
+	}
+	return s.restore("post", p.PostID)
+}
+
+func (s *MemoryStore) RestoreComment(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.comments[int64(id)]
+	if !ok {
+		return ErrNotInTrash
+	}
+	if s.trashed("post", c.PostID) {
+		return ErrParentInTrash
+	}
+	return s.restore("comment", c.CommentID)
+}
+
+func (s *MemoryStore) PurgeTrash(ctx context.Context, cutoff time.Time) (PurgeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := func(table string, id int64) bool {
+		at, ok := s.deletedAt[trashKey{table, id}]
+		return ok && at.Before(cutoff)
+	}
+	var res PurgeResult
+	for id, c := range s.comments {
+		if expired("comment", id) || expired("post", c.PostID) {
+			delete(s.comments, id)
+			delete(s.deletedAt, trashKey{"comment", id})
+			res.Comments++
+		}
+	}
+	for id, img := range s.images {
+		if img.postID != nil && expired("post", *img.postID) {
+			delete(s.images, id)
+			res.Images++
+			for _, u := range s.users {
+				if u.avatarID != nil && *u.avatarID == id {
+					u.avatarID = nil
+				}
+			}
+		}
+	}
+	for id := range s.posts {
+		if expired("post", id) {
+			delete(s.posts, id)
+			delete(s.deletedAt, trashKey{"post", id})
+			res.Posts++
+		}
+	}
+	for id := range s.categories {
+		if !expired("category", id) {
+			continue
+		}
+		inUse := false
+		for _, p := range s.posts {
+			inUse = inUse || p.CategoryID == id
+		}
+		if !inUse {
+			delete(s.categories, id)
+			delete(s.deletedAt, trashKey{"category", id})
+			res.Categories++
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"techblogapi/auth"
+)
+
+func TestLoginRehashesPassword(t *testing.T) {
+	weak := auth.AuthParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	stronger := weak
+	stronger.Memory, stronger.Iterations = 2048, 2
+
+	s := NewMemoryStore()
+	s.Params = &weak
+	ctx := context.Background()
+	if _, err := s.Register(ctx, User{Username: "alice", Email: "alice@example.com", Password: "correct horse battery staple"}); err != nil {
+		t.Fatal(err)
+	}
+	hash := func() string {
+		t.Helper()
+		u, err := s.UserByUsername(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *s.users[u.UserID].password
+	}
+	login := func(password string) bool {
+		t.Helper()
+		_, ok, err := s.Login(ctx, auth.LoginCredentials{Username: "alice", Password: password})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	// Nothing changes while the parameters are current
+	before := hash()
+	if !login("correct horse battery staple") || hash() != before {
+		t.Fatal("login with current parameters changed the hash")
+	}
+
+	// A failed login leaves the old hash alone, a successful one upgrades it
+	s.Params = &stronger
+	if login("wrong password") || hash() != before {
+		t.Fatal("failed login changed the hash")
+	}
+	if !login("correct horse battery staple") {
+		t.Fatal("login failed after changing the parameters")
+	}
+	after := hash()
+	if stale, err := auth.NeedsRehash(after, &stronger); err != nil || stale {
+		t.Errorf("hash after login = %q, want it to use the new parameters (%v)", after, err)
+	}
+	if !login("correct horse battery staple") {
+		t.Error("login failed with the rehashed password")
+	}
+}
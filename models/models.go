@@ -1,8 +1,10 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log"
 	"techblogapi/auth"
 	"time"
 )
@@ -10,16 +12,35 @@ import (
 // Create customer BlogModel type which wraps the sql.DB connection pool
 type BlogModel struct {
 	DB *sql.DB
+	// Params are the Argon2id parameters for new password hashes. Nil means
+	// auth.DefaultAuthParams.
+	Params *auth.AuthParams
+	// Timeouts bound each call on top of the caller's context
+	Timeouts Timeouts
+}
+
+func (m BlogModel) authParams() *auth.AuthParams {
+	if m.Params != nil {
+		return m.Params
+	}
+	p := auth.DefaultAuthParams
+	return &p
 }
 
 type User struct {
+	UserID      int64  `json:"user_id,omitempty" db:"id"`
 	IsGuest     bool   `json:"is_guest" db:"is_guest"`
 	IsSuperuser bool   `json:"is_superuser" db:"is_superuser"`
 	Username    string `json:"username" db:"username"`
 	FirstName   string `json:"firstname" db:"firstname"`
 	LastName    string `json:"lastname" db:"lastname"`
 	Email       string `json:"email" db:"email"`
-	Password    string `json:"password" db:"password"`
+	// EmailVerified is set once the user proved they read mail sent to Email,
+	// or an identity provider vouched for it. Registering doesn't.
+	EmailVerified bool   `json:"email_verified" db:"email_verified"`
+	Password      string `json:"-" db:"password"`
+	Disabled      bool   `json:"disabled" db:"disabled"`
+	TwoFactor     bool   `json:"two_factor" db:"totp_enabled"`
 }
 
 type Category struct {
@@ -37,6 +58,9 @@ type Post struct {
 	Message    string    `json:"message" db:"message"`
 	ReadTime   int64     `json:"read_time" db:"read_time"`
 	DateTime   time.Time `json:"date_time" db:"datetime"`
+
+	// Author is filled in when posts are read, it isn't stored with the post
+	Author *AuthorSummary `json:"author,omitempty" db:"-"`
 }
 
 type Comment struct {
@@ -46,325 +70,438 @@ type Comment struct {
 	PostID    int64  `json:"post_id" db:"post_id"`
 }
 
-// Use a method on the custom BlogModel type to run the SQL query.
-func (m BlogModel) AllCategories() ([]Category, error) {
-	rows, err := m.DB.Query("SELECT * FROM category")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var categories []Category
-	for rows.Next() {
-		var category Category
-		err := rows.Scan(&category.CategoryID, &category.CategoryName, &category.Slug)
-		if err != nil {
-			return nil, err
-		}
-		categories = append(categories, category)
-	}
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-	return categories, nil
+// The columns read for each model, in the order its scan function expects
+// them, followed by any extra columns the query selected. Post slugs and read
+// times predate their NOT NULL constraints. The columns are qualified for
+// queries joining other tables.
+const (
+	categoryColumns = "category.id, category.category_name, category.slug"
+	postColumns     = "post.id, post.user_id, post.category_id, COALESCE(post.slug, ''), post.title, post.message, COALESCE(post.read_time, 0), post.datetime"
+	commentColumns  = "comment.id, comment.user_id, comment.message, comment.post_id"
+)
+
+func scanCategory(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Category, error) {
+	var c Category
+	err := row.Scan(append([]interface{}{&c.CategoryID, &c.CategoryName, &c.Slug}, extra...)...)
+	return c, err
 }
 
-func (m BlogModel) GetCatNameByID(id int) (string, error) {
-	category := Category{}
-	rows, err := m.DB.Query("SELECT category_name FROM category WHERE id = $1", id)
-	if err != nil {
-		fmt.Println(err)
-		return "", err
-	}
-	for rows.Next() {
-		err := rows.Scan(&category.CategoryName)
-		if err != nil {
-			fmt.Println(err)
-			return "", err
-		}
-	}
-	return category.CategoryName, nil
+func scanPost(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Post, error) {
+	var p Post
+	err := row.Scan(append([]interface{}{&p.PostID, &p.UserID, &p.CategoryID, &p.Slug, &p.Title, &p.Message, &p.ReadTime, &p.DateTime}, extra...)...)
+	return p, err
 }
 
-func (m BlogModel) GetCatIDByName(name string) (int, error) {
-	id := -1
-	rows, err := m.DB.Query("SELECT id FROM category WHERE category_name = $1", name)
-	if err != nil {
-		fmt.Println(err)
-		return id, err
-	}
-	for rows.Next() {
-		err := rows.Scan(&id)
-		if err != nil {
-			fmt.Println(err)
-			return id, err
-		}
-	}
-	return id, nil
+func scanComment(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Comment, error) {
+	var c Comment
+	err := row.Scan(append([]interface{}{&c.CommentID, &c.UserID, &c.Message, &c.PostID}, extra...)...)
+	return c, err
 }
 
-func (m BlogModel) AllPosts() ([]Post, error) {
-	rows, err := m.DB.Query("SELECT * FROM post")
+// queryPosts runs a query selecting postColumns and returns the posts with
+// their authors.
+func (m BlogModel) queryPosts(ctx context.Context, query string, args ...interface{}) ([]Post, error) {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var posts []Post
+	posts := []Post{}
 	for rows.Next() {
-		var post Post
-		err := rows.Scan(&post.PostID, &post.UserID, &post.CategoryID, &post.Title, &post.ReadTime, &post.DateTime, &post.Message, &post.Slug)
+		post, err := scanPost(rows)
 		if err != nil {
 			return nil, err
 		}
 		posts = append(posts, post)
 	}
-	// fmt.Println("posts ", posts)
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return posts, nil
+	return m.withAuthors(ctx, posts)
 }
 
-func (m BlogModel) AllPostsByCatID(categoryid int) ([]Post, error) {
-	rows, err := m.DB.Query("SELECT * from post WHERE category_id = $1", categoryid)
+// queryComments runs a query selecting commentColumns.
+func (m BlogModel) queryComments(ctx context.Context, query string, args ...interface{}) ([]Comment, error) {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var posts []Post
+	comments := []Comment{}
 	for rows.Next() {
-		var post Post
-		err := rows.Scan(&post.PostID, &post.UserID, &post.CategoryID, &post.Title, &post.ReadTime, &post.DateTime, &post.Message, &post.Slug)
+		c, err := scanComment(rows)
 		if err != nil {
 			return nil, err
 		}
-		posts = append(posts, post)
+		comments = append(comments, c)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return posts, nil
+	return comments, nil
 }
 
-func (m BlogModel) AllPostsByCatSlug(slug string) ([]Post, error) {
-	rows, err := m.DB.Query("SELECT id FROM category WHERE slug = $1", slug)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	categoryId := 0
-	for rows.Next() {
-		err := rows.Scan(&categoryId)
-		if err != nil {
-			return nil, err
-		}
-	}
-	rows, err = m.DB.Query("SELECT * FROM post WHERE category_id = $1", categoryId)
+// Use a method on the custom BlogModel type to run the SQL query.
+func (m BlogModel) AllCategories(ctx context.Context) ([]Category, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, "SELECT "+categoryColumns+" FROM category WHERE deleted_at IS NULL")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var posts []Post
+	var categories []Category
 	for rows.Next() {
-		var post Post
-		err := rows.Scan(&post.PostID, &post.UserID, &post.CategoryID, &post.Title, &post.ReadTime, &post.DateTime, &post.Message, &post.Slug)
+		category, err := scanCategory(rows)
 		if err != nil {
 			return nil, err
 		}
-		posts = append(posts, post)
+		categories = append(categories, category)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return posts, nil
+	return categories, nil
 }
 
-func (m BlogModel) PostById(id int) ([]Post, error) {
-	rows, err := m.DB.Query("SELECT * FROM post WHERE id = $1", id)
+func (m BlogModel) GetCatNameByID(ctx context.Context, id int) (string, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	category := Category{}
+	rows, err := m.DB.QueryContext(ctx, "SELECT category_name FROM category WHERE id = $1 AND deleted_at IS NULL", id)
 	if err != nil {
-		return nil, err
+		fmt.Println(err)
+		return "", err
 	}
-	defer rows.Close()
-	var posts []Post
 	for rows.Next() {
-		var post Post
-		err := rows.Scan(&post.PostID, &post.UserID, &post.CategoryID, &post.Title, &post.ReadTime, &post.DateTime, &post.Message, &post.Slug)
+		err := rows.Scan(&category.CategoryName)
 		if err != nil {
-			return nil, err
+			fmt.Println(err)
+			return "", err
 		}
-		posts = append(posts, post)
 	}
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-	return posts, nil
+	return category.CategoryName, nil
 }
 
-func (m BlogModel) PostBySlug(slug string) ([]Post, error) {
-	rows, err := m.DB.Query("SELECT * FROM post WHERE slug = $1", slug)
+func (m BlogModel) GetCatIDByName(ctx context.Context, name string) (int, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	id := -1
+	rows, err := m.DB.QueryContext(ctx, "SELECT id FROM category WHERE category_name = $1 AND deleted_at IS NULL", name)
 	if err != nil {
-		return nil, err
+		fmt.Println(err)
+		return id, err
 	}
-	defer rows.Close()
-	var posts []Post
 	for rows.Next() {
-		var post Post
-		err := rows.Scan(&post.PostID, &post.UserID, &post.CategoryID, &post.Title, &post.ReadTime, &post.DateTime, &post.Message, &post.Slug)
+		err := rows.Scan(&id)
 		if err != nil {
-			return nil, err
+			fmt.Println(err)
+			return id, err
 		}
-		posts = append(posts, post)
-		fmt.Println("posts adding ", posts)
 	}
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-	fmt.Println("added posts ", posts)
-	return posts, nil
+	return id, nil
 }
 
-func (m BlogModel) Register(u User) (bool, error) {
-	// Auth Params
-	p := &auth.AuthParams{
-		Memory:      64 * 1024,
-		Iterations:  3,
-		Parallelism: 2,
-		SaltLength:  16,
-		KeyLength:   32,
-	}
+func (m BlogModel) AllPosts(ctx context.Context) ([]Post, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return m.queryPosts(ctx, "SELECT "+postColumns+" FROM post WHERE deleted_at IS NULL")
+}
 
+func (m BlogModel) AllPostsByCatID(ctx context.Context, categoryid int) ([]Post, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return m.queryPosts(ctx, "SELECT "+postColumns+" FROM post WHERE category_id = $1 AND deleted_at IS NULL", categoryid)
+}
+
+func (m BlogModel) AllPostsByCatSlug(ctx context.Context, slug string) ([]Post, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return m.queryPosts(ctx, "SELECT "+postColumns+" FROM post JOIN category ON category.id = post.category_id WHERE category.slug = $1 AND category.deleted_at IS NULL AND post.deleted_at IS NULL", slug)
+}
+
+func (m BlogModel) PostById(ctx context.Context, id int) ([]Post, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return m.queryPosts(ctx, "SELECT "+postColumns+" FROM post WHERE id = $1 AND deleted_at IS NULL", id)
+}
+
+func (m BlogModel) PostBySlug(ctx context.Context, slug string) ([]Post, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return m.queryPosts(ctx, "SELECT "+postColumns+" FROM post WHERE slug = $1 AND deleted_at IS NULL", slug)
+}
+
+func (m BlogModel) Register(ctx context.Context, u User) (bool, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	if ReservedUsername(u.Username) {
+		return false, ErrDuplicateUsername
+	}
 	// Generate Hash for Password
-	encodedHash, err := auth.GenerateFromPassword(u.Password, p)
+	encodedHash, err := auth.GenerateFromPassword(u.Password, m.authParams())
 	if err != nil {
 		return false, err
 	}
-	_, err = m.DB.Exec("INSERT INTO users (is_guest, is_superuser, username, firstname, lastname, email, password) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+	_, err = m.DB.ExecContext(ctx, "INSERT INTO users (is_guest, is_superuser, username, firstname, lastname, email, password) VALUES ($1, $2, $3, $4, $5, $6, $7)",
 		u.IsGuest,
 		u.IsSuperuser,
 		u.Username,
 		u.FirstName,
 		u.LastName,
-		u.Email,
+		nullIfEmpty(u.Email),
 		encodedHash)
 
 	if err != nil {
-		return false, err
+		return false, duplicateUserError(err)
 	}
 	return true, nil
 }
 
-func (m BlogModel) Login(lc auth.LoginCredentials) (bool, error) {
-	var password string
-	row := m.DB.QueryRow("SELECT password FROM users WHERE username = $1", lc.Username)
-	if err := row.Scan(&password); err != nil {
+// Login checks lc against the stored password hash. The identifier in lc can
+// be either the username or the email address, both compared without case.
+// The matched user is returned so callers can use the canonical username.
+func (m BlogModel) Login(ctx context.Context, lc auth.LoginCredentials) (User, bool, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	var password sql.NullString
+	// Prefer a username match in case someone registered another user's
+	// email address as their username
+	row := m.DB.QueryRowContext(ctx, "SELECT "+userColumns+", password FROM users WHERE LOWER(username) = LOWER($1) OR LOWER(email) = LOWER($1) ORDER BY LOWER(username) = LOWER($1) DESC LIMIT 1", lc.Identifier())
+	u, err := scanUser(row, &password)
+	if err != nil {
 		if err == sql.ErrNoRows {
-			return false, err
+			// Unknown usernames are a failed login, not a server error
+			return User{}, false, nil
 		}
-		return false, err
+		return User{}, false, err
+	}
+	// Disabled accounts and accounts without a password can't log in this way
+	if u.Disabled || !password.Valid {
+		return User{}, false, nil
 	}
-	validCreds, err := auth.ComparePasswordAndHash(lc.Password, password)
+	validCreds, err := auth.ComparePasswordAndHash(lc.Password, password.String)
 	if err != nil {
-		return false, err
+		return User{}, false, err
 	}
-	return validCreds, nil
+	if !validCreds {
+		return User{}, false, nil
+	}
+	m.rehashIfNeeded(ctx, u.UserID, lc.Password, password.String)
+	return u, true, nil
 }
 
-func (m BlogModel) AddCategory(c Category) (bool, error) {
-	_, err := m.DB.Exec("INSERT INTO category(category_name) VALUES($1)", c.CategoryName)
+// rehashIfNeeded upgrades a verified password hash that was made with older
+// Argon2id parameters. Failures are only logged, the login itself succeeded.
+func (m BlogModel) rehashIfNeeded(ctx context.Context, userID int64, password, oldHash string) {
+	p := m.authParams()
+	stale, err := auth.NeedsRehash(oldHash, p)
+	if err != nil || !stale {
+		return
+	}
+	newHash, err := auth.GenerateFromPassword(password, p)
 	if err != nil {
-		return false, err
+		log.Print(err)
+		return
 	}
-	return true, nil
-}
-
-func (m BlogModel) PutCategory(categoryId int, newCategoryName string) (bool, error) {
-	fmt.Println("categoryId ", categoryId)
-	fmt.Println("newCategoryName ", newCategoryName)
-	_, err := m.DB.Exec("UPDATE category SET category_name = $1 WHERE id = $2", newCategoryName, categoryId)
+	// Only replace the hash we verified, in case the password changed meanwhile
+	_, err = m.DB.ExecContext(ctx, "UPDATE users SET password = $1 WHERE id = $2 AND password = $3", newHash, userID, oldHash)
 	if err != nil {
-		return false, err
+		log.Print(err)
 	}
-	return true, nil
 }
 
-func (m BlogModel) DeleteCategory(categoryId int) (bool, error) {
-	_, err := m.DB.Exec("DELETE FROM category WHERE id = $1", categoryId)
-	if err != nil {
-		return false, err
-	}
-	return true, nil
+func (m BlogModel) AddCategory(ctx context.Context, c Category) (int64, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	if c.Slug == "" {
+		c.Slug = Slugify(c.CategoryName)
+	}
+	var id int64
+	err := m.DB.QueryRowContext(ctx, "INSERT INTO category(category_name, slug) VALUES($1, $2) RETURNING id", c.CategoryName, c.Slug).Scan(&id)
+	return id, err
 }
 
-func (m BlogModel) AddPost(p Post) (bool, error) {
-	fmt.Println(p.UserID, p.CategoryID, p.Title, p.Slug, p.ReadTime, p.DateTime, p.Message)
-	_, err := m.DB.Exec("INSERT INTO post (user_id, category_id, title, slug, read_time, datetime, message) VALUES($1, $2, $3, $4, $5, $6, $7)",
-		p.UserID, p.CategoryID, p.Title, p.Slug, p.ReadTime, p.DateTime, p.Message)
+// UpdateCategory changes the category with update, which is passed the
+// stored category, and returns the result. It returns sql.ErrNoRows if there
+// is no such category, what update returns if that fails, and a
+// ValidationError if the result can't be stored. An empty slug is made from
+// the name. The category stays locked meanwhile, so concurrent updates don't
+// undo each other.
+func (m BlogModel) UpdateCategory(ctx context.Context, id int, update func(c *Category) error) (Category, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var c Category
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		c, err = scanCategory(tx.QueryRowContext(ctx, "SELECT "+categoryColumns+" FROM category WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id))
+		if err != nil {
+			return err
+		}
+		if err := update(&c); err != nil {
+			return err
+		}
+		c.CategoryID = int64(id)
+		if c.Slug == "" {
+			c.Slug = Slugify(c.CategoryName)
+		}
+		if problems := c.problems(); len(problems) > 0 {
+			return problems
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE category SET category_name = $1, slug = $2 WHERE id = $3", c.CategoryName, c.Slug, id)
+		return err
+	})
 	if err != nil {
-		fmt.Println("err ", err)
-		return false, err
+		return Category{}, err
 	}
-	return true, nil
+	return c, nil
 }
 
-func (m BlogModel) PutPost(postid int, p Post) (bool, error) {
-	_, err := m.DB.Exec("UPDATE post SET user_id = $1, category_id = $2, title = $3, slug = $4, read_time = $5, datetime = $6, message = $7 WHERE id = $8",
-		p.UserID, p.CategoryID, p.Title, p.Slug, p.ReadTime, p.DateTime, p.Message, postid)
+func (m BlogModel) DeleteCategory(ctx context.Context, categoryId int) (bool, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var deleted bool
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		var inUse bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM post WHERE category_id = $1 AND deleted_at IS NULL)", categoryId).Scan(&inUse)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return ErrCategoryInUse
+		}
+		deleted, err = trash(ctx, tx, "category", int64(categoryId))
+		return err
+	})
 	if err != nil {
 		return false, err
 	}
-	return true, nil
+	return deleted, nil
 }
 
-func (m BlogModel) DelPost(postid int) (bool, error) {
-	_, err := m.DB.Exec("DELETE FROM post WHERE id = $1", postid)
-	if err != nil {
-		return false, err
-	}
-	return true, nil
+func (m BlogModel) AddPost(ctx context.Context, p Post) (int64, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	if p.Slug == "" {
+		p.Slug = Slugify(p.Title)
+	}
+	var id int64
+	err := m.DB.QueryRowContext(ctx, "INSERT INTO post (user_id, category_id, title, slug, read_time, datetime, message) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		p.UserID, p.CategoryID, p.Title, p.Slug, p.ReadTime, p.DateTime, p.Message).Scan(&id)
+	return id, err
 }
 
-func (m BlogModel) AllComments() ([]Comment, error) {
-	rows, err := m.DB.Query("SELECT * FROM comment")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var comments []Comment
-	for rows.Next() {
-		var comment Comment
-		err := rows.Scan(&comment.CommentID, &comment.UserID, &comment.PostID, &comment.Message)
+// UpdatePost changes the post with update like UpdateCategory does, and also
+// checks that its author and category exist.
+func (m BlogModel) UpdatePost(ctx context.Context, id int, update func(p *Post) error) (Post, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var p Post
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		p, err = scanPost(tx.QueryRowContext(ctx, "SELECT "+postColumns+" FROM post WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id))
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := update(&p); err != nil {
+			return err
+		}
+		p.PostID, p.Author = int64(id), nil
+		if p.Slug == "" {
+			p.Slug = Slugify(p.Title)
 		}
-		comments = append(comments, comment)
+		problems := p.problems()
+		if err := checkRef(ctx, tx, problems, "user_id", lockUsers, p.UserID, "no such user"); err != nil {
+			return err
+		}
+		if err := checkRef(ctx, tx, problems, "category_id", lockCategories, p.CategoryID, ErrCategoryNotFound.Error()); err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return problems
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE post SET user_id = $1, category_id = $2, title = $3, slug = $4, read_time = $5, datetime = $6, message = $7 WHERE id = $8",
+			p.UserID, p.CategoryID, p.Title, p.Slug, p.ReadTime, p.DateTime, p.Message, id)
+		return err
+	})
+	if err != nil {
+		return Post{}, err
 	}
-	if err = rows.Err(); err != nil {
-		return nil, err
+	posts, err := m.withAuthors(ctx, []Post{p})
+	if err != nil {
+		return Post{}, err
 	}
-	return comments, nil
+	return posts[0], nil
 }
 
-func (m BlogModel) AddComment(c Comment) (bool, error) {
-	_, err := m.DB.Exec("INSERT INTO comment(user_id, post_id, message) VALUES($1, $2, $3)", c.UserID, c.PostID, c.Message)
+func (m BlogModel) DelPost(ctx context.Context, postid int) (bool, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var deleted bool
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if deleted, err = trash(ctx, tx, "post", int64(postid)); err != nil || !deleted {
+			return err
+		}
+		// The comments go with the post, and come back with it
+		_, err = tx.ExecContext(ctx, "UPDATE comment SET deleted_at = (SELECT deleted_at FROM post WHERE id = $1) WHERE post_id = $1 AND deleted_at IS NULL", postid)
+		return err
+	})
 	if err != nil {
-		fmt.Println(err)
 		return false, err
 	}
-	return true, nil
+	return deleted, nil
 }
 
-func (m BlogModel) PutComment(postid int, c Comment) (bool, error) {
-	_, err := m.DB.Exec("UPDATE comment SET user_id = $1, message = $2 WHERE post_id = $3",
-		c.UserID, c.Message, postid)
-	if err != nil {
-		return false, err
-	}
-	return true, nil
+func (m BlogModel) AllComments(ctx context.Context) ([]Comment, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	return m.queryComments(ctx, "SELECT "+commentColumns+" FROM comment WHERE deleted_at IS NULL")
 }
 
-func (m BlogModel) DelComment(commentid int) (bool, error) {
-	_, err := m.DB.Exec("DELETE FROM comment WHERE id = $1", commentid)
+func (m BlogModel) AddComment(ctx context.Context, c Comment) (int64, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var id int64
+	err := m.DB.QueryRowContext(ctx, "INSERT INTO comment(user_id, post_id, message) VALUES($1, $2, $3) RETURNING id", c.UserID, c.PostID, c.Message).Scan(&id)
+	return id, err
+}
+
+// UpdateComment changes the comment with update like UpdateCategory does,
+// and also checks that its author exists. A comment stays on its post.
+func (m BlogModel) UpdateComment(ctx context.Context, id int, update func(c *Comment) error) (Comment, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var c Comment
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		c, err = scanComment(tx.QueryRowContext(ctx, "SELECT "+commentColumns+" FROM comment WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id))
+		if err != nil {
+			return err
+		}
+		postID := c.PostID
+		if err := update(&c); err != nil {
+			return err
+		}
+		c.CommentID, c.PostID = int64(id), postID
+		problems := c.problems()
+		if err := checkRef(ctx, tx, problems, "user_id", lockUsers, c.UserID, "no such user"); err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return problems
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE comment SET user_id = $1, message = $2 WHERE id = $3", c.UserID, c.Message, id)
+		return err
+	})
 	if err != nil {
-		return false, err
+		return Comment{}, err
 	}
-	return true, nil
+	return c, nil
+}
+
+func (m BlogModel) DelComment(ctx context.Context, commentid int) (bool, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return trash(ctx, m.DB, "comment", int64(commentid))
 }
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"techblogapi/auth"
+)
+
+// ErrNoPassword means the account signs in without a password, through an
+// identity provider or magic links.
+var ErrNoPassword = errors.New("account has no password")
+
+// PublicUser is what anyone may see of a user.
+type PublicUser struct {
+	Username  string `json:"username"`
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+}
+
+// Public returns the parts of u that are safe to show to other people.
+func (u User) Public() PublicUser {
+	return PublicUser{Username: u.Username, FirstName: u.FirstName, LastName: u.LastName}
+}
+
+// CheckPassword reports whether password is the password of userID. It
+// returns ErrNoPassword for accounts that don't have one.
+func (m BlogModel) CheckPassword(ctx context.Context, userID int64, password string) (bool, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	var hash sql.NullString
+	err := m.DB.QueryRowContext(ctx, "SELECT password FROM users WHERE id = $1", userID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, ErrUserNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	if !hash.Valid {
+		return false, ErrNoPassword
+	}
+	ok, err := auth.ComparePasswordAndHash(password, hash.String)
+	if err != nil || !ok {
+		return false, err
+	}
+	m.rehashIfNeeded(ctx, userID, password, hash.String)
+	return true, nil
+}
+
+// UpdateName changes the first and last name of userID.
+func (m BlogModel) UpdateName(ctx context.Context, userID int64, firstName, lastName string) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return updateUser(ctx, m.DB, "UPDATE users SET firstname = $1, lastname = $2 WHERE id = $3", firstName, lastName, userID)
+}
+
+// SetEmail changes the email address of userID and marks it verified.
+// Callers verify the address first.
+func (m BlogModel) SetEmail(ctx context.Context, userID int64, email string) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	err := updateUser(ctx, m.DB, "UPDATE users SET email = $1, email_verified = TRUE WHERE id = $2", nullIfEmpty(email), userID)
+	return duplicateUserError(err)
+}
@@ -0,0 +1,228 @@
+package models
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type rowScanner = interface{ Scan(...interface{}) error }
+
+// mappings are the column lists read into each model, with the function
+// scanning them.
+var mappings = []struct {
+	table   string
+	columns string
+	model   interface{}
+	scan    func(row rowScanner) (interface{}, error)
+	// unselected are fields that are stored but read separately, if at all
+	unselected []string
+}{
+	{"users", userColumns, User{}, func(row rowScanner) (interface{}, error) { return scanUser(row) }, []string{"password"}},
+	{"category", categoryColumns, Category{}, func(row rowScanner) (interface{}, error) { return scanCategory(row) }, nil},
+	{"post", postColumns, Post{}, func(row rowScanner) (interface{}, error) { return scanPost(row) }, nil},
+	{"comment", commentColumns, Comment{}, func(row rowScanner) (interface{}, error) { return scanComment(row) }, nil},
+	{"api_keys", apiKeyColumns, APIKey{}, func(row rowScanner) (interface{}, error) { return scanAPIKey(row) }, nil},
+	{"audit_log", auditColumns, AuditEntry{}, func(row rowScanner) (interface{}, error) { return scanAuditEntry(row) }, nil},
+}
+
+var (
+	createTable = regexp.MustCompile(`(?i)^CREATE TABLE (?:IF NOT EXISTS )?(\w+)\s*\(`)
+	addColumn   = regexp.MustCompile(`(?i)^ALTER TABLE (\w+) ADD COLUMN (?:IF NOT EXISTS )?(\w+)`)
+	dropColumn  = regexp.MustCompile(`(?i)^ALTER TABLE (\w+) DROP COLUMN (?:IF EXISTS )?(\w+)`)
+	renameCol   = regexp.MustCompile(`(?i)^ALTER TABLE (\w+) RENAME COLUMN (\w+) TO (\w+)`)
+	columnName  = regexp.MustCompile(`^(?:COALESCE\()?(?:\w+\.)?(\w+)`)
+)
+
+// schema replays the table definitions in sql/create.sql and returns the
+// columns each table ends up with.
+func schema(t *testing.T) map[string]map[string]bool {
+	t.Helper()
+	f, err := os.Open("../sql/create.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tables := map[string]map[string]bool{}
+	var table string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if table != "" {
+			if strings.HasPrefix(line, ")") {
+				table = ""
+				continue
+			}
+			name := strings.Fields(line)[0]
+			switch strings.ToUpper(name) {
+			case "CONSTRAINT", "PRIMARY", "UNIQUE", "FOREIGN", "CHECK":
+			default:
+				tables[table][name] = true
+			}
+			continue
+		}
+		if m := createTable.FindStringSubmatch(line); m != nil {
+			table = m[1]
+			tables[table] = map[string]bool{}
+		} else if m := addColumn.FindStringSubmatch(line); m != nil {
+			tables[m[1]][m[2]] = true
+		} else if m := dropColumn.FindStringSubmatch(line); m != nil {
+			delete(tables[m[1]], m[2])
+		} else if m := renameCol.FindStringSubmatch(line); m != nil {
+			delete(tables[m[1]], m[2])
+			tables[m[1]][m[3]] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return tables
+}
+
+// columnNames returns the column each expression in a column list reads.
+func columnNames(t *testing.T, columns string) []string {
+	t.Helper()
+	var names []string
+	depth, start := 0, 0
+	for i, r := range columns + "," {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth > 0 {
+				continue
+			}
+			expr := strings.TrimSpace(columns[start:i])
+			m := columnName.FindStringSubmatch(expr)
+			if m == nil {
+				t.Fatalf("can't tell which column %q reads", expr)
+			}
+			names = append(names, m[1])
+			start = i + 1
+		}
+	}
+	return names
+}
+
+// dbFields returns the db tags of a model's fields, leaving out the ones
+// that aren't stored.
+func dbFields(model interface{}) []string {
+	typ := reflect.TypeOf(model)
+	var tags []string
+	for i := 0; i < typ.NumField(); i++ {
+		if tag := typ.Field(i).Tag.Get("db"); tag != "" && tag != "-" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func TestColumnsMatchSchema(t *testing.T) {
+	tables := schema(t)
+	for _, m := range mappings {
+		t.Run(m.table, func(t *testing.T) {
+			columns, ok := tables[m.table]
+			if !ok {
+				t.Fatalf("no table %s in sql/create.sql", m.table)
+			}
+			selected := map[string]bool{}
+			for _, name := range columnNames(t, m.columns) {
+				if !columns[name] {
+					t.Errorf("column list reads %s, which %s doesn't have", name, m.table)
+				}
+				selected[name] = true
+			}
+			for _, name := range m.unselected {
+				selected[name] = true
+			}
+			for _, tag := range dbFields(m.model) {
+				if !columns[tag] {
+					t.Errorf("%T field %s has no column in %s", m.model, tag, m.table)
+				}
+				if !selected[tag] {
+					t.Errorf("%T field %s isn't in the column list", m.model, tag)
+				}
+			}
+		})
+	}
+}
+
+// markRow is a row that sets one column and leaves the others zero.
+type markRow struct {
+	columns int
+	mark    int
+}
+
+func (r markRow) Scan(dest ...interface{}) error {
+	if len(dest) != r.columns {
+		return fmt.Errorf("scanned %d columns, the column list has %d", len(dest), r.columns)
+	}
+	switch d := dest[r.mark].(type) {
+	case *string:
+		*d = "x"
+	case *int64:
+		*d = 1
+	case *bool:
+		*d = true
+	case *time.Time:
+		*d = time.Unix(1, 0)
+	case *[]byte:
+		*d = []byte(`{"x": 1}`)
+	case *sql.NullTime:
+		return d.Scan(time.Unix(1, 0))
+	case *sql.NullInt64:
+		return d.Scan(int64(1))
+	case *sql.NullString:
+		return d.Scan("x")
+	case sql.Scanner:
+		// Postgres arrays
+		return d.Scan([]byte("{x}"))
+	default:
+		return fmt.Errorf("can't set a %T", d)
+	}
+	return nil
+}
+
+// TestScanOrder checks each column in a list ends up in the field tagged
+// with its name.
+func TestScanOrder(t *testing.T) {
+	for _, m := range mappings {
+		t.Run(m.table, func(t *testing.T) {
+			names := columnNames(t, m.columns)
+			for i, name := range names {
+				v, err := m.scan(markRow{columns: len(names), mark: i})
+				if err != nil {
+					t.Fatalf("scanning %s: %v", name, err)
+				}
+				var set []string
+				rv := reflect.ValueOf(v)
+				for j := 0; j < rv.NumField(); j++ {
+					tag := rv.Type().Field(j).Tag.Get("db")
+					if tag == "" || tag == "-" || isEmpty(rv.Field(j)) {
+						continue
+					}
+					set = append(set, tag)
+				}
+				if len(set) != 1 || set[0] != name {
+					t.Errorf("column %s was scanned into %v", name, set)
+				}
+			}
+		})
+	}
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
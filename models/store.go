@@ -0,0 +1,122 @@
+package models
+
+import (
+	"context"
+	"techblogapi/auth"
+	"time"
+)
+
+// PostStore reads and writes posts.
+type PostStore interface {
+	AllPosts(ctx context.Context) ([]Post, error)
+	AllPostsByCatID(ctx context.Context, categoryid int) ([]Post, error)
+	AllPostsByCatSlug(ctx context.Context, slug string) ([]Post, error)
+	PostById(ctx context.Context, id int) ([]Post, error)
+	PostBySlug(ctx context.Context, slug string) ([]Post, error)
+	PostsByAuthor(ctx context.Context, username string) ([]Post, error)
+	AddPost(ctx context.Context, p Post) (int64, error)
+	ImportPosts(ctx context.Context, posts []Post, mode ImportMode) ([]ImportResult, error)
+	UpdatePost(ctx context.Context, id int, update func(p *Post) error) (Post, error)
+	DelPost(ctx context.Context, postid int) (bool, error)
+}
+
+// CategoryStore reads and writes categories.
+type CategoryStore interface {
+	AllCategories(ctx context.Context) ([]Category, error)
+	CategoryByID(ctx context.Context, id int) (Category, error)
+	GetCatNameByID(ctx context.Context, id int) (string, error)
+	GetCatIDByName(ctx context.Context, name string) (int, error)
+	AddCategory(ctx context.Context, c Category) (int64, error)
+	ImportCategories(ctx context.Context, categories []Category, mode ImportMode) ([]ImportResult, error)
+	UpdateCategory(ctx context.Context, id int, update func(c *Category) error) (Category, error)
+	DeleteCategory(ctx context.Context, categoryId int) (bool, error)
+	MergeCategories(ctx context.Context, into int, from []int) (ReassignResult, error)
+}
+
+// CommentStore reads and writes comments.
+type CommentStore interface {
+	AllComments(ctx context.Context) ([]Comment, error)
+	CommentByID(ctx context.Context, id int) (Comment, error)
+	CommentsByPost(ctx context.Context, postID int) ([]Comment, error)
+	CommentsByUser(ctx context.Context, userID int64) ([]Comment, error)
+	AddComment(ctx context.Context, c Comment) (int64, error)
+	ImportComments(ctx context.Context, comments []Comment, mode ImportMode) ([]ImportResult, error)
+	UpdateComment(ctx context.Context, id int, update func(c *Comment) error) (Comment, error)
+	DelComment(ctx context.Context, commentid int) (bool, error)
+}
+
+// TrashStore keeps the deleted categories, posts and comments until they are
+// restored or purged.
+type TrashStore interface {
+	Trash(ctx context.Context) (Trash, error)
+	RestoreCategory(ctx context.Context, id int) error
+	RestorePost(ctx context.Context, id int) error
+	RestoreComment(ctx context.Context, id int) error
+	PurgeTrash(ctx context.Context, cutoff time.Time) (PurgeResult, error)
+}
+
+// UserStore holds accounts with everything that hangs off them: credentials,
+// two-factor settings, linked identities, API keys and author profiles.
+type UserStore interface {
+	Register(ctx context.Context, u User) (bool, error)
+	Login(ctx context.Context, lc auth.LoginCredentials) (User, bool, error)
+	UserByUsername(ctx context.Context, username string) (User, error)
+	UserByEmail(ctx context.Context, email string) (User, error)
+	UserByIdentity(ctx context.Context, provider, subject string) (User, error)
+	CreateExternalUser(ctx context.Context, u User, id ExternalIdentity) (User, error)
+	LinkIdentity(ctx context.Context, userID int64, id ExternalIdentity) error
+	IdentitiesForUser(ctx context.Context, userID int64) ([]ExportedIdentity, error)
+	CheckPassword(ctx context.Context, userID int64, password string) (bool, error)
+	SetPassword(ctx context.Context, username, password string) error
+	UpdateName(ctx context.Context, userID int64, firstName, lastName string) error
+	SetEmail(ctx context.Context, userID int64, email string) error
+	RemoveAccount(ctx context.Context, userID int64, policy string) error
+
+	TOTPSecret(ctx context.Context, userID int64) (string, error)
+	SetTOTPSecret(ctx context.Context, userID int64, secret string) error
+	EnableTOTP(ctx context.Context, userID int64, recoveryHashes []string) error
+	DisableTOTP(ctx context.Context, userID int64) error
+	UseTOTPStep(ctx context.Context, userID, step int64) (bool, error)
+	ReplaceRecoveryCodes(ctx context.Context, userID int64, hashes []string) error
+	UseRecoveryCode(ctx context.Context, userID int64, hash string) (bool, error)
+	TwoFactorRequired(ctx context.Context, role string) (bool, error)
+	TwoFactorPolicy(ctx context.Context) (map[string]bool, error)
+	SetTwoFactorRequired(ctx context.Context, role string, required bool) error
+
+	AddAPIKey(ctx context.Context, k APIKey, hash string) (APIKey, error)
+	APIKeysForUser(ctx context.Context, userID int64) ([]APIKey, error)
+	APIKeyByHash(ctx context.Context, hash string) (APIKey, User, error)
+	TouchAPIKey(ctx context.Context, id int64) error
+	RevokeAPIKey(ctx context.Context, userID, id int64) error
+
+	Authors(ctx context.Context) ([]Author, error)
+	AuthorByUsername(ctx context.Context, username string) (Author, error)
+	AuthorByUserID(ctx context.Context, userID int64) (Author, error)
+	UpdateAuthorProfile(ctx context.Context, userID int64, p AuthorProfile) error
+	ImageExists(ctx context.Context, id int64) (bool, error)
+	ImagesForUser(ctx context.Context, userID int64) ([]ExportedImage, error)
+}
+
+// AuditStore keeps the audit log.
+type AuditStore interface {
+	AddAuditEntry(ctx context.Context, e AuditEntry) error
+	AuditEntries(ctx context.Context, f AuditFilter) ([]AuditEntry, error)
+	AuditEntriesByActor(ctx context.Context, username string) ([]AuditEntry, error)
+	PruneAuditLog(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// Store is everything the server keeps in the database. BlogModel implements
+// it on PostgreSQL and MemoryStore in memory.
+type Store interface {
+	PostStore
+	CategoryStore
+	CommentStore
+	TrashStore
+	UserStore
+	AuditStore
+}
+
+var (
+	_ Store = BlogModel{}
+	_ Store = (*MemoryStore)(nil)
+)
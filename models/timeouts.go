@@ -0,0 +1,43 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Timeouts limit how long a single BlogModel call may run. Zero means no
+// limit beyond the caller's context, which is what the admin commands use.
+type Timeouts struct {
+	Read  time.Duration // lookups and listings
+	Write time.Duration // inserts, updates and deletes
+}
+
+func (m BlogModel) readContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, m.Timeouts.Read)
+}
+
+func (m BlogModel) writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, m.Timeouts.Write)
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// IsTimeout reports whether err comes from a call that ran out of time,
+// either before reaching the database or because PostgreSQL canceled the
+// statement when the deadline passed.
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var pqErr *pq.Error
+	// query_canceled, which is what lib/pq's cancel request produces
+	return errors.As(err, &pqErr) && pqErr.Code == "57014"
+}
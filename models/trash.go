@@ -0,0 +1,230 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNotInTrash    = errors.New("not in the trash")
+	ErrCategoryInUse = errors.New("category still has posts")
+	ErrParentInTrash = errors.New("restore the category or post it belongs to first")
+)
+
+// Trash lists what is in the trash, most recently deleted first.
+type Trash struct {
+	Categories []TrashedCategory `json:"categories"`
+	Posts      []TrashedPost     `json:"posts"`
+	Comments   []TrashedComment  `json:"comments"`
+}
+
+type TrashedCategory struct {
+	Category
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type TrashedPost struct {
+	Post
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type TrashedComment struct {
+	Comment
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// PurgeResult counts the rows a purge deleted.
+type PurgeResult struct {
+	Categories int64 `json:"categories"`
+	Posts      int64 `json:"posts"`
+	Comments   int64 `json:"comments"`
+	Images     int64 `json:"images"`
+}
+
+// trash moves a row of table to the trash by setting its deleted_at. Every
+// query but the ones in this file leaves such rows out, and PurgeTrash
+// deletes them for good later. Rows already in the trash keep their deletion
+// time. It reports whether the row was moved, false if there is no such row
+// or it already was in the trash.
+func trash(ctx context.Context, q querier, table string, id int64) (bool, error) {
+	res, err := q.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL", table), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Trash returns everything in the trash.
+func (m BlogModel) Trash(ctx context.Context) (Trash, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	t := Trash{Categories: []TrashedCategory{}, Posts: []TrashedPost{}, Comments: []TrashedComment{}}
+	rows, err := m.DB.QueryContext(ctx, "SELECT "+categoryColumns+", deleted_at FROM category WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id")
+	if err != nil {
+		return Trash{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c TrashedCategory
+		if c.Category, err = scanCategory(rows, &c.DeletedAt); err != nil {
+			return Trash{}, err
+		}
+		t.Categories = append(t.Categories, c)
+	}
+	if err = rows.Err(); err != nil {
+		return Trash{}, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, "SELECT "+postColumns+", deleted_at FROM post WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id")
+	if err != nil {
+		return Trash{}, err
+	}
+	defer rows.Close()
+	var posts []Post
+	var deleted []time.Time
+	for rows.Next() {
+		var at time.Time
+		p, err := scanPost(rows, &at)
+		if err != nil {
+			return Trash{}, err
+		}
+		posts = append(posts, p)
+		deleted = append(deleted, at)
+	}
+	if err = rows.Err(); err != nil {
+		return Trash{}, err
+	}
+	if posts, err = m.withAuthors(ctx, posts); err != nil {
+		return Trash{}, err
+	}
+	for i, p := range posts {
+		t.Posts = append(t.Posts, TrashedPost{p, deleted[i]})
+	}
+
+	rows, err = m.DB.QueryContext(ctx, "SELECT "+commentColumns+", deleted_at FROM comment WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id")
+	if err != nil {
+		return Trash{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c TrashedComment
+		if c.Comment, err = scanComment(rows, &c.DeletedAt); err != nil {
+			return Trash{}, err
+		}
+		t.Comments = append(t.Comments, c)
+	}
+	if err = rows.Err(); err != nil {
+		return Trash{}, err
+	}
+	return t, nil
+}
+
+// RestoreCategory takes a category out of the trash.
+func (m BlogModel) RestoreCategory(ctx context.Context, id int) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return restore(ctx, m.DB, "category", int64(id))
+}
+
+// RestorePost takes a post out of the trash, with the comments that were
+// deleted along with it. It returns ErrParentInTrash while the post's
+// category is in the trash.
+func (m BlogModel) RestorePost(ctx context.Context, id int) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		var categoryDeleted bool
+		err := tx.QueryRowContext(ctx, "SELECT c.deleted_at IS NOT NULL FROM post p JOIN category c ON c.id = p.category_id WHERE p.id = $1", id).Scan(&categoryDeleted)
+		if err == sql.ErrNoRows {
+			return ErrNotInTrash
+		}
+		if err != nil {
+			return err
+		}
+		if categoryDeleted {
+			return ErrParentInTrash
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE comment SET deleted_at = NULL WHERE post_id = $1 AND deleted_at = (SELECT deleted_at FROM post WHERE id = $1)", id)
+		if err != nil {
+			return err
+		}
+		return restore(ctx, tx, "post", int64(id))
+	})
+}
+
+// RestoreComment takes a comment out of the trash. It returns
+// ErrParentInTrash while the post it was written on is in the trash.
+func (m BlogModel) RestoreComment(ctx context.Context, id int) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		var postDeleted bool
+		err := tx.QueryRowContext(ctx, "SELECT p.deleted_at IS NOT NULL FROM comment c JOIN post p ON p.id = c.post_id WHERE c.id = $1", id).Scan(&postDeleted)
+		if err == sql.ErrNoRows {
+			return ErrNotInTrash
+		}
+		if err != nil {
+			return err
+		}
+		if postDeleted {
+			return ErrParentInTrash
+		}
+		return restore(ctx, tx, "comment", int64(id))
+	})
+}
+
+// restore takes a row of table out of the trash.
+func restore(ctx context.Context, q querier, table string, id int64) error {
+	res, err := q.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL", table), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotInTrash
+	}
+	return nil
+}
+
+// PurgeTrash deletes for good what was moved to the trash before cutoff,
+// along with the comments and images of the posts and categories deleted.
+// Categories that trashed posts still refer to stay until those are purged.
+func (m BlogModel) PurgeTrash(ctx context.Context, cutoff time.Time) (PurgeResult, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var res PurgeResult
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		res = PurgeResult{}
+		const posts = "SELECT id FROM post WHERE deleted_at < $1"
+		const categories = "SELECT id FROM category WHERE deleted_at < $1 AND NOT EXISTS (SELECT 1 FROM post WHERE post.category_id = category.id AND (post.deleted_at IS NULL OR post.deleted_at >= $1))"
+		for _, step := range []struct {
+			query string
+			n     *int64
+		}{
+			{"DELETE FROM comment WHERE deleted_at < $1 OR post_id IN (" + posts + ")", &res.Comments},
+			{"DELETE FROM image WHERE post_id IN (" + posts + ") OR category_id IN (" + categories + ")", &res.Images},
+			{"DELETE FROM post WHERE deleted_at < $1", &res.Posts},
+			{"DELETE FROM category WHERE id IN (" + categories + ")", &res.Categories},
+		} {
+			r, err := tx.ExecContext(ctx, step.query, cutoff)
+			if err != nil {
+				return err
+			}
+			if *step.n, err = r.RowsAffected(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return PurgeResult{}, err
+	}
+	return res, nil
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+var ErrNoTOTPSecret = errors.New("two-factor authentication is not set up")
+
+// TOTPSecret returns the TOTP secret of a user, enrolled or not yet confirmed.
+func (m BlogModel) TOTPSecret(ctx context.Context, userID int64) (string, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	var secret sql.NullString
+	err := m.DB.QueryRowContext(ctx, "SELECT totp_secret FROM users WHERE id = $1", userID).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !secret.Valid {
+		return "", ErrNoTOTPSecret
+	}
+	return secret.String, nil
+}
+
+// SetTOTPSecret stores a new secret for enrollment. Two-factor authentication
+// stays off until EnableTOTP confirms the user can produce codes with it.
+func (m BlogModel) SetTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return updateUser(ctx, m.DB, "UPDATE users SET totp_secret = $1, totp_enabled = FALSE, totp_last_step = NULL WHERE id = $2", secret, userID)
+}
+
+// EnableTOTP turns on two-factor authentication and replaces the recovery
+// codes with the given hashes.
+func (m BlogModel) EnableTOTP(ctx context.Context, userID int64, recoveryHashes []string) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := updateUser(ctx, tx, "UPDATE users SET totp_enabled = TRUE WHERE id = $1 AND totp_secret IS NOT NULL", userID); err != nil {
+			return err
+		}
+		return replaceRecoveryCodes(ctx, tx, userID, recoveryHashes)
+	})
+}
+
+// DisableTOTP turns off two-factor authentication and drops the secret and
+// recovery codes.
+func (m BlogModel) DisableTOTP(ctx context.Context, userID int64) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := updateUser(ctx, tx, "UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = NULL WHERE id = $1", userID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID)
+		return err
+	})
+}
+
+// UseTOTPStep records that the code for time step was used. It returns false
+// if that step or a later one was already used, which stops a code that was
+// seen by someone else from being replayed.
+func (m BlogModel) UseTOTPStep(ctx context.Context, userID, step int64) (bool, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	res, err := m.DB.ExecContext(ctx, "UPDATE users SET totp_last_step = $1 WHERE id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)", step, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ReplaceRecoveryCodes drops the recovery codes of a user and stores new ones.
+func (m BlogModel) ReplaceRecoveryCodes(ctx context.Context, userID int64, hashes []string) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		return replaceRecoveryCodes(ctx, tx, userID, hashes)
+	})
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64, hashes []string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks a recovery code as used. It returns false if the code
+// doesn't exist or was used before.
+func (m BlogModel) UseRecoveryCode(ctx context.Context, userID int64, hash string) (bool, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	res, err := m.DB.ExecContext(ctx, "UPDATE recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL", userID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// TwoFactorRequired reports whether users with role must use two-factor
+// authentication.
+func (m BlogModel) TwoFactorRequired(ctx context.Context, role string) (bool, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	var required bool
+	err := m.DB.QueryRowContext(ctx, "SELECT required FROM two_factor_policy WHERE role = $1", role).Scan(&required)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return required, err
+}
+
+// TwoFactorPolicy returns whether two-factor authentication is required, per
+// role. Roles without a policy aren't listed.
+func (m BlogModel) TwoFactorPolicy(ctx context.Context) (map[string]bool, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, "SELECT role, required FROM two_factor_policy")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	policy := map[string]bool{}
+	for rows.Next() {
+		var role string
+		var required bool
+		if err := rows.Scan(&role, &required); err != nil {
+			return nil, err
+		}
+		policy[role] = required
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// SetTwoFactorRequired sets whether users with role must use two-factor
+// authentication.
+func (m BlogModel) SetTwoFactorRequired(ctx context.Context, role string, required bool) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, "INSERT INTO two_factor_policy (role, required) VALUES ($1, $2) ON CONFLICT (role) DO UPDATE SET required = EXCLUDED.required", role, required)
+	return err
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// txAttempts is how many times WithTx runs a transaction that PostgreSQL
+// keeps aborting because of concurrent ones.
+const txAttempts = 3
+
+// querier is what *sql.DB and *sql.Tx have in common, for helpers that run
+// either on their own or as part of a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// WithTx runs fn in a transaction, which is committed if fn returns nil and
+// rolled back otherwise. A transaction aborted by a serialization failure or
+// a deadlock is retried from the start, so fn must be safe to run again and
+// only touch the database through tx.
+func (m BlogModel) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	var err error
+	for attempt := 0; attempt < txAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, time.Duration(attempt)*50*time.Millisecond); err != nil {
+				return err
+			}
+		}
+		err = m.runTx(ctx, fn)
+		if !retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (m BlogModel) runTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retryable reports whether err aborted a transaction that may succeed when
+// run again.
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	// serialization_failure and deadlock_detected
+	return pqErr.Code == "40001" || pqErr.Code == "40P01"
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,283 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"techblogapi/auth"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrUserNotFound      = errors.New("user not found")
+	ErrDuplicateUsername = errors.New("username is already taken")
+	ErrDuplicateEmail    = errors.New("email is already registered")
+)
+
+const (
+	RoleSuperuser = "superuser"
+	RoleUser      = "user"
+	RoleGuest     = "guest"
+)
+
+const userColumns = "id, is_guest, is_superuser, username, COALESCE(firstname, ''), COALESCE(lastname, ''), COALESCE(email, ''), email_verified, disabled, totp_enabled"
+
+// scanUser scans the columns in userColumns, followed by any extra columns
+// the query selected.
+func scanUser(row interface{ Scan(...interface{}) error }, extra ...interface{}) (User, error) {
+	var u User
+	dest := append([]interface{}{&u.UserID, &u.IsGuest, &u.IsSuperuser, &u.Username, &u.FirstName, &u.LastName, &u.Email, &u.EmailVerified, &u.Disabled, &u.TwoFactor}, extra...)
+	err := row.Scan(dest...)
+	return u, err
+}
+
+// duplicateUserError translates a unique violation on the users indexes into
+// ErrDuplicateUsername or ErrDuplicateEmail.
+func duplicateUserError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err
+	}
+	switch pqErr.Constraint {
+	case "users_username_lower_key":
+		return ErrDuplicateUsername
+	case "users_email_lower_key":
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Duplicate is a username or email shared by several users, ignoring case.
+type Duplicate struct {
+	Field   string
+	Value   string
+	UserIDs []int64
+}
+
+// DuplicateUsers lists usernames and emails that are used by more than one
+// account. They have to be resolved before the unique indexes can be created.
+func (m BlogModel) DuplicateUsers(ctx context.Context) ([]Duplicate, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, `SELECT 'username', LOWER(username), array_agg(id ORDER BY id) FROM users GROUP BY LOWER(username) HAVING COUNT(*) > 1
+		UNION ALL
+		SELECT 'email', LOWER(email), array_agg(id ORDER BY id) FROM users WHERE email <> '' GROUP BY LOWER(email) HAVING COUNT(*) > 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var dups []Duplicate
+	for rows.Next() {
+		var d Duplicate
+		if err := rows.Scan(&d.Field, &d.Value, pq.Array(&d.UserIDs)); err != nil {
+			return nil, err
+		}
+		dups = append(dups, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return dups, nil
+}
+
+// Role names the privilege level of the user: superuser, guest or user.
+func (u User) Role() string {
+	switch {
+	case u.IsSuperuser:
+		return RoleSuperuser
+	case u.IsGuest:
+		return RoleGuest
+	}
+	return RoleUser
+}
+
+func (m BlogModel) UserByUsername(ctx context.Context, username string) (User, error) {
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+	u, err := scanUser(m.DB.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE LOWER(username) = LOWER($1)", username))
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+// SetPassword replaces the password of username with a fresh hash.
+func (m BlogModel) SetPassword(ctx context.Context, username, password string) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	encodedHash, err := auth.GenerateFromPassword(password, m.authParams())
+	if err != nil {
+		return err
+	}
+	return updateUser(ctx, m.DB, "UPDATE users SET password = $1 WHERE LOWER(username) = LOWER($2)", encodedHash, username)
+}
+
+// SetRole changes the privileges of username. Superusers can't also be guests.
+func (m BlogModel) SetRole(ctx context.Context, username string, superuser, guest bool) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	if superuser && guest {
+		return errors.New("a user can't be both superuser and guest")
+	}
+	return updateUser(ctx, m.DB, "UPDATE users SET is_superuser = $1, is_guest = $2 WHERE LOWER(username) = LOWER($3)", superuser, guest, username)
+}
+
+// SetDisabled enables or disables logins for username.
+func (m BlogModel) SetDisabled(ctx context.Context, username string, disabled bool) error {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	return updateUser(ctx, m.DB, "UPDATE users SET disabled = $1 WHERE LOWER(username) = LOWER($2)", disabled, username)
+}
+
+// updateUser runs an update of a single user and returns ErrUserNotFound if
+// it matched none.
+func updateUser(ctx context.Context, q querier, query string, args ...interface{}) error {
+	res, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ReassignPosts moves every post written by from to the user to and returns
+// how many posts were moved.
+func (m BlogModel) ReassignPosts(ctx context.Context, from, to string) (int64, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var n int64
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		// Lock both users so neither is deleted while the posts move
+		ids := make([]int64, 2)
+		for i, username := range []string{from, to} {
+			err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE LOWER(username) = LOWER($1) FOR SHARE", username).Scan(&ids[i])
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("%s: %w", username, ErrUserNotFound)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", username, err)
+			}
+		}
+		res, err := tx.ExecContext(ctx, "UPDATE post SET user_id = $1 WHERE user_id = $2", ids[1], ids[0])
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// RebuildSlugs fills in missing category and post slugs, or regenerates all of
+// them when all is set. Clashing slugs get the row id appended. Nothing is
+// changed unless both tables can be updated. It returns the number of
+// categories and posts updated.
+func (m BlogModel) RebuildSlugs(ctx context.Context, all bool) (int, int, error) {
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+	var categories, posts int
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if categories, err = rebuildSlugs(ctx, tx, "category", "category_name", all); err != nil {
+			return err
+		}
+		posts, err = rebuildSlugs(ctx, tx, "post", "title", all)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return categories, posts, nil
+}
+
+func rebuildSlugs(ctx context.Context, tx *sql.Tx, table, source string, all bool) (int, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT id, %s, COALESCE(slug, '') FROM %s ORDER BY id", source, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	type row struct {
+		id   int64
+		name string
+		slug string
+	}
+	var existing []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.name, &r.slug); err != nil {
+			return 0, err
+		}
+		existing = append(existing, r)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	taken := map[string]bool{}
+	if !all {
+		for _, r := range existing {
+			if r.slug != "" {
+				taken[r.slug] = true
+			}
+		}
+	}
+	updated := 0
+	for _, r := range existing {
+		if !all && r.slug != "" {
+			continue
+		}
+		slug := Slugify(r.name)
+		if slug == "" || taken[slug] {
+			slug = strings.Trim(fmt.Sprintf("%s-%d", slug, r.id), "-")
+		}
+		taken[slug] = true
+		if slug == r.slug {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET slug = $1 WHERE id = $2", table), slug, r.id)
+		if err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// Slugify turns a title into a lowercase, URL friendly slug.
+func Slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimRight(b.String(), "-")
+}
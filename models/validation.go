@@ -0,0 +1,95 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationError lists what is wrong with a category, post or comment, per
+// field, e.g. {"title": ["is required"]}.
+type ValidationError map[string][]string
+
+func (e ValidationError) add(field, problem string) {
+	e[field] = append(e[field], problem)
+}
+
+func (e ValidationError) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		parts[i] = field + ": " + strings.Join(e[field], ", ")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// The checks below catch what the columns would refuse, so that bad input
+// is reported per field instead of failing as a database error. The foreign
+// keys are checked separately, with the referenced rows locked.
+
+func checkLength(e ValidationError, field, value string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		e.add(field, fmt.Sprintf("must be at most %d characters", max))
+	}
+}
+
+func (c Category) problems() ValidationError {
+	e := ValidationError{}
+	if c.CategoryName == "" {
+		e.add("category_name", "is required")
+	}
+	checkLength(e, "category_name", c.CategoryName, 150)
+	checkLength(e, "slug", c.Slug, 200)
+	return e
+}
+
+func (p Post) problems() ValidationError {
+	e := ValidationError{}
+	if p.Title == "" {
+		e.add("title", "is required")
+	}
+	checkLength(e, "title", p.Title, 150)
+	checkLength(e, "slug", p.Slug, 250)
+	if p.ReadTime < 0 {
+		e.add("read_time", "must not be negative")
+	}
+	if p.DateTime.IsZero() {
+		e.add("date_time", "is required")
+	}
+	return e
+}
+
+func (c Comment) problems() ValidationError {
+	e := ValidationError{}
+	if c.Message == "" {
+		e.add("message", "is required")
+	}
+	return e
+}
+
+// Queries for lockIDs, finding the rows a post or comment may refer to.
+const (
+	lockUsers      = "SELECT id FROM users WHERE id = ANY($1) FOR SHARE"
+	lockCategories = "SELECT id FROM category WHERE id = ANY($1) AND deleted_at IS NULL FOR SHARE"
+	lockPosts      = "SELECT id FROM post WHERE id = ANY($1) AND deleted_at IS NULL FOR SHARE"
+)
+
+// checkRef adds problem to e for field unless query finds id, which then
+// stays locked until tx ends.
+func checkRef(ctx context.Context, tx *sql.Tx, e ValidationError, field, query string, id int64, problem string) error {
+	found, err := lockIDs(ctx, tx, query, []int64{id})
+	if err != nil {
+		return err
+	}
+	if !found[id] {
+		e.add(field, problem)
+	}
+	return nil
+}
@@ -55,3 +55,131 @@ ALTER TABLE comment ADD COLUMN post_id INT NOT NULL;
 ALTER TABLE comment ADD CONSTRAINT fk_post_comment FOREIGN KEY(post_id) REFERENCES post(id);
 
 INSERT INTO category(category_name) VALUES('Web Development'), ('Algorithms and Data Structures'), ('New Technologies');
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id BIGSERIAL PRIMARY KEY,
+	actor VARCHAR(150) NOT NULL,
+	action VARCHAR(100) NOT NULL,
+	target_type VARCHAR(50) NOT NULL,
+	target_id VARCHAR(100) NOT NULL,
+	details JSONB NULL,
+	ip VARCHAR(64) NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Usernames and emails are unique regardless of case. The block below lists
+-- any existing duplicates and aborts so they can be resolved by hand first
+-- (admin duplicate-users prints the same report).
+UPDATE users SET email = NULL WHERE email = '';
+
+DO $$
+DECLARE
+	dup RECORD;
+	found BOOLEAN := FALSE;
+BEGIN
+	FOR dup IN
+		SELECT 'username' AS field, LOWER(username) AS value, string_agg(id::text, ', ' ORDER BY id) AS ids
+		FROM users GROUP BY LOWER(username) HAVING COUNT(*) > 1
+		UNION ALL
+		SELECT 'email', LOWER(email), string_agg(id::text, ', ' ORDER BY id)
+		FROM users WHERE email IS NOT NULL GROUP BY LOWER(email) HAVING COUNT(*) > 1
+	LOOP
+		RAISE WARNING 'duplicate % "%" used by users %', dup.field, dup.value, dup.ids;
+		found := TRUE;
+	END LOOP;
+	IF found THEN
+		RAISE EXCEPTION 'resolve the duplicate users listed above before adding the unique indexes';
+	END IF;
+END $$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_key ON users (LOWER(username));
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_key ON users (LOWER(email));
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL,
+	name VARCHAR(100) NOT NULL,
+	prefix VARCHAR(16) NOT NULL,
+	key_hash CHAR(64) NOT NULL UNIQUE,
+	scopes TEXT[] NOT NULL DEFAULT '{}',
+	expires_at TIMESTAMP WITH TIME ZONE NULL,
+	last_used_at TIMESTAMP WITH TIME ZONE NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	revoked_at TIMESTAMP WITH TIME ZONE NULL,
+	CONSTRAINT fk_user_api_key FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL,
+	provider VARCHAR(50) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	email VARCHAR(254) NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	CONSTRAINT fk_user_identity FOREIGN KEY(user_id) REFERENCES users(id),
+	CONSTRAINT user_identities_provider_subject_key UNIQUE (provider, subject)
+);
+
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) NULL;
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NULL;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL,
+	code_hash CHAR(64) NOT NULL,
+	used_at TIMESTAMP WITH TIME ZONE NULL,
+	CONSTRAINT fk_user_recovery_code FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS two_factor_policy (
+	role VARCHAR(20) PRIMARY KEY,
+	required BOOLEAN NOT NULL
+);
+
+ALTER TABLE users ADD COLUMN bio TEXT NULL;
+ALTER TABLE users ADD COLUMN avatar_image_id INT NULL;
+ALTER TABLE users ADD CONSTRAINT fk_image_user_avatar FOREIGN KEY(avatar_image_id) REFERENCES image(id) ON DELETE SET NULL;
+ALTER TABLE users ADD COLUMN website VARCHAR(254) NULL;
+ALTER TABLE users ADD COLUMN social_links JSONB NULL;
+CREATE INDEX IF NOT EXISTS post_user_id_idx ON post (user_id);
+
+ALTER TABLE audit_log ADD COLUMN before JSONB NULL;
+ALTER TABLE audit_log ADD COLUMN after JSONB NULL;
+ALTER TABLE audit_log ADD COLUMN request_id VARCHAR(64) NULL;
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log (target_type, target_id);
+
+-- The audit log is append-only. Only the retention job deletes entries, and it
+-- sets techblogapi.audit_prune for its transaction to be allowed to.
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'DELETE' AND current_setting('techblogapi.audit_prune', true) = 'on' THEN
+		RETURN OLD;
+	END IF;
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();
+DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+	FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only();
+
+-- Deleted categories, posts and comments go to the trash first. They can be
+-- restored until they are purged, TRASH_RETENTION after being deleted.
+ALTER TABLE category ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE NULL;
+ALTER TABLE post ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE NULL;
+ALTER TABLE comment ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE NULL;
+CREATE INDEX IF NOT EXISTS category_deleted_at_idx ON category (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS post_deleted_at_idx ON post (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS comment_deleted_at_idx ON comment (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- Accounts made through an identity provider only got an email it verified
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE users SET email_verified = TRUE WHERE password IS NULL AND email IS NOT NULL;